@@ -0,0 +1,87 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// AllowlistConfig lists the orgs (hex) the gateway takes reports for and,
+// per org, the application ids; an org with no applications listed may
+// use any.  Reports from anything else are written to storageQuarantine
+// and answered 200, so the device purges them; 500 if they could not be
+// written.
+type AllowlistConfig struct {
+	Orgs map[string][]string `json:"orgs"`
+}
+
+// allowlist maps a lower case hex org to its apps; a nil set allows any
+type allowlist map[string]map[string]bool
+
+func compileAllowlist(ac *AllowlistConfig) (allowlist, error) {
+	al := make(allowlist, len(ac.Orgs))
+	for org, apps := range ac.Orgs {
+		if b, err := hex.DecodeString(org); err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("allowlist: org %q is not hex", org)
+		}
+		var set map[string]bool
+		if len(apps) > 0 {
+			set = make(map[string]bool, len(apps))
+			for _, app := range apps {
+				if app == "" {
+					return nil, fmt.Errorf("allowlist: org %s has an empty app id", org)
+				}
+				set[app] = true
+			}
+		}
+		al[strings.ToLower(org)] = set
+	}
+	return al, nil
+}
+
+// check returns the quarantine reason for a report, or ""
+func (al allowlist) check(pi *ParsedInfo) string {
+	apps, ok := al[hex.EncodeToString(pi.OrgId)]
+	if !ok {
+		return QuarantineUnknownOrg
+	}
+	if apps != nil && !apps[string(pi.AppId)] {
+		return QuarantineUnknownApp
+	}
+	return ""
+}
+
+// opAllowlist quarantines a report the allowlist does not cover.  It
+// returns the status to answer with, or 0 when the report goes on.
+func (s *Server) opAllowlist(mc *Config, body []byte, pi *ParsedInfo) int {
+	reason := mc.allowlist.check(pi)
+	if reason == "" {
+		return 0
+	}
+	if reason == QuarantineUnknownOrg {
+		atomic.AddUint64(&s.stats.UnknownOrg, 1)
+	} else {
+		atomic.AddUint64(&s.stats.UnknownApp, 1)
+	}
+	if err := s.opQuarantine(mc, reason, body, pi); err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
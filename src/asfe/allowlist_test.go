@@ -0,0 +1,81 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := parseMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := hex.EncodeToString(pi.OrgId)
+
+	m, qm := newMemStorage(), newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil), WithQuarantine(qm),
+		WithConfig(&Config{Allowlist: &AllowlistConfig{Orgs: map[string][]string{org: nil}}}))
+
+	// Any app of a listed org
+	if code := postMsg(s, data); code != 200 || m.len() != 1 || qm.len() != 0 {
+		t.Fatalf("listed org: %d, %d stored", code, m.len())
+	}
+
+	s.installConfig(&Config{Allowlist: &AllowlistConfig{Orgs: map[string][]string{org: {"com.example.other"}}}})
+	if code := postMsg(s, data); code != 200 || m.len() != 1 || qm.len() != 1 {
+		t.Errorf("unlisted app: %d, %d stored, %d quarantined", code, m.len(), qm.len())
+	}
+	s.installConfig(&Config{Allowlist: &AllowlistConfig{Orgs: map[string][]string{"00ff": nil, org: {string(pi.AppId)}}}})
+	if code := postMsg(s, data); code != 200 || m.len() != 2 {
+		t.Errorf("listed app: %d, %d stored", code, m.len())
+	}
+	s.installConfig(&Config{Allowlist: &AllowlistConfig{Orgs: map[string][]string{"00ff": nil}}})
+	if code := postMsg(s, data); code != 200 || m.len() != 2 || qm.len() != 2 {
+		t.Errorf("unknown org: %d, %d stored, %d quarantined", code, m.len(), qm.len())
+	}
+
+	st := s.Stats()
+	if st.UnknownOrg != 1 || st.UnknownApp != 1 || st.Quarantined != 2 {
+		t.Errorf("stats %+v", st)
+	}
+	// A report that could not be quarantined is not purged
+	qm.fail = true
+	if code := postMsg(s, data); code != 500 || m.len() != 2 {
+		t.Errorf("quarantine failure: %d, %d stored", code, m.len())
+	}
+	qm.fail = false
+
+	for key := range qm.objects {
+		if !strings.HasPrefix(key, "/"+QuarantineUnknownOrg+"/"+org+"/") && !strings.HasPrefix(key, "/"+QuarantineUnknownApp+"/"+org+"/") {
+			t.Errorf("quarantine key %s", key)
+		}
+	}
+
+	if _, err := compileAllowlist(&AllowlistConfig{Orgs: map[string][]string{"org1": nil}}); err == nil {
+		t.Error("accepted a non-hex org")
+	}
+	if _, err := compileAllowlist(&AllowlistConfig{Orgs: map[string][]string{"aa": {""}}}); err == nil {
+		t.Error("accepted an empty app id")
+	}
+}
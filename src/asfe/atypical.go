@@ -0,0 +1,207 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+// AtypicalConfig decides which sightings route a report to the atypical
+// queue.  A sighting is atypical if any rule matches it; overrides replace
+// the default rules for an organization, or for one app of an organization.
+type AtypicalConfig struct {
+	Rules     []AtypicalRule     `json:"rules"`
+	Overrides []AtypicalOverride `json:"overrides,omitempty"`
+}
+
+// AtypicalRule matches when every condition it sets holds; unset
+// conditions match anything.  TestRanges are inclusive [low, high] pairs.
+type AtypicalRule struct {
+	Tests         []uint32    `json:"tests,omitempty"`
+	TestRanges    [][2]uint32 `json:"testRanges,omitempty"`
+	SightingTypes []uint32    `json:"sightingTypes,omitempty"`
+	MinConfidence uint32      `json:"minConfidence,omitempty"`
+	MinImpact     uint32      `json:"minImpact,omitempty"`
+	SystemTypes   []uint32    `json:"systemTypes,omitempty"`
+}
+
+// AtypicalOverride applies to Org (hex), and to App only if it is set.
+type AtypicalOverride struct {
+	Org   string         `json:"org"`
+	App   string         `json:"app,omitempty"`
+	Rules []AtypicalRule `json:"rules"`
+}
+
+// sightingInfo is the part of a Sighting the rules look at
+type sightingInfo struct {
+	test         uint32
+	sightingType uint32
+	confidence   uint32
+	impact       uint32
+}
+
+type atypicalRule struct {
+	tests         map[uint32]bool
+	ranges        [][2]uint32
+	sightingTypes map[uint32]bool
+	minConfidence uint32
+	minImpact     uint32
+	systemTypes   map[uint32]bool
+}
+
+type atypicalOrg struct {
+	rules []atypicalRule
+	apps  map[string][]atypicalRule
+}
+
+type atypicalRules struct {
+	rules  []atypicalRule
+	orgs   map[string]*atypicalOrg // keyed by raw org id bytes
+	detail bool                    // rules look past the test id
+}
+
+var (
+	// The test IDs that were historically hard-coded as atypical
+	DefaultAtypicalTests = []uint32{
+		250, 251, 252, 253, 254, 255,
+		300, 302, 305, 306, 307, 308, 309, 310, 311, 312, 313, 314, 315, 317, 318,
+		400, 401, 402, 403, 405, 406, 409, 410, 411, 412, 413, 414, 416, 417, 418,
+		500, 501, 502, 503, 504, 505,
+	}
+
+	defaultAtypical = mustCompileAtypical(&AtypicalConfig{
+		Rules: []AtypicalRule{{Tests: DefaultAtypicalTests}},
+	})
+)
+
+func uint32Set(l []uint32) map[uint32]bool {
+	if len(l) == 0 {
+		return nil
+	}
+	m := make(map[uint32]bool, len(l))
+	for _, v := range l {
+		m[v] = true
+	}
+	return m
+}
+
+func compileAtypicalRules(l []AtypicalRule) ([]atypicalRule, bool, error) {
+	detail := false
+	out := make([]atypicalRule, 0, len(l))
+	for _, r := range l {
+		for _, rg := range r.TestRanges {
+			if rg[0] > rg[1] {
+				return nil, false, errors.New("atypical test range low > high")
+			}
+		}
+		if len(r.SightingTypes) > 0 || r.MinConfidence > 0 || r.MinImpact > 0 {
+			detail = true
+		}
+		out = append(out, atypicalRule{
+			tests:         uint32Set(r.Tests),
+			ranges:        r.TestRanges,
+			sightingTypes: uint32Set(r.SightingTypes),
+			minConfidence: r.MinConfidence,
+			minImpact:     r.MinImpact,
+			systemTypes:   uint32Set(r.SystemTypes),
+		})
+	}
+	return out, detail, nil
+}
+
+func compileAtypical(ac *AtypicalConfig) (*atypicalRules, error) {
+	var err error
+
+	ar := &atypicalRules{orgs: make(map[string]*atypicalOrg)}
+	if ar.rules, ar.detail, err = compileAtypicalRules(ac.Rules); err != nil {
+		return nil, err
+	}
+
+	for _, o := range ac.Overrides {
+		org, err := hex.DecodeString(o.Org)
+		if err != nil || len(org) == 0 {
+			return nil, errors.New("atypical override has bad org: " + o.Org)
+		}
+		rules, detail, err := compileAtypicalRules(o.Rules)
+		if err != nil {
+			return nil, err
+		}
+		ar.detail = ar.detail || detail
+
+		ao, ok := ar.orgs[string(org)]
+		if !ok {
+			ao = &atypicalOrg{apps: make(map[string][]atypicalRule)}
+			ar.orgs[string(org)] = ao
+		}
+		if o.App == "" {
+			ao.rules = rules
+		} else {
+			ao.apps[o.App] = rules
+		}
+	}
+
+	return ar, nil
+}
+
+func mustCompileAtypical(ac *AtypicalConfig) *atypicalRules {
+	ar, err := compileAtypical(ac)
+	if err != nil {
+		panic(err)
+	}
+	return ar
+}
+
+// forApp picks the most specific rule set for an org/app
+func (ar *atypicalRules) forApp(org, app []byte) []atypicalRule {
+	if ao, ok := ar.orgs[string(org)]; ok {
+		if rules, ok := ao.apps[string(app)]; ok {
+			return rules
+		}
+		if ao.rules != nil {
+			return ao.rules
+		}
+	}
+	return ar.rules
+}
+
+func (r *atypicalRule) match(si *sightingInfo, sysType uint32) bool {
+	if r.tests != nil || len(r.ranges) > 0 {
+		ok := r.tests[si.test]
+		for i := 0; !ok && i < len(r.ranges); i++ {
+			ok = si.test >= r.ranges[i][0] && si.test <= r.ranges[i][1]
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.sightingTypes != nil && !r.sightingTypes[si.sightingType] {
+		return false
+	}
+	if r.systemTypes != nil && !r.systemTypes[sysType] {
+		return false
+	}
+	return si.confidence >= r.minConfidence && si.impact >= r.minImpact
+}
+
+func matchAtypical(rules []atypicalRule, si *sightingInfo, sysType uint32) bool {
+	for i := range rules {
+		if rules[i].match(si, sysType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func testAtypicalRules(t *testing.T, js string) *atypicalRules {
+	ac := &AtypicalConfig{}
+	if err := json.Unmarshal([]byte(js), ac); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := compileAtypical(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ar
+}
+
+func TestAtypicalRules(t *testing.T) {
+	ar := mustCompileAtypical(&AtypicalConfig{
+		Rules: []AtypicalRule{
+			{TestRanges: [][2]uint32{{600, 610}}, MinConfidence: 2},
+			{SightingTypes: []uint32{4}, SystemTypes: []uint32{2}},
+		},
+		Overrides: []AtypicalOverride{
+			{Org: "abcd", Rules: []AtypicalRule{{Tests: []uint32{1}}}},
+			{Org: "abcd", App: "com.app", Rules: []AtypicalRule{}},
+		},
+	})
+
+	rules := ar.forApp([]byte{0x01}, []byte("x"))
+	for _, c := range []struct {
+		si      sightingInfo
+		sysType uint32
+		want    bool
+	}{
+		{sightingInfo{test: 605, confidence: 2}, 1, true},
+		{sightingInfo{test: 605, confidence: 1}, 1, false},
+		{sightingInfo{test: 611, confidence: 3}, 1, false},
+		{sightingInfo{test: 1, sightingType: 4}, 2, true},
+		{sightingInfo{test: 1, sightingType: 4}, 1, false},
+	} {
+		if got := matchAtypical(rules, &c.si, c.sysType); got != c.want {
+			t.Errorf("%+v sys %d: got %v", c.si, c.sysType, got)
+		}
+	}
+
+	si := sightingInfo{test: 1}
+	if !matchAtypical(ar.forApp([]byte{0xab, 0xcd}, []byte("other")), &si, 1) {
+		t.Error("org override not applied")
+	}
+	if matchAtypical(ar.forApp([]byte{0xab, 0xcd}, []byte("com.app")), &si, 1) {
+		t.Error("app override not applied")
+	}
+
+	if _, err := compileAtypical(&AtypicalConfig{Overrides: []AtypicalOverride{{Org: "zz"}}}); err == nil {
+		t.Error("bad org accepted")
+	}
+}
+
+func TestAtypicalParse(t *testing.T) {
+	for _, name := range []string{"testdata/test_msg_sp.bin", "testdata/test_msg_fp.bin"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The fixtures carry test 407, which is not atypical by default
+		pi, err := parseMsg(data)
+		if err != nil || pi.Atypical {
+			t.Errorf("%s default: %v %v", name, pi, err)
+		}
+
+		pi, err = parseMsgRules(data, testAtypicalRules(t, `{"rules":[{"tests":[407]}]}`))
+		if err != nil || !pi.Atypical {
+			t.Errorf("%s tests rule: %v %v", name, pi, err)
+		}
+
+		// Needs the sighting detail, which must not force the fast path to fall back
+		pi, err = parseMsgRules(data, testAtypicalRules(t, `{"rules":[{"tests":[407],"minImpact":1}]}`))
+		if err != nil || pi.Atypical {
+			t.Errorf("%s impact rule: %v %v", name, pi, err)
+		}
+		if name == "testdata/test_msg_fp.bin" && pi.Fallback {
+			t.Errorf("%s fell back", name)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AuthTimestampHeader = "X-Asfe-Timestamp"
+	AuthSignatureHeader = "X-Asfe-Signature"
+	AuthDefaultWindow   = 5 * time.Minute
+
+	AuthPolicyAllow      = "allow"
+	AuthPolicyDrop       = "drop"
+	AuthPolicyQuarantine = "quarantine"
+
+	replayCacheMax = 1 << 20
+)
+
+var (
+	AuthMissingError    = errors.New("Request is not signed")
+	AuthSignatureError  = errors.New("Request signature does not verify")
+	AuthExpiredError    = errors.New("Request timestamp outside the replay window")
+	AuthReplayError     = errors.New("Request signature already accepted")
+	AuthReplayFullError = errors.New("Too many signed requests inside the replay window")
+)
+
+// AuthConfig turns on request signatures.  A signed request carries
+//
+//	X-Asfe-Timestamp: <unix seconds>
+//	X-Asfe-Signature: org=<org id hex>,key=<key id>,sig=<base64 MAC>
+//
+// where the MAC is HMAC-SHA256 with the key over the timestamp, a ".", and
+// the body (see SignMsg).  The timestamp has to be within WindowSeconds of
+// the gateway's clock, a signature is only accepted once, and the signed
+// org has to be the org in the report.
+//
+// A request that fails is handled by the policy of its org: "drop" (the
+// default for orgs listed here) answers 401, "quarantine" stores it in
+// storageQuarantine and answers 200, and "allow" accepts it anyway, for
+// rolling signatures out.  Orgs not listed follow Policy, "allow" by default.
+type AuthConfig struct {
+	WindowSeconds int                       `json:"windowSeconds,omitempty"`
+	Policy        string                    `json:"policy,omitempty"`
+	Orgs          map[string]*OrgAuthConfig `json:"orgs"`
+}
+
+// OrgAuthConfig holds an org's keys by key id, base64 encoded; several
+// keys let them be rotated
+type OrgAuthConfig struct {
+	Keys   map[string]string `json:"keys"`
+	Policy string            `json:"policy,omitempty"`
+}
+
+type authRules struct {
+	window time.Duration
+	policy string
+	orgs   map[string]*orgAuth // by lower case hex org id
+}
+
+type orgAuth struct {
+	keys   map[string][]byte
+	policy string
+}
+
+func validAuthPolicy(p string) bool {
+	return p == "" || p == AuthPolicyAllow || p == AuthPolicyDrop || p == AuthPolicyQuarantine
+}
+
+func compileAuth(ac *AuthConfig) (*authRules, error) {
+	if ac.WindowSeconds < 0 {
+		return nil, errors.New("auth: windowSeconds cannot be negative")
+	}
+	if !validAuthPolicy(ac.Policy) {
+		return nil, fmt.Errorf("auth: unknown policy %q", ac.Policy)
+	}
+
+	ar := &authRules{window: AuthDefaultWindow, policy: ac.Policy, orgs: make(map[string]*orgAuth, len(ac.Orgs))}
+	if ac.WindowSeconds > 0 {
+		ar.window = time.Duration(ac.WindowSeconds) * time.Second
+	}
+	if ar.policy == "" {
+		ar.policy = AuthPolicyAllow
+	}
+
+	for org, oc := range ac.Orgs {
+		if b, err := hex.DecodeString(org); err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("auth: org %q is not hex", org)
+		}
+		if oc == nil || len(oc.Keys) == 0 {
+			return nil, fmt.Errorf("auth: org %s has no keys", org)
+		}
+		if !validAuthPolicy(oc.Policy) {
+			return nil, fmt.Errorf("auth: org %s: unknown policy %q", org, oc.Policy)
+		}
+		oa := &orgAuth{keys: make(map[string][]byte, len(oc.Keys)), policy: oc.Policy}
+		if oa.policy == "" {
+			oa.policy = AuthPolicyDrop
+		}
+		for kid, b64 := range oc.Keys {
+			key, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil || len(key) < 16 {
+				return nil, fmt.Errorf("auth: org %s key %s: needs 16 or more base64 bytes", org, kid)
+			}
+			oa.keys[kid] = key
+		}
+		ar.orgs[strings.ToLower(org)] = oa
+	}
+	return ar, nil
+}
+
+// quarantines reports whether any policy quarantines
+func (ar *authRules) quarantines() bool {
+	if ar.policy == AuthPolicyQuarantine {
+		return true
+	}
+	for _, oa := range ar.orgs {
+		if oa.policy == AuthPolicyQuarantine {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFor returns what happens to a request from org that fails
+func (ar *authRules) policyFor(org string) string {
+	if oa := ar.orgs[org]; oa != nil {
+		return oa.policy
+	}
+	return ar.policy
+}
+
+func authMAC(key []byte, ts string, body []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(ts))
+	m.Write([]byte{'.'})
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// SignMsg adds the signature headers for a report body to h
+func SignMsg(h http.Header, body, org []byte, kid string, key []byte, t time.Time) {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	h.Set(AuthTimestampHeader, ts)
+	h.Set(AuthSignatureHeader, "org="+hex.EncodeToString(org)+",key="+kid+",sig="+
+		base64.StdEncoding.EncodeToString(authMAC(key, ts, body)))
+}
+
+// authResult is the outcome of a signature check; org is the org the
+// request claims, when it claims one.  sig is the decoded MAC, so another
+// base64 spelling of it is the same signature.
+type authResult struct {
+	org string
+	sig string
+	err error
+}
+
+// verify checks the signature headers of a request against its body
+func (ar *authRules) verify(h http.Header, body []byte, now time.Time) authResult {
+	ts, sh := h.Get(AuthTimestampHeader), h.Get(AuthSignatureHeader)
+	if ts == "" && sh == "" {
+		return authResult{err: AuthMissingError}
+	}
+
+	var res authResult
+	var kid, enc string
+	for _, f := range strings.Split(sh, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "org":
+			res.org = strings.ToLower(kv[1])
+		case "key":
+			kid = kv[1]
+		case "sig":
+			enc = kv[1]
+		}
+	}
+
+	res.err = AuthSignatureError
+	var key []byte
+	if oa := ar.orgs[res.org]; oa != nil {
+		key = oa.keys[kid]
+	}
+	sig, err := base64.StdEncoding.Strict().DecodeString(enc)
+	if key == nil || err != nil || !hmac.Equal(sig, authMAC(key, ts, body)) {
+		return res
+	}
+	res.sig = string(sig)
+
+	// Only an authentic timestamp says anything about replay
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return res
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > ar.window || d < -ar.window {
+		res.err = AuthExpiredError
+		return res
+	}
+	res.err = nil
+	return res
+}
+
+// authenticate checks a request's signature before its body is parsed; the
+// org it claims is checked against the report after
+func (s *Server) authenticate(ar *authRules, h http.Header, body []byte) authResult {
+	res := ar.verify(h, body, s.now())
+	switch res.err {
+	case AuthMissingError:
+		atomic.AddUint64(&s.stats.ErrAuthMissing, 1)
+	case AuthExpiredError:
+		atomic.AddUint64(&s.stats.ErrAuthExpired, 1)
+	case AuthSignatureError:
+		atomic.AddUint64(&s.stats.ErrAuthSignature, 1)
+	}
+	return res
+}
+
+// opAuthPolicy applies org's policy to a request that failed
+// authentication.  It returns the status to answer with, or 0 when the
+// request goes on as if it had passed.
+func (s *Server) opAuthPolicy(mc *Config, org string, body []byte) int {
+	switch mc.auth.policyFor(org) {
+	case AuthPolicyDrop:
+		atomic.AddUint64(&s.stats.AuthDropped, 1)
+		return http.StatusUnauthorized
+	case AuthPolicyQuarantine:
+		if err := s.opQuarantine(mc, QuarantineAuth, body, nil); err != nil {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	}
+	atomic.AddUint64(&s.stats.AuthAllowed, 1)
+	return 0
+}
+
+// replayCache remembers the signatures of accepted requests while their
+// timestamps are still inside the window
+type replayCache struct {
+	mu     sync.Mutex
+	max    int
+	sigs   map[string]time.Time // signature to expiry
+	expiry replayHeap           // soonest first; may hold stale entries
+}
+
+type replayEntry struct {
+	sig string
+	exp time.Time
+}
+
+// replayHeap orders signatures by expiry, so expired ones leave from the top
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].exp.Before(h[j].exp) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newReplayCache(max int) *replayCache {
+	return &replayCache{max: max, sigs: make(map[string]time.Time)}
+}
+
+// claim records a signature before its request is handled, so copies of
+// the request sent at the same time are not all handled.  It fails with
+// AuthReplayError when the signature was already claimed, and with
+// AuthReplayFullError when the cache holds max unexpired signatures.
+func (rc *replayCache) claim(sig string, now time.Time, window time.Duration) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if exp, ok := rc.sigs[sig]; ok && now.Before(exp) {
+		return AuthReplayError
+	}
+	for len(rc.expiry) > 0 && !now.Before(rc.expiry[0].exp) {
+		e := heap.Pop(&rc.expiry).(replayEntry)
+		if exp, ok := rc.sigs[e.sig]; ok && exp.Equal(e.exp) {
+			delete(rc.sigs, e.sig)
+		}
+	}
+	if len(rc.sigs) >= rc.max {
+		return AuthReplayFullError
+	}
+
+	// A timestamp up to window ahead stays valid for up to two windows
+	e := replayEntry{sig: sig, exp: now.Add(2 * window)}
+	rc.sigs[sig] = e.exp
+	heap.Push(&rc.expiry, e)
+	if len(rc.expiry) > 2*rc.max {
+		// Released signatures leave stale entries behind
+		rc.expiry = rc.expiry[:0]
+		for k, exp := range rc.sigs {
+			rc.expiry = append(rc.expiry, replayEntry{sig: k, exp: exp})
+		}
+		heap.Init(&rc.expiry)
+	}
+	return nil
+}
+
+// release forgets a claimed signature whose request was not accepted, so
+// the device can send it again
+func (rc *replayCache) release(sig string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.sigs, sig)
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testAuthKey  = []byte("0123456789abcdef0123456789abcdef")
+	testOtherKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func postSigned(s *Server, body, org []byte, kid string, key []byte, t time.Time) int {
+	req := httptest.NewRequest("POST", "/v1/msg", bytes.NewReader(body))
+	if key != nil {
+		SignMsg(req.Header, body, org, kid, key, t)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAuthPolicies(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := parseMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := hex.EncodeToString(pi.OrgId)
+	other := []byte{0xaa, 0xbb}
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := func(policy string) *Config {
+		return &Config{Auth: &AuthConfig{Orgs: map[string]*OrgAuthConfig{
+			org:    {Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(testAuthKey)}, Policy: policy},
+			"aabb": {Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(testOtherKey)}},
+		}}}
+	}
+
+	m, qm := newMemStorage(), newMemStorage()
+	s := newTestServer(t, WithConfig(config("")), WithStorage(m, nil), WithQuarantine(qm),
+		WithClock(func() time.Time { return now }))
+
+	if code := postSigned(s, data, pi.OrgId, "k1", testAuthKey, now.Add(-time.Minute)); code != 200 || m.len() != 1 {
+		t.Fatalf("signed: %d, %d stored", code, m.len())
+	}
+	// The same request again is acknowledged, not stored
+	if code := postSigned(s, data, pi.OrgId, "k1", testAuthKey, now.Add(-time.Minute)); code != 200 || m.len() != 1 {
+		t.Errorf("replay: %d, %d stored", code, m.len())
+	}
+
+	// Unsigned, wrong key, stale, and signed for another org
+	cases := []struct {
+		org []byte
+		key []byte
+		at  time.Time
+	}{
+		{nil, nil, now},
+		{pi.OrgId, testOtherKey, now},
+		{pi.OrgId, testAuthKey, now.Add(-time.Hour)},
+		{other, testOtherKey, now},
+	}
+	for i, c := range cases {
+		if code := postSigned(s, data, c.org, "k1", c.key, c.at); code != http.StatusUnauthorized {
+			t.Errorf("%d: drop policy answered %d", i, code)
+		}
+	}
+	st := s.Stats()
+	if st.AuthVerified != 1 || st.AuthReplay != 1 || st.AuthDropped != 4 || st.ErrAuthMissing != 1 ||
+		st.ErrAuthSignature != 2 || st.ErrAuthExpired != 1 || m.len() != 1 {
+		t.Errorf("stats %+v, %d stored", st, m.len())
+	}
+
+	// Quarantine keeps the report apart; allow takes it in
+	s.installConfig(config(AuthPolicyQuarantine))
+	if code := postSigned(s, data, pi.OrgId, "k1", testOtherKey, now); code != 200 || qm.len() != 1 || m.len() != 1 {
+		t.Errorf("quarantine: %d, %d quarantined", code, qm.len())
+	}
+	for key := range qm.objects {
+		if !strings.HasPrefix(key, "/"+QuarantineAuth+"/2019-05-01T12:00:00_") {
+			t.Errorf("quarantine key %s", key)
+		}
+	}
+	s.installConfig(config(AuthPolicyAllow))
+	if code := postSigned(s, data, nil, "", nil, now); code != 200 || m.len() != 2 || st.AuthAllowed != 1 {
+		t.Errorf("allow: %d, %d stored", code, m.len())
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := parseMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &AuthConfig{Orgs: map[string]*OrgAuthConfig{
+		hex.EncodeToString(pi.OrgId): {Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(testAuthKey)}},
+	}}
+	now := time.Now()
+
+	// Another spelling of the same MAC, in the unused bits before the pad,
+	// does not verify
+	ar, err := compileAuth(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{}
+	SignMsg(h, data, pi.OrgId, "k1", testAuthKey, now)
+	if res := ar.verify(h, data, now); res.err != nil {
+		t.Fatal(res.err)
+	}
+	const b64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	sh := []byte(h.Get(AuthSignatureHeader))
+	i := bytes.LastIndexByte(sh, '=') - 1
+	sh[i] = b64[strings.IndexByte(b64, sh[i])^1]
+	h.Set(AuthSignatureHeader, string(sh))
+	if res := ar.verify(h, data, now); res.err != AuthSignatureError {
+		t.Errorf("non-canonical signature: %v", res.err)
+	}
+
+	// Copies of a request sent at once are handled once
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil), WithConfig(&Config{Auth: ac}))
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postSigned(s, data, pi.OrgId, "k1", testAuthKey, now)
+		}()
+	}
+	wg.Wait()
+	if st := s.Stats(); m.len() != 1 || st.AuthReplay != 7 {
+		t.Errorf("%d stored, %d replays", m.len(), st.AuthReplay)
+	}
+
+	// A request that was not accepted can be sent again
+	rc := newReplayCache(2)
+	if rc.claim("sig", now, time.Minute) != nil || rc.claim("sig", now, time.Minute) != AuthReplayError {
+		t.Error("claimed twice")
+	}
+	rc.release("sig")
+	if rc.claim("sig", now, time.Minute) != nil {
+		t.Error("released signature not claimable")
+	}
+
+	// A full cache refuses new signatures until the oldest expire
+	rc.claim("a", now.Add(time.Second), time.Minute)
+	if err := rc.claim("b", now.Add(time.Second), time.Minute); err != AuthReplayFullError {
+		t.Errorf("full cache: %v", err)
+	}
+	if err := rc.claim("b", now.Add(2*time.Minute), time.Minute); err != nil || len(rc.sigs) != 2 {
+		t.Errorf("after expiry: %v, %d held", err, len(rc.sigs))
+	}
+}
+
+func TestAuthConfigInvalid(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testAuthKey)
+	bad := []*AuthConfig{
+		{WindowSeconds: -1},
+		{Policy: "maybe"},
+		{Orgs: map[string]*OrgAuthConfig{"xyz": {Keys: map[string]string{"k": key}}}},
+		{Orgs: map[string]*OrgAuthConfig{"aa": {}}},
+		{Orgs: map[string]*OrgAuthConfig{"aa": {Keys: map[string]string{"k": "c2hvcnQ="}}}},
+		{Orgs: map[string]*OrgAuthConfig{"aa": {Keys: map[string]string{"k": key}, Policy: "log"}}},
+	}
+	for i, ac := range bad {
+		if _, err := compileAuth(ac); err == nil {
+			t.Errorf("%d: accepted", i)
+		}
+	}
+
+	c := &Config{StoragePrimary: &StorageConfig{Driver: "file", Path: "/tmp"},
+		Auth: &AuthConfig{Policy: AuthPolicyQuarantine}}
+	if c.Validate() == nil {
+		t.Error("quarantine policy without storageQuarantine")
+	}
+}
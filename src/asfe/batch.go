@@ -0,0 +1,394 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BatchFormatProtobuf = "protobuf"
+	BatchFormatNDJSON   = "ndjson"
+
+	BatchAckBuffered = "buffered" // 200 once the report is in memory
+	BatchAckLogged   = "logged"   // 200 once the report is in the WAL
+	BatchAckStored   = "stored"   // 200 once the batch object is stored
+
+	BatchDefaultPartition = "/{org}/{app}/{yyyy}/{mm}/{dd}/{hh}"
+	BatchDefaultMaxBytes  = (8 * 1024 * 1024)
+	BatchDefaultMaxAge    = 60 * time.Second
+	batchTick             = 1 * time.Second
+)
+
+var (
+	BatchFlushError = errors.New("Batch could not be stored")
+)
+
+// BatchConfig enables batching mode: instead of one object per report,
+// reports are appended to a per-partition object, stored once it reaches
+// MaxBytes or MaxSeconds.  Protobuf objects hold uvarint length-delimited
+// Report messages; NDJSON objects hold the decoded events.  WALPath keeps
+// unflushed reports on disk across a crash.  With the stored ack, batches
+// are stored within half of the listener's write timeout.  A report whose
+// batch is not stored in time fails with 500, unless WALPath holds it; then
+// it is acked anyway and still retried.
+type BatchConfig struct {
+	Format     string `json:"format,omitempty"`
+	Partition  string `json:"partition,omitempty"`
+	MaxBytes   int    `json:"maxBytes,omitempty"`
+	MaxSeconds int    `json:"maxSeconds,omitempty"`
+	Compress   string `json:"compress,omitempty"`
+	WALPath    string `json:"walPath,omitempty"`
+	Ack        string `json:"ack,omitempty"`
+}
+
+func batchValidate(bc *BatchConfig) error {
+	switch bc.Format {
+	case "", BatchFormatProtobuf, BatchFormatNDJSON:
+	default:
+		return fmt.Errorf("batch: unknown format %q", bc.Format)
+	}
+	switch bc.Compress {
+	case "", "gzip":
+	default:
+		return fmt.Errorf("batch: unknown compression %q", bc.Compress)
+	}
+	switch bc.Ack {
+	case "", BatchAckBuffered, BatchAckStored:
+	case BatchAckLogged:
+		if bc.WALPath == "" {
+			return errors.New("batch: logged ack requires walPath")
+		}
+	default:
+		return fmt.Errorf("batch: unknown ack %q", bc.Ack)
+	}
+	partition := bc.Partition
+	if partition == "" {
+		partition = BatchDefaultPartition
+	}
+	_, err := compilePartitionTemplate(partition)
+	return err
+}
+
+type batch struct {
+	partition string
+	buf       bytes.Buffer
+	count     int
+	opened    time.Time
+	wal       *Spool
+	walDir    string
+	waiters   []chan error
+}
+
+type batchWriter struct {
+	s         *Server
+	bc        *BatchConfig
+	partition *keyTemplate
+	ack       string
+	ackWait   time.Duration
+	maxBytes  int
+	maxAge    time.Duration
+	ext       string
+
+	mu      sync.Mutex
+	batches map[string]*batch
+	failed  []*batch
+	walSeq  uint64
+	objSeq  uint64
+}
+
+// newBatchWriter takes the listener config for the stored ack, which must
+// answer before the write timeout; lc may be nil
+func newBatchWriter(s *Server, bc *BatchConfig, lc *ListenConfig) (*batchWriter, error) {
+	if err := batchValidate(bc); err != nil {
+		return nil, err
+	}
+
+	w := &batchWriter{
+		s:        s,
+		bc:       bc,
+		ack:      bc.Ack,
+		maxBytes: BatchDefaultMaxBytes,
+		maxAge:   BatchDefaultMaxAge,
+		ext:      ".pb",
+		batches:  make(map[string]*batch),
+	}
+	partition := bc.Partition
+	if partition == "" {
+		partition = BatchDefaultPartition
+	}
+	w.partition, _ = compilePartitionTemplate(partition)
+	if w.ack == "" {
+		w.ack = BatchAckBuffered
+		if bc.WALPath != "" {
+			w.ack = BatchAckLogged
+		}
+	}
+	if bc.MaxBytes > 0 {
+		w.maxBytes = bc.MaxBytes
+	}
+	if bc.MaxSeconds > 0 {
+		w.maxAge = time.Duration(bc.MaxSeconds) * time.Second
+	}
+	if w.ack == BatchAckStored {
+		if lc == nil {
+			lc = &ListenConfig{}
+		}
+		w.ackWait = seconds(lc.WriteTimeoutSeconds, ListenDefaultWriteTimeout) * 3 / 4
+		if w.maxAge > w.ackWait/2 {
+			w.maxAge = w.ackWait / 2
+		}
+	}
+	if bc.Format == BatchFormatNDJSON {
+		w.ext = ".ndjson"
+	}
+	if bc.Compress == "gzip" {
+		w.ext += ".gz"
+	}
+
+	if bc.WALPath != "" {
+		if err := os.MkdirAll(bc.WALPath, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// recover re-adds the reports left in WALs by a previous run
+func (w *batchWriter) recover() error {
+	if w.bc.WALPath == "" {
+		return nil
+	}
+	dirs, err := ioutil.ReadDir(w.bc.WALPath)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(w.bc.WALPath, d.Name())
+		wal, err := OpenSpool(dir, 0)
+		if err != nil {
+			return err
+		}
+		_, err = wal.Replay(func(partition string, r io.ReadSeeker) error {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			full, _, err := w.append(partition, data, false)
+			if full != nil {
+				w.flush(full)
+			}
+			return err
+		})
+		wal.Close()
+		if err != nil {
+			return err
+		}
+		os.RemoveAll(dir)
+	}
+	return nil
+}
+
+func (w *batchWriter) encode(data []byte) ([]byte, error) {
+	if w.bc.Format == BatchFormatNDJSON {
+		events, err := DecodeEvents(data)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = WriteEventsJSON(&buf, events)
+		return buf.Bytes(), err
+	}
+
+	out := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(out, uint64(len(data)))
+	return append(out[:n], data...), nil
+}
+
+// append adds a report to its partition's batch.  A batch that reached
+// maxBytes is detached and returned for the caller to flush.
+func (w *batchWriter) append(partition string, data []byte, wait bool) (*batch, chan error, error) {
+	rec, err := w.encode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b := w.batches[partition]
+	if b == nil {
+		b = &batch{partition: partition, opened: w.s.now()}
+		if w.bc.WALPath != "" {
+			w.walSeq++
+			b.walDir = filepath.Join(w.bc.WALPath, fmt.Sprintf("%d-%d", b.opened.UnixNano(), w.walSeq))
+			wal, err := OpenSpool(b.walDir, 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			b.wal = wal
+		}
+		w.batches[partition] = b
+	}
+
+	if b.wal != nil {
+		if err := b.wal.Append(partition, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	b.buf.Write(rec)
+	b.count++
+
+	var ch chan error
+	if wait {
+		ch = make(chan error, 1)
+		b.waiters = append(b.waiters, ch)
+	}
+	if b.buf.Len() >= w.maxBytes {
+		delete(w.batches, partition)
+		return b, ch, nil
+	}
+	return nil, ch, nil
+}
+
+// add batches one report, waiting for it to be stored if the ack mode asks
+func (w *batchWriter) add(ctx context.Context, partition string, data []byte) error {
+	full, ch, err := w.append(partition, data, w.ack == BatchAckStored)
+	if err != nil {
+		return err
+	}
+	if full != nil {
+		w.flush(full)
+	}
+	if ch == nil {
+		return nil
+	}
+
+	t := time.NewTimer(w.ackWait)
+	defer t.Stop()
+	select {
+	case err = <-ch:
+	case <-t.C:
+		err = BatchFlushError
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err == nil {
+		return nil
+	}
+	if w.bc.WALPath == "" {
+		// Only memory holds the report; the device must send it again
+		return err
+	}
+	// The WAL holds the report and it is retried; failing the request would
+	// only have the device send it again
+	atomic.AddUint64(&w.s.stats.BatchAckLate, 1)
+	return nil
+}
+
+func (w *batchWriter) objectKey(b *batch) string {
+	seq := atomic.AddUint64(&w.objSeq, 1)
+	return fmt.Sprintf("%s/%s_%x%s", b.partition, w.s.keys.timestamp().ts, seq, w.ext)
+}
+
+// flush stores a detached batch.  A batch that cannot be stored is kept,
+// WAL and all, and retried on the next tick.
+func (w *batchWriter) flush(b *batch) {
+	data := b.buf.Bytes()
+	if w.bc.Compress == "gzip" {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		zw.Write(data)
+		zw.Close()
+		data = zb.Bytes()
+	}
+
+	if err := w.s.opPutObject(data, w.objectKey(b)); err != nil {
+		atomic.AddUint64(&w.s.stats.ErrBatch, 1)
+		w.notify(b, BatchFlushError)
+		w.mu.Lock()
+		w.failed = append(w.failed, b)
+		w.mu.Unlock()
+		return
+	}
+
+	atomic.AddUint64(&w.s.stats.BatchObjects, 1)
+	atomic.AddUint64(&w.s.stats.BatchReports, uint64(b.count))
+	w.notify(b, nil)
+	if b.wal != nil {
+		b.wal.Close()
+		os.RemoveAll(b.walDir)
+	}
+}
+
+func (w *batchWriter) notify(b *batch, err error) {
+	for _, ch := range b.waiters {
+		ch <- err
+	}
+	b.waiters = nil
+}
+
+// flushDue flushes batches older than maxAge, and retries failed ones;
+// all flushes everything
+func (w *batchWriter) flushDue(all bool) {
+	now := w.s.now()
+
+	w.mu.Lock()
+	due := w.failed
+	w.failed = nil
+	for p, b := range w.batches {
+		if all || now.Sub(b.opened) >= w.maxAge {
+			due = append(due, b)
+			delete(w.batches, p)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, b := range due {
+		w.flush(b)
+	}
+}
+
+func (w *batchWriter) worker(done chan struct{}) {
+	tick := time.NewTicker(batchTick)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			w.flushDue(false)
+		case <-done:
+			w.flushDue(true)
+			return
+		}
+	}
+}
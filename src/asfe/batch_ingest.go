@@ -0,0 +1,179 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMaxBatchLength = (4 * 1024 * 1024)
+	DefaultMaxBatchItems  = 1000
+)
+
+var (
+	BatchFrameError    = errors.New("Batch is not a stream of length-delimited reports")
+	BatchTooLargeError = errors.New("Batch has too many reports")
+)
+
+func (c *Config) maxBatchLength() int {
+	if c.Body != nil && c.Body.MaxBatchBytes > 0 {
+		return c.Body.MaxBatchBytes
+	}
+	return DefaultMaxBatchLength
+}
+
+func (c *Config) maxBatchItems() int {
+	if c.Body != nil && c.Body.MaxBatchItems > 0 {
+		return c.Body.MaxBatchItems
+	}
+	return DefaultMaxBatchItems
+}
+
+// splitDelimited splits a batch into its reports, each prefixed with its
+// length as a varint (as protobuf's writeDelimitedTo does).  The reports
+// are slices of data.
+func splitDelimited(data []byte, max int) ([][]byte, error) {
+	var items [][]byte
+	for len(data) > 0 {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return nil, BatchFrameError
+		}
+		if len(items) == max {
+			return nil, BatchTooLargeError
+		}
+		items = append(items, data[n:n+int(l)])
+		data = data[n+int(l):]
+	}
+	return items, nil
+}
+
+// batchResponse has the status of each report, in order; the reports
+// answered 200 can be purged, as they would be from /v1/msg
+type batchResponse struct {
+	Status []int `json:"status"`
+}
+
+// handleBatch takes the reports a device queued while offline in one
+// request.  Each report is handled as /v1/msg would; a signature covers
+// the whole batch.  Reports not reached by three quarters of the write
+// timeout are answered 503, so the answer still gets out.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	mc := s.loadConfig()
+	atomic.AddUint64(&s.stats.BatchRequest, 1)
+
+	if r.Method != "POST" || r.ContentLength == 0 {
+		atomic.AddUint64(&s.stats.ErrDiscarded, 1)
+		w.WriteHeader(200)
+		return
+	}
+
+	lc := mc.Listen
+	if lc == nil {
+		lc = &ListenConfig{}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), seconds(lc.WriteTimeoutSeconds, ListenDefaultWriteTimeout)*3/4)
+	defer cancel()
+
+	done := s.opAdmit(mc, w)
+	if done == nil {
+		return
+	}
+	defer done()
+
+	body, release, err := s.readBody(r, mc.maxBatchLength())
+	if err != nil {
+		s.bodyError(w, err)
+		return
+	}
+	defer release()
+
+	items, err := splitDelimited(body, mc.maxBatchItems())
+	if err != nil {
+		atomic.AddUint64(&s.stats.ErrBatchFrame, 1)
+		if err == BatchTooLargeError {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	resp := batchResponse{Status: make([]int, len(items))}
+
+	var auth authResult
+	replayed := false
+	if mc.auth != nil {
+		auth = s.authenticate(mc.auth, r.Header, body)
+		if auth.err == nil {
+			switch s.replay.claim(auth.sig, s.now(), mc.auth.window) {
+			case AuthReplayError:
+				replayed = true
+			case AuthReplayFullError:
+				atomic.AddUint64(&s.stats.ErrAuthReplayFull, 1)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+
+	var retry time.Duration
+	accepted := true
+	for i, item := range items {
+		resp.Status[i] = 200
+		switch {
+		case replayed:
+			// Already accepted; the device did not get our answer
+		case len(item) == 0:
+			atomic.AddUint64(&s.stats.ErrDiscarded, 1)
+		case ctx.Err() != nil:
+			atomic.AddUint64(&s.stats.ErrBatchDeadline, 1)
+			resp.Status[i] = http.StatusServiceUnavailable
+			if retry < time.Second {
+				retry = time.Second
+			}
+			accepted = false
+		default:
+			atomic.AddUint64(&s.stats.BatchItems, 1)
+			res := s.handleReport(ctx, mc, item, auth)
+			resp.Status[i] = res.code
+			if res.retry > retry {
+				retry = res.retry
+			}
+			accepted = accepted && res.code == 200
+		}
+	}
+
+	if replayed {
+		atomic.AddUint64(&s.stats.AuthReplay, 1)
+	} else if !accepted && mc.auth != nil && auth.err == nil {
+		// Only a batch accepted whole can be answered from the replay cache
+		s.replay.release(auth.sig)
+	}
+	if retry > 0 {
+		w.Header().Set("Retry-After", retryAfter(retry))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func delimited(items ...[]byte) []byte {
+	var buf bytes.Buffer
+	var l [binary.MaxVarintLen64]byte
+	for _, item := range items {
+		buf.Write(l[:binary.PutUvarint(l[:], uint64(len(item)))])
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+// postBatch sends a batch, signed for org unless it is nil
+func postBatch(t *testing.T, s *Server, body, org []byte) (int, []int, string) {
+	req := httptest.NewRequest("POST", "/v1/batch", bytes.NewReader(body))
+	if org != nil {
+		SignMsg(req.Header, body, org, "k1", testAuthKey, time.Now())
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	var resp batchResponse
+	if rec.Code == 200 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, resp.Status, rec.Header().Get("Retry-After")
+}
+
+func TestBatchIngest(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil))
+
+	code, status, _ := postBatch(t, s, delimited(data, nil, []byte("junk"), data), nil)
+	if code != 200 || !reflect.DeepEqual(status, []int{200, 200, 200, 200}) || m.len() != 2 {
+		t.Fatalf("batch: %d %v, %d stored", code, status, m.len())
+	}
+	if st := s.Stats(); st.BatchItems != 3 || st.ErrParse != 1 || st.OK != 2 {
+		t.Errorf("stats %+v", st)
+	}
+
+	// Items over a rate limit are answered on their own
+	s.installConfig(&Config{RateLimit: &RateLimitConfig{Org: &RateLimit{Rate: 1, Burst: 2}}})
+	code, status, after := postBatch(t, s, delimited(data, data, data), nil)
+	if code != 200 || !reflect.DeepEqual(status, []int{200, 200, 429}) || after != "1" || m.len() != 4 {
+		t.Errorf("rate limited: %d %v %q, %d stored", code, status, after, m.len())
+	}
+
+	// Broken framing and too many reports fail the whole batch
+	s.installConfig(&Config{Body: &BodyConfig{MaxBatchItems: 2}})
+	if code, _, _ = postBatch(t, s, delimited(data)[:10], nil); code != 400 {
+		t.Errorf("truncated: %d", code)
+	}
+	if code, _, _ = postBatch(t, s, delimited(data, data, data), nil); code != 413 {
+		t.Errorf("too many: %d", code)
+	}
+	if m.len() != 4 || s.Stats().ErrBatchFrame != 2 {
+		t.Errorf("%d stored", m.len())
+	}
+}
+
+// slowStorage takes delay to store each object
+type slowStorage struct {
+	*memStorage
+	delay time.Duration
+}
+
+func (ss *slowStorage) Put(key string, r io.ReadSeeker) error {
+	time.Sleep(ss.delay)
+	return ss.memStorage.Put(key, r)
+}
+
+func TestBatchDeadline(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(&slowStorage{m, 400 * time.Millisecond}, nil),
+		WithConfig(&Config{Listen: &ListenConfig{WriteTimeoutSeconds: 1}}))
+
+	// Reports not reached by 750ms are left for the device to send again
+	code, status, after := postBatch(t, s, delimited(data, data, data, data), nil)
+	if code != 200 || !reflect.DeepEqual(status, []int{200, 200, 503, 503}) || after != "1" || m.len() != 2 {
+		t.Errorf("slow storage: %d %v %q, %d stored", code, status, after, m.len())
+	}
+	if st := s.Stats(); st.BatchItems != 2 || st.ErrBatchDeadline != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestBatchSigned(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := parseMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil), WithConfig(&Config{Auth: &AuthConfig{Orgs: map[string]*OrgAuthConfig{
+		hex.EncodeToString(pi.OrgId): {Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(testAuthKey)}},
+	}}}))
+	batch := delimited(data, data)
+	if code, status, _ := postBatch(t, s, batch, pi.OrgId); code != 200 || !reflect.DeepEqual(status, []int{200, 200}) || m.len() != 2 {
+		t.Fatalf("signed: %d %v, %d stored", code, status, m.len())
+	}
+	if code, status, _ := postBatch(t, s, batch, pi.OrgId); code != 200 || !reflect.DeepEqual(status, []int{200, 200}) || m.len() != 2 {
+		t.Errorf("replayed: %d %v, %d stored", code, status, m.len())
+	}
+	if code, status, _ := postBatch(t, s, batch, nil); code != 200 || !reflect.DeepEqual(status, []int{401, 401}) {
+		t.Errorf("unsigned: %d %v", code, status)
+	}
+	if st := s.Stats(); st.AuthVerified != 2 || st.AuthReplay != 1 || st.AuthDropped != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
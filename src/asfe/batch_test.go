@@ -0,0 +1,183 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchRecords splits a protobuf batch object into its reports
+func batchRecords(t *testing.T, obj []byte) [][]byte {
+	var out [][]byte
+	for len(obj) > 0 {
+		l, n := binary.Uvarint(obj)
+		if n <= 0 || uint64(len(obj)-n) < l {
+			t.Fatal("bad batch framing")
+		}
+		out = append(out, obj[n:n+int(l)])
+		obj = obj[n+int(l):]
+	}
+	return out
+}
+
+func newBatchServer(t *testing.T, m *memStorage, clock *int64, bc *BatchConfig) *Server {
+	now := func() time.Time { return time.Unix(atomic.LoadInt64(clock), 0).UTC() }
+	s, err := NewServer(WithAddr(""), WithStorage(m, nil), WithClock(now), WithConfig(&Config{Batch: bc}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBatchWriter(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clock int64 = 1500000000
+
+	// Size threshold, with the request waiting for the object
+	m := newMemStorage()
+	s := newBatchServer(t, m, &clock, &BatchConfig{MaxBytes: 1, Ack: BatchAckStored})
+	if code := postMsg(s, data); code != 200 || m.len() != 1 {
+		t.Fatalf("stored ack: %d, %d objects", code, m.len())
+	}
+	for k, obj := range m.objects {
+		if !strings.HasSuffix(k, ".pb") || !strings.Contains(k, "/2017/07/14/02/") {
+			t.Errorf("key %s", k)
+		}
+		if recs := batchRecords(t, obj); len(recs) != 1 || !bytes.Equal(recs[0], data) {
+			t.Errorf("records: %d", len(recs))
+		}
+	}
+	s.Shutdown(context.Background())
+
+	// Without a WAL, a report whose batch fails to store is not acked
+	m = newMemStorage()
+	m.fail = true
+	s = newBatchServer(t, m, &clock, &BatchConfig{MaxBytes: 1, Ack: BatchAckStored})
+	if s.batch.maxAge >= ListenDefaultWriteTimeout/2 {
+		t.Errorf("stored ack max age %v", s.batch.maxAge)
+	}
+	if code := postMsg(s, data); code != 500 || s.Stats().BatchAckLate != 0 {
+		t.Fatalf("failed flush: %d", code)
+	}
+	m.fail = false
+	s.batch.flushDue(false)
+	if m.len() != 1 {
+		t.Errorf("retried: %d objects", m.len())
+	}
+	s.Shutdown(context.Background())
+
+	// Time threshold, compressed NDJSON
+	m = newMemStorage()
+	s = newBatchServer(t, m, &clock, &BatchConfig{Format: BatchFormatNDJSON, Compress: "gzip", MaxSeconds: 60})
+	postMsg(s, data)
+	postMsg(s, data)
+	s.batch.flushDue(false)
+	if m.len() != 0 {
+		t.Fatal("flushed early")
+	}
+	atomic.AddInt64(&clock, 60)
+	s.batch.flushDue(false)
+	if m.len() != 1 || atomic.LoadUint64(&s.Stats().BatchReports) != 2 {
+		t.Fatalf("time flush: %d", m.len())
+	}
+	for k, obj := range m.objects {
+		if !strings.HasSuffix(k, ".ndjson.gz") {
+			t.Errorf("key %s", k)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(obj))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := 0
+		for sc := bufio.NewScanner(zr); sc.Scan(); lines++ {
+		}
+		if lines == 0 || lines%2 != 0 {
+			t.Errorf("ndjson lines: %d", lines)
+		}
+	}
+	s.Shutdown(context.Background())
+}
+
+func TestBatchWAL(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_fp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var clock int64 = 1500000000
+	bc := &BatchConfig{WALPath: dir}
+
+	// Crash with two reports buffered: no shutdown
+	m := newMemStorage()
+	s := newBatchServer(t, m, &clock, bc)
+	postMsg(s, data)
+	postMsg(s, data)
+	if m.len() != 0 {
+		t.Fatal("stored before flush")
+	}
+
+	// The next start picks them up, and shutdown flushes them
+	s = newBatchServer(t, m, &clock, bc)
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.len() != 1 {
+		t.Fatalf("recovered objects: %d", m.len())
+	}
+	for _, obj := range m.objects {
+		if recs := batchRecords(t, obj); len(recs) != 2 {
+			t.Errorf("recovered records: %d", len(recs))
+		}
+	}
+	if dirs, _ := ioutil.ReadDir(dir); len(dirs) != 0 {
+		t.Errorf("WAL left behind: %d", len(dirs))
+	}
+
+	// With the WAL holding it, a report whose batch fails to store is acked
+	m = newMemStorage()
+	m.fail = true
+	s = newBatchServer(t, m, &clock, &BatchConfig{MaxBytes: 1, Ack: BatchAckStored, WALPath: dir})
+	if code := postMsg(s, data); code != 200 || s.Stats().BatchAckLate != 1 {
+		t.Fatalf("failed flush with WAL: %d", code)
+	}
+	m.fail = false
+	s.Shutdown(context.Background())
+	if m.len() != 1 {
+		t.Errorf("retried with WAL: %d objects", m.len())
+	}
+
+	if _, err := NewServer(WithAddr(""), WithStorage(m, nil),
+		WithConfig(&Config{Batch: &BatchConfig{Ack: BatchAckLogged}})); err == nil {
+		t.Error("logged ack without WAL accepted")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	DefaultMaxBodyLength = (64 * 1024) // ASMA reports max at 64k
+
+	zstdMaxWindow = (8 << 20)
+)
+
+var (
+	BodyTooLargeError      = errors.New("Request body too large")
+	BodyEncodingError      = errors.New("Request body encoding not supported")
+	BodyDecompressionError = errors.New("Request body does not decompress")
+
+	gzipPool, zstdPool sync.Pool
+)
+
+// BodyConfig bounds request bodies.  MaxBytes applies to the body as sent
+// and, for a compressed body, to what it decompresses to; MaxBatchBytes
+// does the same for /v1/batch, which takes up to MaxBatchItems reports.
+// 0 is the default for each.
+type BodyConfig struct {
+	MaxBytes      int `json:"maxBytes,omitempty"`
+	MaxBatchBytes int `json:"maxBatchBytes,omitempty"`
+	MaxBatchItems int `json:"maxBatchItems,omitempty"`
+}
+
+func (c *Config) maxBodyLength() int {
+	if c.Body != nil && c.Body.MaxBytes > 0 {
+		return c.Body.MaxBytes
+	}
+	return DefaultMaxBodyLength
+}
+
+// recordingReader remembers the error of the reader under a decompressor,
+// so read failures can be told apart from bad compressed data
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+// decoder returns a reader that undoes the Content-Encoding, and the func
+// that gives back what it took from a pool
+func decoder(encoding string, r io.Reader) (io.Reader, func(), error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return r, func() {}, nil
+
+	case "gzip", "x-gzip":
+		zr, _ := gzipPool.Get().(*gzip.Reader)
+		var err error
+		if zr == nil {
+			zr, err = gzip.NewReader(r)
+		} else {
+			err = zr.Reset(r)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		zr.Multistream(false)
+		return zr, func() { gzipPool.Put(zr) }, nil
+
+	case "deflate":
+		// Meant to be zlib, but raw deflate is common enough to take too
+		br := bufio.NewReader(r)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			return zr, func() {}, nil
+		}
+		return flate.NewReader(br), func() {}, nil
+
+	case "zstd":
+		zd, _ := zstdPool.Get().(*zstd.Decoder)
+		var err error
+		if zd == nil {
+			zd, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+				zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		} else {
+			err = zd.Reset(r)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return zd, func() {
+			zd.Reset(nil)
+			zstdPool.Put(zd)
+		}, nil
+	}
+	return nil, nil, BodyEncodingError
+}
+
+// bodyError answers a request whose body could not be read
+func (s *Server) bodyError(w http.ResponseWriter, err error) {
+	switch err {
+	case BodyTooLargeError:
+		atomic.AddUint64(&s.stats.ErrBodyTooLarge, 1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case BodyEncodingError:
+		atomic.AddUint64(&s.stats.ErrBodyEncoding, 1)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	case BodyDecompressionError:
+		atomic.AddUint64(&s.stats.ErrBodyEncoding, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		atomic.AddUint64(&s.stats.ErrBodyRead, 1)
+		w.WriteHeader(500)
+	}
+}
+
+// fill reads until buf is full or r ends
+func fill(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readBody reads a whole request body, decompressed, into a pool buffer
+// when it fits one; chunked bodies with no Content-Length too.  The body
+// is only valid until release is called.  Errors are BodyTooLargeError,
+// BodyEncodingError, BodyDecompressionError, or the error reading the
+// request.
+func (s *Server) readBody(r *http.Request, max int) (body []byte, release func(), err error) {
+	release = func() {}
+	if r.ContentLength > int64(max) {
+		return nil, release, BodyTooLargeError
+	}
+
+	// The limit applies to what is sent, as well as what it decompresses to
+	lr := &io.LimitedReader{R: r.Body, N: int64(max) + 1}
+	raw := &recordingReader{r: lr}
+	classify := func(err error) error {
+		switch {
+		case lr.N <= 0:
+			return BodyTooLargeError
+		case err == BodyEncodingError, raw.err != nil:
+			return err
+		}
+		return BodyDecompressionError
+	}
+
+	rd, done, err := decoder(r.Header.Get("Content-Encoding"), raw)
+	if err != nil {
+		return nil, release, classify(err)
+	}
+	defer done()
+	if rd != io.Reader(raw) {
+		atomic.AddUint64(&s.stats.Decompressed, 1)
+		rd = io.LimitReader(rd, int64(max)+1)
+	}
+
+	// Most reports fit a pool buffer
+	poolBuf := pool.Get().([]byte)
+	n, err := fill(rd, poolBuf)
+	if err != nil {
+		pool.Put(poolBuf)
+		return nil, release, classify(err)
+	}
+	if n < len(poolBuf) {
+		if n > max || lr.N <= 0 {
+			pool.Put(poolBuf)
+			return nil, release, BodyTooLargeError
+		}
+		return poolBuf[:n], func() { pool.Put(poolBuf) }, nil
+	}
+
+	// Larger ones are read on past it
+	atomic.AddUint64(&s.stats.NonPool, 1)
+	buf := bytes.NewBuffer(make([]byte, 0, 2*len(poolBuf)))
+	buf.Write(poolBuf)
+	pool.Put(poolBuf)
+	if _, err = buf.ReadFrom(rd); err != nil {
+		return nil, release, classify(err)
+	}
+	if buf.Len() > max || lr.N <= 0 {
+		return nil, release, BodyTooLargeError
+	}
+	return buf.Bytes(), release, nil
+}
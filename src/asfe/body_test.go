@@ -0,0 +1,129 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func encodeBody(encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "rawdeflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		w, _ = zstd.NewWriter(&buf)
+	default:
+		return data
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestBodyEncodings(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil))
+
+	for i, enc := range []string{"", "gzip", "deflate", "rawdeflate", "zstd", "zstd", "gzip"} {
+		req := httptest.NewRequest("POST", "/v1/msg", bytes.NewReader(encodeBody(enc, data)))
+		if enc == "rawdeflate" {
+			enc = "deflate"
+		}
+		req.Header.Set("Content-Encoding", enc)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if rec.Code != 200 || m.len() != i+1 {
+			t.Fatalf("%q: %d, %d stored", enc, rec.Code, m.len())
+		}
+	}
+	for _, obj := range m.objects {
+		if !bytes.Equal(obj, data) {
+			t.Error("stored body differs")
+		}
+	}
+	if st := s.Stats(); st.Decompressed != 6 {
+		t.Errorf("%d decompressed", st.Decompressed)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	s := newTestServer(t)
+	read := func(body io.Reader, encoding string, max int) ([]byte, error) {
+		req := httptest.NewRequest("POST", "/v1/msg", body)
+		req.Header.Set("Content-Encoding", encoding)
+		data, release, err := s.readBody(req, max)
+		data = append([]byte(nil), data...)
+		release()
+		return data, err
+	}
+
+	// Short reads and chunked bodies without a length are read in full
+	big := bytes.Repeat([]byte("0123456789"), 3000)
+	data, err := read(iotest.OneByteReader(bytes.NewReader(big[:1000])), "", DefaultMaxBodyLength)
+	if err != nil || !bytes.Equal(data, big[:1000]) {
+		t.Errorf("short reads: %d bytes, %v", len(data), err)
+	}
+	data, err = read(iotest.HalfReader(bytes.NewReader(big)), "", DefaultMaxBodyLength)
+	if err != nil || !bytes.Equal(data, big) || s.Stats().NonPool != 1 {
+		t.Errorf("past the pool buffer: %d bytes, %v", len(data), err)
+	}
+
+	// Bombs, and bodies over the limit before or after decompression
+	bomb := encodeBody("zstd", make([]byte, 1<<20))
+	cut := encodeBody("zstd", big)
+	cases := []struct {
+		body     []byte
+		encoding string
+		max      int
+		want     error
+	}{
+		{bomb, "zstd", DefaultMaxBodyLength, BodyTooLargeError},
+		{encodeBody("gzip", make([]byte, 1<<20)), "gzip", DefaultMaxBodyLength, BodyTooLargeError},
+		{big, "", 1000, BodyTooLargeError},
+		{big[:1001], "", 1000, BodyTooLargeError},
+		{encodeBody("gzip", big), "gzip", 1000, BodyTooLargeError},
+		{big, "br", DefaultMaxBodyLength, BodyEncodingError},
+		{big, "gzip", DefaultMaxBodyLength, BodyDecompressionError},
+		{cut[:len(cut)/2], "zstd", DefaultMaxBodyLength, BodyDecompressionError},
+		{big[:1000], "", 1000, nil},
+	}
+	for i, c := range cases {
+		// No length, as for a chunked upload
+		if _, err := read(iotest.HalfReader(bytes.NewReader(c.body)), c.encoding, c.max); err != c.want {
+			t.Errorf("%d: got %v, want %v", i, err, c.want)
+		}
+	}
+}
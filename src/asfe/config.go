@@ -16,80 +16,361 @@
 package asfe
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"net/http"
+	"os"
 	"sync/atomic"
 	"time"
 	"unsafe"
-)
-
-const (
-	ConfigRefreshDuration = 5 * time.Minute
-)
 
-var (
-	MainConfig unsafe.Pointer
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
 )
 
 type Config struct {
-	StoragePrimary   []string `json:"storagePrimary"`
-	StorageSecondary []string `json:"storageSecondary,omitempty"`
-	QueueParseError  []string `json:"queueParseError,omitempty"`
-	QueueAtypical    []string `json:"queueAtypical,omitempty"`
-	TopicStats       []string `json:"topicStats,omitempty"`
+	StoragePrimary   *StorageConfig       `json:"storagePrimary"`
+	StorageSecondary *StorageConfig       `json:"storageSecondary,omitempty"`
+	QueueParseError  []string             `json:"queueParseError,omitempty"`
+	QueueAtypical    []string             `json:"queueAtypical,omitempty"`
+	Queues           map[string][]string  `json:"queues,omitempty"`
+	TopicStats       []string             `json:"topicStats,omitempty"`
+	Spool            *SpoolConfig         `json:"spool,omitempty"`
+	Shutdown         *ShutdownConfig      `json:"shutdown,omitempty"`
+	StorageKey       string               `json:"storageKey,omitempty"`
+	ContentKeys      bool                 `json:"contentKeys,omitempty"`
+	Dedupe           *DedupeConfig        `json:"dedupe,omitempty"`
+	Batch            *BatchConfig         `json:"batch,omitempty"`
+	Parquet          *ParquetConfig       `json:"parquet,omitempty"`
+	ExportDecoded    bool                 `json:"exportDecoded,omitempty"`
+	Atypical         *AtypicalConfig      `json:"atypical,omitempty"`
+	Splunk           *SplunkConfig        `json:"splunk,omitempty"`
+	Syslog           *SyslogConfig        `json:"syslog,omitempty"`
+	Taxii            *TaxiiConfig         `json:"taxii,omitempty"`
+	Kafka            *KafkaConfig         `json:"kafka,omitempty"`
+	Routes           []RouteConfig        `json:"routes,omitempty"`
+	ConfigRefresh    *ConfigRefreshConfig `json:"configRefresh,omitempty"`
+	Listen           *ListenConfig        `json:"listen,omitempty"`
+	Auth             *AuthConfig          `json:"auth,omitempty"`
+	Quarantine       *StorageConfig       `json:"storageQuarantine,omitempty"`
+	Allowlist        *AllowlistConfig     `json:"allowlist,omitempty"`
+	RateLimit        *RateLimitConfig     `json:"rateLimit,omitempty"`
+	Body             *BodyConfig          `json:"body,omitempty"`
+
+	// Built from the above by prepare()
+	primary         Storage
+	secondary       Storage
+	queueParseError Queue
+	queueAtypical   Queue
+	queues          map[string]Queue
+	topicStats      *sns.SNS
+	atypical        *atypicalRules
+	keyTemplate     *keyTemplate
+	routes          []*route
+	auth            *authRules
+	allowlist       allowlist
+	rateLimit       *rateLimits
+	quarantine      Storage
+	prepared        bool
 }
 
-func configRefresher(url string) {
+// prepare validates the config and builds the runtime objects (storage
+// backends, queues, etc.) it describes, so a config is fully usable before
+// it is swapped in.
+func (c *Config) prepare(needStorage bool) error {
+	var err error
 
-	c := time.Tick(ConfigRefreshDuration)
+	if c.prepared {
+		return nil
+	}
 
-	for _ = range c {
-		resp, err := http.Get(url)
-		if err != nil {
-			atomic.AddUint64(&StatErrConfigRefresh, 1)
-			continue
+	if err = c.validate(needStorage); err != nil {
+		return err
+	}
+
+	if c.StoragePrimary != nil {
+		if c.primary, err = NewStorage(c.StoragePrimary); err != nil {
+			return err
+		}
+	}
+
+	if c.StorageSecondary != nil {
+		if c.secondary, err = NewStorage(c.StorageSecondary); err != nil {
+			return err
 		}
+	}
+
+	if c.Quarantine != nil {
+		if c.quarantine, err = NewStorage(c.Quarantine); err != nil {
+			return err
+		}
+	}
+
+	if c.QueueParseError != nil {
+		if c.queueParseError, err = newSQSQueue(c.QueueParseError); err != nil {
+			return err
+		}
+	}
+
+	if c.QueueAtypical != nil {
+		if c.queueAtypical, err = newSQSQueue(c.QueueAtypical); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Queues) > 0 {
+		c.queues = make(map[string]Queue, len(c.Queues))
+		for name, q := range c.Queues {
+			if c.queues[name], err = newSQSQueue(q); err != nil {
+				return err
+			}
+		}
+	}
 
-		data, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	if c.TopicStats != nil {
+		sess, err := session.NewSession()
 		if err != nil {
-			atomic.AddUint64(&StatErrConfigRefresh, 1)
-			continue
+			return err
 		}
+		c.topicStats = sns.New(sess, aws.NewConfig().WithMaxRetries(2).WithRegion(c.TopicStats[0]))
+	}
 
-		config := &Config{}
-		if err = json.Unmarshal(data, config); err != nil {
-			atomic.AddUint64(&StatErrConfigRefresh, 1)
-			continue
+	if c.StorageKey != "" {
+		if c.keyTemplate, err = compileKeyTemplate(c.StorageKey); err != nil {
+			return err
 		}
+	}
 
-		atomic.StorePointer(&MainConfig, unsafe.Pointer(config))
-		atomic.AddUint64(&StatConfigRefresh, 1)
+	if len(c.Routes) > 0 {
+		if c.routes, err = compileRoutes(c.Routes, c.Queues); err != nil {
+			return err
+		}
 	}
+
+	if c.Atypical != nil {
+		if c.atypical, err = compileAtypical(c.Atypical); err != nil {
+			return err
+		}
+	}
+
+	if c.Auth != nil {
+		if c.auth, err = compileAuth(c.Auth); err != nil {
+			return err
+		}
+	}
+
+	if c.Allowlist != nil {
+		if c.allowlist, err = compileAllowlist(c.Allowlist); err != nil {
+			return err
+		}
+	}
+
+	if c.RateLimit != nil {
+		if c.rateLimit, err = compileRateLimits(c.RateLimit); err != nil {
+			return err
+		}
+	}
+
+	c.prepared = true
+	return nil
+}
+
+// atypicalRules returns the configured rules, or the defaults
+func (c *Config) atypicalRules() *atypicalRules {
+	if c.atypical != nil {
+		return c.atypical
+	}
+	return defaultAtypical
 }
 
-func ConfigInit(url string) error {
+// storageKey returns the configured key template, or the default layout
+func (c *Config) storageKey() *keyTemplate {
+	if c.keyTemplate != nil {
+		return c.keyTemplate
+	}
+	if c.ContentKeys {
+		return contentKeyTemplate
+	}
+	return defaultKeyTemplate
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
+func (s *Server) loadConfig() *Config {
+	return (*Config)(atomic.LoadPointer(&s.config))
+}
+
+// installConfig prepares a config, applies the server's backend overrides
+// and swaps it in.  A config that fails leaves the current one in place.
+func (s *Server) installConfig(config *Config) error {
+	if err := config.prepare(s.primary == nil); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	data, err := ioutil.ReadAll(resp.Body)
+	if s.primary != nil {
+		config.primary, config.secondary = s.primary, s.secondary
+	}
+	if s.quarantine != nil {
+		config.quarantine = s.quarantine
+	}
+	if s.queueParseError != nil {
+		config.queueParseError = s.queueParseError
+	}
+	if s.queueAtypical != nil {
+		config.queueAtypical = s.queueAtypical
+	}
+	for name, q := range s.queues {
+		if config.queues == nil {
+			config.queues = make(map[string]Queue)
+		}
+		config.queues[name] = q
+	}
+	if config.primary == nil {
+		return errors.New("storagePrimary not configured")
+	}
+
+	atomic.StorePointer(&s.config, unsafe.Pointer(config))
+	if s.lastGoodPath != "" {
+		if err := saveLastGood(s.lastGoodPath, config); err != nil {
+			s.logger.Println("config: saving last known good:", err)
+		}
+	}
+	return nil
+}
+
+// saveLastGood keeps a copy of the installed config, for startup when the
+// config source is down or serves a bad config
+func saveLastGood(path string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
-
-	config := &Config{}
-	if err := json.Unmarshal(data, config); err != nil {
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
 		return err
 	}
+	return os.Rename(tmp, path)
+}
 
-	atomic.StorePointer(&MainConfig, unsafe.Pointer(config))
+// logConfigErrors logs each problem of a rejected config
+func (s *Server) logConfigErrors(prefix string, err error) {
+	if ce, ok := err.(ConfigErrors); ok {
+		for _, e := range ce {
+			s.logger.Println(prefix, e)
+		}
+		return
+	}
+	s.logger.Println(prefix, err)
+}
 
-	go configRefresher(url)
+// initialConfig loads the config the server starts with.  If the sources
+// fail, or their config is invalid, the last known good config is used.
+func (s *Server) initialConfig() error {
+	if s.static != nil {
+		return s.installConfig(s.static)
+	}
+	if s.configSource == "" {
+		return NoConfigError
+	}
 
+	var config *Config
+	var err error
+	if s.configs, err = newConfigLoader(s.configSource, s.configKeys); err != nil {
+		return err
+	}
+	s.configs.audit = s.audit
+	ctx, cancel := context.WithTimeout(context.Background(), ConfigFetchTimeout)
+	config, err = s.configs.load(ctx, true)
+	cancel()
+	if err == nil {
+		if err = s.installConfig(config); err == nil {
+			s.audit(ConfigAuditRecord{Event: "config_installed", Source: s.configSource})
+			return nil
+		}
+		atomic.AddUint64(&s.stats.ConfigRejected, 1)
+	}
+	s.rejectConfig("config:", err)
+	if s.lastGoodPath == "" {
+		return err
+	}
+
+	// The last known good copy was written by this process, so it is
+	// trusted unsigned
+	config, lerr := loadConfigSource(s.lastGoodPath, nil)
+	if lerr == nil {
+		lerr = s.installConfig(config)
+	}
+	if lerr != nil {
+		s.logConfigErrors("config: last known good:", lerr)
+		return err
+	}
+	s.logger.Println("config: using last known good", s.lastGoodPath)
+	s.audit(ConfigAuditRecord{Event: "config_installed", Source: "file://" + s.lastGoodPath})
 	return nil
 }
+
+// rejectConfig logs, counts and audits a config that was not installed
+func (s *Server) rejectConfig(prefix string, err error) {
+	s.logConfigErrors(prefix, err)
+	if isSignatureError(err) {
+		atomic.AddUint64(&s.stats.ErrConfigSignature, 1)
+	}
+	s.auditConfigError(err)
+}
+
+// refreshConfig reloads the config if a source changed; force reloads it
+// regardless
+func (s *Server) refreshConfig(force bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConfigFetchTimeout)
+	defer cancel()
+
+	config, err := s.configs.load(ctx, force)
+	if err != nil {
+		atomic.AddUint64(&s.stats.ErrConfigRefresh, 1)
+		if isSignatureError(err) {
+			s.rejectConfig("config refresh: rejected:", err)
+		} else {
+			s.logger.Println("config refresh:", err)
+		}
+		return
+	}
+	if config == nil {
+		atomic.AddUint64(&s.stats.ConfigUnchanged, 1)
+		return
+	}
+	if err = s.installConfig(config); err != nil {
+		// Keep serving with the current config
+		s.rejectConfig("config refresh: rejected:", err)
+		atomic.AddUint64(&s.stats.ErrConfigRefresh, 1)
+		atomic.AddUint64(&s.stats.ConfigRejected, 1)
+		return
+	}
+	s.audit(ConfigAuditRecord{Event: "config_installed", Source: s.configSource})
+	atomic.AddUint64(&s.stats.ConfigRefresh, 1)
+}
+
+func (s *Server) configRefresher() {
+	for {
+		timer := time.NewTimer(s.loadConfig().refreshInterval())
+		force := false
+		select {
+		case <-timer.C:
+		case <-s.reload:
+			timer.Stop()
+			force = true
+		case <-s.done:
+			timer.Stop()
+			return
+		}
+		s.refreshConfig(force)
+	}
+}
+
+// Reload makes the server reload its config now, as on SIGHUP
+func (s *Server) Reload() {
+	select {
+	case s.reload <- struct{}{}:
+	default:
+		// A reload is already pending
+	}
+}
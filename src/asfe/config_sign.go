@@ -0,0 +1,196 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// ConfigKeysEnv names a file of pinned config signing keys
+	ConfigKeysEnv = "ASFE_CONFIG_KEYS"
+
+	jwsAlgEdDSA = "EdDSA"
+)
+
+var (
+	ConfigUnsignedError       = errors.New("Config is not a signed document")
+	ConfigSignatureError      = errors.New("Config signature does not verify")
+	ConfigUnknownKeyError     = errors.New("Config signed with a key that is not pinned")
+	ConfigUnsupportedJWSError = errors.New("Config signature uses an unsupported JWS algorithm or header")
+)
+
+// ConfigKeys are the pinned Ed25519 public keys config documents must be
+// signed with, by key id.  With keys pinned, every source document has to
+// be a JWS compact serialization ("header.payload.signature", RFC 7515)
+// with alg EdDSA, whose payload is the config JSON.
+type ConfigKeys map[string]ed25519.PublicKey
+
+// LoadConfigKeys reads a JSON object of key id to base64 public key
+func LoadConfigKeys(path string) (ConfigKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	keys := make(ConfigKeys, len(raw))
+	for kid, b64 := range raw {
+		key, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("config key %s: not a base64 Ed25519 public key", kid)
+		}
+		keys[kid] = ed25519.PublicKey(key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("config keys: none in " + path)
+	}
+	return keys, nil
+}
+
+type jwsHeader struct {
+	Alg  string   `json:"alg"`
+	Kid  string   `json:"kid,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+}
+
+var b64url = base64.RawURLEncoding
+
+// SignConfig wraps a config document in a JWS signed by key
+func SignConfig(doc []byte, kid string, key ed25519.PrivateKey) []byte {
+	header, _ := json.Marshal(&jwsHeader{Alg: jwsAlgEdDSA, Kid: kid})
+	input := b64url.EncodeToString(header) + "." + b64url.EncodeToString(doc)
+	sig := ed25519.Sign(key, []byte(input))
+	return []byte(input + "." + b64url.EncodeToString(sig))
+}
+
+// verify checks a signed document against the pinned keys and returns its
+// payload, and the id of the key that signed it
+func (keys ConfigKeys) verify(doc []byte) ([]byte, string, error) {
+	doc = bytes.TrimSpace(doc)
+	parts := bytes.Split(doc, []byte("."))
+	if len(parts) != 3 {
+		return nil, "", ConfigUnsignedError
+	}
+
+	hdata, err := b64url.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, "", ConfigUnsignedError
+	}
+	var h jwsHeader
+	if err = json.Unmarshal(hdata, &h); err != nil {
+		return nil, "", ConfigUnsignedError
+	}
+	if h.Alg != jwsAlgEdDSA || len(h.Crit) > 0 {
+		return nil, h.Kid, ConfigUnsupportedJWSError
+	}
+
+	sig, err := b64url.DecodeString(string(parts[2]))
+	if err != nil {
+		return nil, h.Kid, ConfigSignatureError
+	}
+	input := doc[:len(parts[0])+1+len(parts[1])]
+
+	// Without a kid, any pinned key will do
+	candidates := keys
+	if h.Kid != "" {
+		key, ok := keys[h.Kid]
+		if !ok {
+			return nil, h.Kid, ConfigUnknownKeyError
+		}
+		candidates = ConfigKeys{h.Kid: key}
+	}
+	for kid, key := range candidates {
+		if ed25519.Verify(key, input, sig) {
+			payload, err := b64url.DecodeString(string(parts[1]))
+			if err != nil {
+				return nil, kid, ConfigSignatureError
+			}
+			return payload, kid, nil
+		}
+	}
+	return nil, h.Kid, ConfigSignatureError
+}
+
+// ConfigAuditRecord is written for every config document accepted or
+// rejected on signature grounds, and every config installed or rejected
+type ConfigAuditRecord struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"` // config_verified, config_rejected, config_installed
+	Source string    `json:"source,omitempty"`
+	KeyId  string    `json:"keyId,omitempty"`
+	Digest string    `json:"digest,omitempty"` // sha256 of the fetched document
+	Reason string    `json:"reason,omitempty"`
+}
+
+// ConfigSourceError carries the source and document a config failed on
+type ConfigSourceError struct {
+	Source string
+	KeyId  string
+	Digest string
+	Err    error
+}
+
+func (e *ConfigSourceError) Error() string { return e.Source + ": " + e.Err.Error() }
+func (e *ConfigSourceError) Unwrap() error { return e.Err }
+
+func docDigest(doc []byte) string {
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:])
+}
+
+// audit writes an audit record to the audit log, or the server log
+func (s *Server) audit(rec ConfigAuditRecord) {
+	rec.Time = s.now().UTC()
+	data, _ := json.Marshal(&rec)
+	if s.auditLog != nil {
+		s.auditMu.Lock()
+		s.auditLog.Write(append(data, '\n'))
+		s.auditMu.Unlock()
+		return
+	}
+	s.logger.Println("audit:", string(data))
+}
+
+// auditConfigError records a config that failed, if it failed on a source
+// document
+func (s *Server) auditConfigError(err error) {
+	var se *ConfigSourceError
+	if errors.As(err, &se) {
+		s.audit(ConfigAuditRecord{Event: "config_rejected", Source: se.Source, KeyId: se.KeyId,
+			Digest: se.Digest, Reason: se.Err.Error()})
+		return
+	}
+	s.audit(ConfigAuditRecord{Event: "config_rejected", Reason: err.Error()})
+}
+
+// isSignatureError reports whether err is a failed signature check
+func isSignatureError(err error) bool {
+	return errors.Is(err, ConfigUnsignedError) || errors.Is(err, ConfigSignatureError) ||
+		errors.Is(err, ConfigUnknownKeyError) || errors.Is(err, ConfigUnsupportedJWSError)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigSignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	keys := ConfigKeys{"k1": pub, "k2": otherPub}
+	doc := []byte(`{"storagePrimary":["us-east-1","b"]}`)
+
+	payload, kid, err := keys.verify(SignConfig(doc, "k1", priv))
+	if err != nil || kid != "k1" || !bytes.Equal(payload, doc) {
+		t.Fatalf("verify: %s %s %v", payload, kid, err)
+	}
+
+	signed := SignConfig(doc, "k1", priv)
+	if _, _, err = keys.verify(append([]byte("\n "), signed...)); err != nil {
+		t.Errorf("leading whitespace: %v", err)
+	}
+	parts := strings.Split(string(signed), ".")
+	tampered := parts[0] + "." + b64url.EncodeToString([]byte(`{"storagePrimary":["us-east-1","evil"]}`)) + "." + parts[2]
+	none := b64url.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+
+	for name, tc := range map[string]struct {
+		doc []byte
+		err error
+	}{
+		"unsigned":  {doc, ConfigUnsignedError},
+		"tampered":  {[]byte(tampered), ConfigSignatureError},
+		"wrong key": {SignConfig(doc, "k1", otherPriv), ConfigSignatureError},
+		"unknown":   {SignConfig(doc, "k9", priv), ConfigUnknownKeyError},
+		"alg none":  {[]byte(none), ConfigUnsupportedJWSError},
+	} {
+		if _, _, err := keys.verify(tc.doc); err != tc.err {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadConfigKeys(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data, _ := json.Marshal(map[string]string{"k1": base64.StdEncoding.EncodeToString(pub)})
+	ioutil.WriteFile(path, data, 0600)
+
+	keys, err := LoadConfigKeys(path)
+	if err != nil || !bytes.Equal(keys["k1"], pub) {
+		t.Errorf("keys %v %v", keys, err)
+	}
+	ioutil.WriteFile(path, []byte(`{"k1":"c2hvcnQ="}`), 0600)
+	if _, err = LoadConfigKeys(path); err == nil {
+		t.Error("short key accepted")
+	}
+}
+
+func TestSignedConfigRefresh(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+	doc := []byte(fmt.Sprintf(testGoodConfig, dir))
+
+	es := &etagServer{}
+	es.set(string(SignConfig(doc, "k1", priv)))
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	var audit bytes.Buffer
+	s, err := NewServer(WithConfigURL(ts.URL), WithAddr(""), WithConfigKeys(ConfigKeys{"k1": pub}),
+		WithAuditLog(&audit), WithLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := s.loadConfig()
+
+	// An unsigned document is rejected, counted and audited
+	es.set(`{"storagePrimary":{"driver":"file","path":"/elsewhere"}}`)
+	s.refreshConfig(false)
+	if s.loadConfig() != first {
+		t.Error("unsigned config installed")
+	}
+	if s.stats.ErrConfigRefresh != 1 || s.stats.ErrConfigSignature != 1 {
+		t.Errorf("stats %+v", s.stats)
+	}
+
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var rec ConfigAuditRecord
+		if err = json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, rec.Event)
+		if rec.Event == "config_rejected" && (rec.Digest == "" || rec.Source != ts.URL) {
+			t.Errorf("rejection record %+v", rec)
+		}
+	}
+	if strings.Join(events, ",") != "config_verified,config_installed,config_rejected" {
+		t.Errorf("audit events %v", events)
+	}
+}
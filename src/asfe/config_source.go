@@ -0,0 +1,376 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	ConfigRefreshDuration = 5 * time.Minute
+	ConfigRefreshJitter   = 30 * time.Second
+	ConfigFetchTimeout    = 30 * time.Second
+
+	// DefaultConfigEnv is the variable an "env:" source reads
+	DefaultConfigEnv = "ASFE_CONFIG"
+)
+
+var (
+	EmptyConfigSourceError = errors.New("No config source given")
+)
+
+// ConfigRefreshConfig sets how often the config sources are checked.  The
+// wait between checks is IntervalSeconds plus up to JitterSeconds, so a
+// fleet does not poll in lockstep; 0 turns the jitter off, and leaving it
+// out keeps the default.
+type ConfigRefreshConfig struct {
+	IntervalSeconds int  `json:"intervalSeconds,omitempty"`
+	JitterSeconds   *int `json:"jitterSeconds,omitempty"`
+}
+
+// ConfigSource is one place a config document comes from.  Fetch returns
+// nil data when the document has not changed since the last fetch, unless
+// force is set.
+type ConfigSource interface {
+	Fetch(ctx context.Context, force bool) ([]byte, error)
+	String() string
+}
+
+// NewConfigSource parses a source:
+//
+//	file:///etc/asfe.json or a plain path   a local file
+//	http://... https://...                   fetched with ETag/If-Modified-Since
+//	s3://bucket/key?region=r&endpoint=e      an S3 object, fetched with ETag
+//	env: or env:NAME                         JSON in $NAME ($ASFE_CONFIG)
+func NewConfigSource(src string) (ConfigSource, error) {
+	switch {
+	case strings.HasPrefix(src, "env:"):
+		name := strings.TrimPrefix(src, "env:")
+		if name == "" {
+			name = DefaultConfigEnv
+		}
+		return &envSource{name: name}, nil
+	case strings.HasPrefix(src, "http://"), strings.HasPrefix(src, "https://"):
+		return &httpSource{url: src, client: &http.Client{Timeout: ConfigFetchTimeout}}, nil
+	case strings.HasPrefix(src, "s3://"):
+		return newS3Source(src)
+	case strings.HasPrefix(src, "file://"):
+		u, err := url.Parse(src)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSource{path: u.Path}, nil
+	case strings.Contains(src, "://"):
+		return nil, fmt.Errorf("config source: unknown scheme in %q", src)
+	}
+	return &fileSource{path: src}, nil
+}
+
+type fileSource struct {
+	path  string
+	mtime time.Time
+	size  int64
+}
+
+func (fs *fileSource) String() string { return "file://" + fs.path }
+
+func (fs *fileSource) Fetch(ctx context.Context, force bool) ([]byte, error) {
+	fi, err := os.Stat(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	if !force && fi.ModTime().Equal(fs.mtime) && fi.Size() == fs.size {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	fs.mtime, fs.size = fi.ModTime(), fi.Size()
+	return data, nil
+}
+
+type httpSource struct {
+	url          string
+	client       *http.Client
+	etag         string
+	lastModified string
+}
+
+func (hs *httpSource) String() string { return hs.url }
+
+func (hs *httpSource) Fetch(ctx context.Context, force bool) ([]byte, error) {
+	req, err := http.NewRequest("GET", hs.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if !force {
+		if hs.etag != "" {
+			req.Header.Set("If-None-Match", hs.etag)
+		}
+		if hs.lastModified != "" {
+			req.Header.Set("If-Modified-Since", hs.lastModified)
+		}
+	}
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("config fetch %s: %s", hs.url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	hs.etag, hs.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return data, nil
+}
+
+type s3Source struct {
+	src    string
+	client *s3.S3
+	bucket string
+	key    string
+	etag   string
+}
+
+func newS3Source(src string) (*s3Source, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("config source: %q needs s3://bucket/key", src)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	c := aws.NewConfig().WithMaxRetries(2)
+	if region := u.Query().Get("region"); region != "" {
+		c = c.WithRegion(region)
+	}
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		c = c.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	return &s3Source{src: src, client: s3.New(sess, c), bucket: u.Host, key: key}, nil
+}
+
+func (ss *s3Source) String() string { return ss.src }
+
+func (ss *s3Source) Fetch(ctx context.Context, force bool) ([]byte, error) {
+	inp := &s3.GetObjectInput{Bucket: aws.String(ss.bucket), Key: aws.String(ss.key)}
+	if !force && ss.etag != "" {
+		inp.IfNoneMatch = aws.String(ss.etag)
+	}
+
+	out, err := ss.client.GetObjectWithContext(ctx, inp)
+	if err != nil {
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == http.StatusNotModified {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	ss.etag = aws.StringValue(out.ETag)
+	return data, nil
+}
+
+type envSource struct {
+	name string
+	last string
+	seen bool
+}
+
+func (es *envSource) String() string { return "env:" + es.name }
+
+// Fetch treats an unset variable as an empty document, so an env source
+// can sit in the list for overrides that are not always there
+func (es *envSource) Fetch(ctx context.Context, force bool) ([]byte, error) {
+	v := os.Getenv(es.name)
+	if v == "" {
+		v = "{}"
+	}
+	if !force && es.seen && v == es.last {
+		return nil, nil
+	}
+	es.last, es.seen = v, true
+	return []byte(v), nil
+}
+
+// configLoader layers the documents of its sources: a later source
+// overrides an earlier one, objects merging key by key (a null removes a
+// key) and any other value replacing what was there.  It is only used by
+// one goroutine at a time.
+type configLoader struct {
+	sources []ConfigSource
+	docs    [][]byte
+	failed  bool                        // the last load fetched documents it did not keep
+	keys    ConfigKeys                  // nil accepts unsigned documents
+	audit   func(rec ConfigAuditRecord) // optional
+}
+
+// newConfigLoader takes a comma separated list of sources, in override
+// order.  With keys, every document must be signed by one of them.
+func newConfigLoader(spec string, keys ConfigKeys) (*configLoader, error) {
+	cl := &configLoader{keys: keys}
+	for _, src := range strings.Split(spec, ",") {
+		if src = strings.TrimSpace(src); src == "" {
+			continue
+		}
+		cs, err := NewConfigSource(src)
+		if err != nil {
+			return nil, err
+		}
+		cl.sources = append(cl.sources, cs)
+	}
+	if len(cl.sources) == 0 {
+		return nil, EmptyConfigSourceError
+	}
+	cl.docs = make([][]byte, len(cl.sources))
+	return cl, nil
+}
+
+// load fetches every source and returns the merged config, or nil if no
+// source changed and force is not set.  Documents are kept only once every
+// source was fetched and verified; after a failure the sources that did
+// answer have moved on to documents that were dropped, so the next load
+// fetches them all again.
+func (cl *configLoader) load(ctx context.Context, force bool) (*Config, error) {
+	force = force || cl.failed
+	changed := force
+	docs := append([][]byte(nil), cl.docs...)
+	cl.failed = true
+	for i, cs := range cl.sources {
+		data, err := cs.Fetch(ctx, force || docs[i] == nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cs, err)
+		}
+		if data == nil {
+			continue
+		}
+		if cl.keys != nil {
+			payload, kid, err := cl.keys.verify(data)
+			if err != nil {
+				return nil, &ConfigSourceError{Source: cs.String(), KeyId: kid, Digest: docDigest(data), Err: err}
+			}
+			if cl.audit != nil {
+				cl.audit(ConfigAuditRecord{Event: "config_verified", Source: cs.String(), KeyId: kid, Digest: docDigest(data)})
+			}
+			data = payload
+		}
+		docs[i], changed = data, true
+	}
+	cl.docs, cl.failed = docs, false
+	if !changed {
+		return nil, nil
+	}
+
+	if len(cl.docs) == 1 {
+		return ParseConfig(cl.docs[0])
+	}
+	var merged interface{}
+	for i, doc := range cl.docs {
+		dec := json.NewDecoder(bytes.NewReader(doc))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("%s: %v", cl.sources[i], err)
+		}
+		merged = mergeConfigDoc(merged, v)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+func mergeConfigDoc(base, over interface{}) interface{} {
+	bm, ok1 := base.(map[string]interface{})
+	om, ok2 := over.(map[string]interface{})
+	if !ok1 || !ok2 {
+		return over
+	}
+	for k, v := range om {
+		if v == nil {
+			delete(bm, k)
+			continue
+		}
+		bm[k] = mergeConfigDoc(bm[k], v)
+	}
+	return bm
+}
+
+// loadConfigSource loads and merges a comma separated list of sources once
+func loadConfigSource(spec string, keys ConfigKeys) (*Config, error) {
+	cl, err := newConfigLoader(spec, keys)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ConfigFetchTimeout)
+	defer cancel()
+	return cl.load(ctx, true)
+}
+
+// refreshInterval is the wait before the next config refresh
+func (c *Config) refreshInterval() time.Duration {
+	interval, jitter := ConfigRefreshDuration, ConfigRefreshJitter
+	if c.ConfigRefresh != nil {
+		if c.ConfigRefresh.IntervalSeconds > 0 {
+			interval = time.Duration(c.ConfigRefresh.IntervalSeconds) * time.Second
+		}
+		if c.ConfigRefresh.JitterSeconds != nil {
+			jitter = time.Duration(*c.ConfigRefresh.JitterSeconds) * time.Second
+		}
+	}
+	if jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return interval
+}
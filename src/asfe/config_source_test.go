@@ -0,0 +1,219 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// etagServer serves one document with an ETag, answering 304 to a match
+type etagServer struct {
+	mu       sync.Mutex
+	doc      string
+	version  int
+	requests int
+	fail     int // requests left to answer with 500
+}
+
+func (es *etagServer) set(doc string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.doc = doc
+	es.version++
+}
+
+func (es *etagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.requests++
+	if es.fail > 0 {
+		es.fail--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`"v%d"`, es.version)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(es.doc))
+}
+
+func TestConfigSourceHTTP(t *testing.T) {
+	es := &etagServer{}
+	es.set(`{"storagePrimary":["us-east-1","b1"]}`)
+	ts := httptest.NewServer(es)
+	defer ts.Close()
+
+	cl, err := newConfigLoader(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if c, err := cl.load(ctx, false); err != nil || c.StoragePrimary.Bucket != "b1" {
+		t.Fatalf("first load: %v %v", c, err)
+	}
+	if c, err := cl.load(ctx, false); err != nil || c != nil {
+		t.Errorf("unchanged load: %v %v", c, err)
+	}
+	if c, err := cl.load(ctx, true); err != nil || c == nil {
+		t.Errorf("forced load: %v %v", c, err)
+	}
+	es.set(`{"storagePrimary":["us-east-1","b2"]}`)
+	if c, err := cl.load(ctx, false); err != nil || c.StoragePrimary.Bucket != "b2" {
+		t.Errorf("changed load: %v %v", c, err)
+	}
+}
+
+func TestConfigSourceS3(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	es := &etagServer{}
+	es.set(`{"storagePrimary":["us-east-1","b1"]}`)
+	mux := http.NewServeMux()
+	mux.Handle("/config/asfe.json", es)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	cl, err := newConfigLoader("s3://config/asfe.json?region=us-east-1&endpoint="+ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if c, err := cl.load(ctx, false); err != nil || c.StoragePrimary.Bucket != "b1" {
+		t.Fatalf("first load: %v %v", c, err)
+	}
+	if c, err := cl.load(ctx, false); err != nil || c != nil {
+		t.Errorf("unchanged load: %v %v", c, err)
+	}
+}
+
+func TestConfigSourceLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "asfe.json")
+	ioutil.WriteFile(path, []byte(`{"storagePrimary":{"driver":"file","path":"/data"},
+		"spool":{"path":"/spool"},"splunk":{"url":"https://splunk","token":"t1"}}`), 0600)
+	t.Setenv("ASFE_TEST_CONFIG", `{"spool":null,"splunk":{"token":"t2"}}`)
+
+	c, err := loadConfigSource("file://"+path+",env:ASFE_TEST_CONFIG", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Spool != nil || c.Splunk.URL != "https://splunk" || c.Splunk.Token != "t2" || c.StoragePrimary.Path != "/data" {
+		t.Errorf("merged config %+v", c)
+	}
+
+	// An unset variable overrides nothing
+	if c, err = loadConfigSource(path+",env:ASFE_TEST_UNSET", nil); err != nil || c.Spool == nil {
+		t.Errorf("unset env: %v %v", c, err)
+	}
+	if _, err = loadConfigSource("ftp://config", nil); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+}
+
+func TestConfigSourcePartialFailure(t *testing.T) {
+	base, over := &etagServer{}, &etagServer{}
+	base.set(`{"splunk":{"url":"https://splunk","token":"t1"}}`)
+	over.set(`{}`)
+	baseSrv, overSrv := httptest.NewServer(base), httptest.NewServer(over)
+	defer baseSrv.Close()
+	defer overSrv.Close()
+
+	cl, err := newConfigLoader(baseSrv.URL+","+overSrv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cl.load(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first source changes while the second fails; the change is not
+	// lost once the second answers again
+	base.set(`{"splunk":{"url":"https://splunk","token":"t2"}}`)
+	over.mu.Lock()
+	over.fail = 1
+	over.mu.Unlock()
+	if _, err = cl.load(context.Background(), false); err == nil {
+		t.Fatal("failed source accepted")
+	}
+	c, err := cl.load(context.Background(), false)
+	if err != nil || c == nil || c.Splunk.Token != "t2" {
+		t.Fatalf("after failure: %v %v", c, err)
+	}
+	if c, err = cl.load(context.Background(), false); c != nil || err != nil {
+		t.Errorf("unchanged: %v %v", c, err)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "asfe.json")
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(testGoodConfig, dir)), 0600)
+
+	s, err := NewServer(WithConfigURL(path), WithAddr(""), WithLogger(log.New(ioutil.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	// A reload re-reads the sources even if they look unchanged
+	s.Reload()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&s.stats.ConfigRefresh) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("config not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfigRefreshInterval(t *testing.T) {
+	ten, zero := 10, 0
+	c := &Config{ConfigRefresh: &ConfigRefreshConfig{IntervalSeconds: 60, JitterSeconds: &ten}}
+	for i := 0; i < 100; i++ {
+		if d := c.refreshInterval(); d < time.Minute || d >= 70*time.Second {
+			t.Fatalf("interval %v", d)
+		}
+	}
+	if d := (&Config{ConfigRefresh: &ConfigRefreshConfig{JitterSeconds: &zero}}).refreshInterval(); d != ConfigRefreshDuration {
+		t.Errorf("no jitter: %v", d)
+	}
+
+	// Only the interval set keeps the default jitter
+	c = &Config{ConfigRefresh: &ConfigRefreshConfig{IntervalSeconds: 60}}
+	jittered := false
+	for i := 0; i < 100 && !jittered; i++ {
+		jittered = c.refreshInterval() != time.Minute
+	}
+	if !jittered {
+		t.Error("default jitter lost")
+	}
+}
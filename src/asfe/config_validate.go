@@ -0,0 +1,263 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	ConfigTrailingDataError = errors.New("Config has data after the JSON object")
+)
+
+// ConfigErrors lists every problem found in a config
+type ConfigErrors []error
+
+func (ce ConfigErrors) Error() string {
+	msgs := make([]string, len(ce))
+	for i, err := range ce {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseConfig decodes a config.  Unknown fields are rejected, so a
+// misspelled section is not silently ignored.
+func ParseConfig(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	config := &Config{}
+	if err := dec.Decode(config); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ConfigTrailingDataError
+	}
+	return config, nil
+}
+
+func validateStorage(name string, sc *StorageConfig) error {
+	storageDriversMu.RLock()
+	_, ok := storageDrivers[sc.Driver]
+	storageDriversMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: unknown driver %q", name, sc.Driver)
+	}
+
+	switch sc.Driver {
+	case "s3", "s3compat":
+		if sc.Region == "" || sc.Bucket == "" {
+			return fmt.Errorf("%s: s3 storage requires region and bucket", name)
+		}
+		if sc.Driver == "s3compat" && sc.Endpoint == "" {
+			return fmt.Errorf("%s: s3compat storage requires endpoint", name)
+		}
+	case "file":
+		if sc.Path == "" {
+			return fmt.Errorf("%s: file storage requires path", name)
+		}
+	}
+	return nil
+}
+
+func validateQueue(name string, q []string) error {
+	if len(q) < 2 || q[0] == "" {
+		return fmt.Errorf("%s: queue requires [region, url]", name)
+	}
+	if u, err := url.Parse(q[1]); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s: bad queue url %q", name, q[1])
+	}
+	return nil
+}
+
+// Validate checks a config without building anything from it, and reports
+// every problem it finds as ConfigErrors
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate skips the storagePrimary requirement for a server that brings
+// its own storage
+func (c *Config) validate(needStorage bool) error {
+	var errs ConfigErrors
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.StoragePrimary == nil {
+		if needStorage {
+			add(errors.New("storagePrimary: required"))
+		}
+	} else {
+		add(validateStorage("storagePrimary", c.StoragePrimary))
+	}
+	if c.StorageSecondary != nil {
+		add(validateStorage("storageSecondary", c.StorageSecondary))
+	}
+	if c.Quarantine != nil {
+		add(validateStorage("storageQuarantine", c.Quarantine))
+	}
+
+	if c.QueueParseError != nil {
+		add(validateQueue("queueParseError", c.QueueParseError))
+	}
+	if c.QueueAtypical != nil {
+		add(validateQueue("queueAtypical", c.QueueAtypical))
+	}
+	for name, q := range c.Queues {
+		if name == RouteQueueAtypical || name == RouteQueueParseError {
+			add(fmt.Errorf("queues: name %q is reserved", name))
+			continue
+		}
+		add(validateQueue("queues."+name, q))
+	}
+	if c.TopicStats != nil && (len(c.TopicStats) != 2 || c.TopicStats[0] == "" || !strings.HasPrefix(c.TopicStats[1], "arn:")) {
+		add(errors.New("topicStats: requires [region, arn]"))
+	}
+
+	if c.Spool != nil {
+		if c.Spool.Path == "" {
+			add(errors.New("spool: path required"))
+		}
+		if c.Spool.MaxBytes < 0 || c.Spool.ReplaySeconds < 0 {
+			add(errors.New("spool: maxBytes and replaySeconds cannot be negative"))
+		}
+	}
+	if c.Shutdown != nil && c.Shutdown.DeadlineSeconds < 0 {
+		add(errors.New("shutdown: deadlineSeconds cannot be negative"))
+	}
+
+	if c.ConfigRefresh != nil && (c.ConfigRefresh.IntervalSeconds < 0 ||
+		(c.ConfigRefresh.JitterSeconds != nil && *c.ConfigRefresh.JitterSeconds < 0)) {
+		add(errors.New("configRefresh: intervalSeconds and jitterSeconds cannot be negative"))
+	}
+
+	if c.Auth != nil {
+		ar, err := compileAuth(c.Auth)
+		add(err)
+		if ar != nil && needStorage && c.Quarantine == nil && ar.quarantines() {
+			add(errors.New("auth: quarantine policy requires storageQuarantine"))
+		}
+	}
+	if c.Allowlist != nil {
+		_, err := compileAllowlist(c.Allowlist)
+		add(err)
+		if needStorage && c.Quarantine == nil {
+			add(errors.New("allowlist: requires storageQuarantine"))
+		}
+	}
+	if c.RateLimit != nil {
+		_, err := compileRateLimits(c.RateLimit)
+		add(err)
+	}
+	if c.Body != nil && (c.Body.MaxBytes < 0 || c.Body.MaxBatchBytes < 0 || c.Body.MaxBatchItems < 0) {
+		add(errors.New("body: maxBytes, maxBatchBytes and maxBatchItems cannot be negative"))
+	}
+	if c.Listen != nil {
+		add(listenValidate(c.Listen))
+	}
+
+	if c.StorageKey != "" {
+		_, err := compileKeyTemplate(c.StorageKey)
+		add(err)
+	}
+	if c.Dedupe != nil && (c.Dedupe.WindowSeconds < 0 || c.Dedupe.MaxEntries < 0) {
+		add(errors.New("dedupe: windowSeconds and maxEntries cannot be negative"))
+	}
+	if c.Batch != nil {
+		add(batchValidate(c.Batch))
+	}
+	if c.Parquet != nil {
+		add(parquetValidate(c.Parquet))
+	}
+	if c.Atypical != nil {
+		_, err := compileAtypical(c.Atypical)
+		add(err)
+	}
+	if c.Splunk != nil {
+		add(splunkValidate(c.Splunk))
+	}
+	if c.Syslog != nil {
+		add(syslogValidate(c.Syslog))
+	}
+	if c.Taxii != nil {
+		add(taxiiValidate(c.Taxii))
+	}
+	if c.Kafka != nil {
+		add(kafkaValidate(c.Kafka))
+	}
+	if len(c.Routes) > 0 {
+		_, err := compileRoutes(c.Routes, c.Queues)
+		add(err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateConfigCommand implements "validate-config <sources>...": each
+// comma separated source list is loaded, merged and validated, and every
+// problem printed.  Returns the process exit code.
+func ValidateConfigCommand(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(out, "usage: validate-config <source>[,<source>...]...")
+		return 2
+	}
+
+	// Signatures are checked when keys are pinned, as the server would
+	var keys ConfigKeys
+	if path := os.Getenv(ConfigKeysEnv); path != "" {
+		var err error
+		if keys, err = LoadConfigKeys(path); err != nil {
+			fmt.Fprintln(out, err)
+			return 2
+		}
+	}
+
+	code := 0
+	for _, src := range args {
+		config, err := loadConfigSource(src, keys)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil {
+			fmt.Fprintf(out, "%s: ok\n", src)
+			continue
+		}
+
+		code = 1
+		if ce, ok := err.(ConfigErrors); ok {
+			for _, e := range ce {
+				fmt.Fprintf(out, "%s: %v\n", src, e)
+			}
+		} else {
+			fmt.Fprintf(out, "%s: %v\n", src, err)
+		}
+	}
+	return code
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testGoodConfig = `{"storagePrimary":{"driver":"file","path":"%s"}}`
+
+func TestParseConfig(t *testing.T) {
+	if _, err := ParseConfig([]byte(`{"storagePrimary":["us-east-1","b"]}`)); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseConfig([]byte(`{"storagePrimery":["us-east-1","b"]}`)); err == nil {
+		t.Error("unknown field accepted")
+	}
+	if _, err := ParseConfig([]byte(`{"storagePrimary":{"driver":"file","pathh":"/tmp"}}`)); err == nil {
+		t.Error("unknown storage field accepted")
+	}
+	if _, err := ParseConfig([]byte(`{} {}`)); err != ConfigTrailingDataError {
+		t.Errorf("trailing data: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := &Config{
+		StoragePrimary: &StorageConfig{Driver: "s3"},
+		QueueAtypical:  []string{"us-east-1"},
+		StorageKey:     "/{org}",
+		Kafka:          &KafkaConfig{},
+	}
+	err := c.Validate()
+	ce, ok := err.(ConfigErrors)
+	if !ok || len(ce) != 4 {
+		t.Fatalf("errors: %v", err)
+	}
+
+	if err = (&Config{}).Validate(); err == nil || !strings.Contains(err.Error(), "storagePrimary") {
+		t.Errorf("missing storagePrimary: %v", err)
+	}
+	if err = (&Config{StoragePrimary: &StorageConfig{Driver: "file", Path: "/tmp"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	dir := t.TempDir()
+	good, bad := filepath.Join(dir, "good.json"), filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(good, []byte(strings.Replace(testGoodConfig, "%s", dir, 1)), 0600)
+	ioutil.WriteFile(bad, []byte(`{"storagePrimary":{"driver":"nope"},"spool":{}}`), 0600)
+
+	var out bytes.Buffer
+	if code := ValidateConfigCommand([]string{good}, &out); code != 0 {
+		t.Errorf("good config: %d %s", code, out.String())
+	}
+	out.Reset()
+	if code := ValidateConfigCommand([]string{bad}, &out); code != 1 || strings.Count(out.String(), "\n") != 2 {
+		t.Errorf("bad config: %d %s", code, out.String())
+	}
+}
+
+func TestConfigLastKnownGood(t *testing.T) {
+	dir := t.TempDir()
+	lastGood := filepath.Join(dir, "last-good.json")
+
+	var body atomic.Value
+	body.Store(strings.Replace(testGoodConfig, "%s", dir, 1))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer ts.Close()
+
+	logger := log.New(ioutil.Discard, "", 0)
+	s, err := NewServer(WithConfigURL(ts.URL), WithAddr(""), WithLastGoodPath(lastGood), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := s.loadConfig()
+
+	// A bad refresh is rejected, and the current config kept
+	body.Store(`{"storagePrimary":{"driver":"file"}}`)
+	s.refreshConfig(false)
+	if s.loadConfig() != first || s.stats.ConfigRejected != 1 || s.stats.ErrConfigRefresh != 1 {
+		t.Error("bad config installed")
+	}
+
+	// A restart against the bad source starts from the last known good
+	s, err = NewServer(WithConfigURL(ts.URL), WithAddr(""), WithLastGoodPath(lastGood), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := s.loadConfig(); c.StoragePrimary == nil || c.StoragePrimary.Path != dir {
+		t.Error("last known good config not used")
+	}
+	if _, err = NewServer(WithConfigURL(ts.URL), WithAddr(""), WithLogger(logger)); err == nil {
+		t.Error("bad config without a last known good")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Event is the normalized form of a single Sighting, carrying the
+// identifying fields of the Report it came from.  The *Encoding fields are
+// "hex" when that id was not valid UTF-8, as for EventData.
+type Event struct {
+	OrganizationId          string `json:"organizationId"`
+	SystemId                string `json:"systemId"`
+	SystemIdSecondary       string `json:"systemIdSecondary,omitempty"`
+	SystemType              string `json:"systemType"`
+	SystemTypeId            uint32 `json:"systemTypeId"`
+	ApplicationId           string `json:"applicationId"`
+	ApplicationIdEncoding   string `json:"applicationIdEncoding,omitempty"`
+	UserId                  string `json:"userId,omitempty"`
+	UserIdEncoding          string `json:"userIdEncoding,omitempty"`
+	UserIdSecondary         string `json:"userIdSecondary,omitempty"`
+	UserIdSecondaryEncoding string `json:"userIdSecondaryEncoding,omitempty"`
+
+	SightingType   string      `json:"sightingType"`
+	SightingTypeId uint32      `json:"sightingTypeId"`
+	Confidence     string      `json:"confidence"`
+	ConfidenceId   uint32      `json:"confidenceId"`
+	Impact         string      `json:"impact"`
+	ImpactId       uint32      `json:"impactId"`
+	TestId         uint32      `json:"testId"`
+	TestSubId      uint32      `json:"testSubId"`
+	Time           *time.Time  `json:"time,omitempty"`
+	Data           []EventData `json:"data,omitempty"`
+}
+
+// EventData is a decoded ObservationData.  Encoding is "hex" when a value
+// that should be text was not valid UTF-8.
+type EventData struct {
+	Type     string  `json:"type"`
+	TypeId   uint32  `json:"typeId"`
+	Value    string  `json:"value,omitempty"`
+	Encoding string  `json:"encoding,omitempty"`
+	Num      *uint32 `json:"num,omitempty"`
+}
+
+// DecodeReport fully unmarshals a report body.
+func DecodeReport(data []byte) (*Report, error) {
+	rep := &Report{}
+	if err := proto.Unmarshal(data, rep); err != nil {
+		return nil, MsgParseError
+	}
+	return rep, nil
+}
+
+// DecodeEvents decodes a report body straight to normalized events.
+func DecodeEvents(data []byte) ([]*Event, error) {
+	rep, err := DecodeReport(data)
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeReport(rep), nil
+}
+
+func enumName(names map[int32]string, v uint32) string {
+	if n, ok := names[int32(v)]; ok {
+		return n
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+func textValue(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return hex.EncodeToString(b), "hex"
+}
+
+func macValue(b []byte) string {
+	var buf bytes.Buffer
+	for i, c := range b {
+		if i > 0 {
+			buf.WriteByte(':')
+		}
+		buf.WriteString(hex.EncodeToString([]byte{c}))
+	}
+	return buf.String()
+}
+
+// NormalizeObservation decodes the data bytes according to the data type.
+func NormalizeObservation(od *ObservationData) EventData {
+	dt := od.GetDataType()
+	ed := EventData{
+		Type:   enumName(ObservationData_DataType_name, dt),
+		TypeId: dt,
+		Num:    od.Num,
+	}
+
+	b := od.GetData()
+	if b == nil {
+		return ed
+	}
+
+	switch ObservationData_DataType(dt) {
+	case ObservationData_DataTypeHashMD5, ObservationData_DataTypeHashSHA1,
+		ObservationData_DataTypeHashSHA256, ObservationData_DataTypeHashAS1,
+		ObservationData_DataTypeHashAS2, ObservationData_DataTypeHPKP,
+		ObservationData_DataTypeSystemID, ObservationData_DataTypeNativePointer,
+		ObservationData_DataTypeNativeInt:
+		ed.Value = hex.EncodeToString(b)
+
+	case ObservationData_DataTypeIPv4, ObservationData_DataTypeIPv6:
+		if len(b) == net.IPv4len || len(b) == net.IPv6len {
+			ed.Value = net.IP(b).String()
+		} else {
+			ed.Value, ed.Encoding = hex.EncodeToString(b), "hex"
+		}
+
+	case ObservationData_DataTypeMAC, ObservationData_DataTypeBSSID:
+		ed.Value = macValue(b)
+
+	case ObservationData_DataTypeX509:
+		ed.Value, ed.Encoding = base64.StdEncoding.EncodeToString(b), "base64"
+
+	case ObservationData_DataTypeUnknown:
+		ed.Value, ed.Encoding = hex.EncodeToString(b), "hex"
+
+	default:
+		// Everything else (and future types we don't know about) is text
+		ed.Value, ed.Encoding = textValue(b)
+	}
+
+	return ed
+}
+
+// sightingTime resolves a sighting's absolute time: timestamp is epoch
+// seconds, timeDelta is seconds relative to the report's timeBase.
+func sightingTime(rep *Report, s *Sighting) *time.Time {
+	var t time.Time
+	if s.TimeDelta != nil && rep.TimeBase != nil {
+		t = time.Unix(int64(rep.GetTimeBase())+int64(s.GetTimeDelta()), 0).UTC()
+	} else if s.Timestamp != nil {
+		t = time.Unix(int64(s.GetTimestamp()), 0).UTC()
+	} else if rep.TimeBase != nil {
+		t = time.Unix(int64(rep.GetTimeBase()), 0).UTC()
+	} else {
+		return nil
+	}
+	return &t
+}
+
+// NormalizeReport produces one Event per Sighting in the report.
+func NormalizeReport(rep *Report) []*Event {
+	base := Event{
+		OrganizationId: hex.EncodeToString(rep.GetOrganizationId()),
+		SystemId:       hex.EncodeToString(rep.GetSystemId()),
+		SystemType:     enumName(Report_SystemType_name, rep.GetSystemType()),
+		SystemTypeId:   rep.GetSystemType(),
+	}
+	if rep.SystemIdSecondary != nil {
+		base.SystemIdSecondary = hex.EncodeToString(rep.SystemIdSecondary)
+	}
+	base.ApplicationId, base.ApplicationIdEncoding = textValue(rep.GetApplicationId())
+	base.UserId, base.UserIdEncoding = textValue(rep.GetUserId())
+	base.UserIdSecondary, base.UserIdSecondaryEncoding = textValue(rep.GetUserIdSecondary())
+
+	events := make([]*Event, 0, len(rep.GetSightings()))
+	for _, s := range rep.GetSightings() {
+		ev := base
+		ev.SightingTypeId = s.GetSightingType()
+		ev.SightingType = enumName(Sighting_SightingType_name, ev.SightingTypeId)
+		ev.ConfidenceId = s.GetConfidence()
+		ev.Confidence = enumName(Sighting_SightingConfidence_name, ev.ConfidenceId)
+		ev.ImpactId = s.GetImpact()
+		ev.Impact = enumName(Sighting_SightingImpact_name, ev.ImpactId)
+		ev.TestId = s.GetTestId()
+		ev.TestSubId = s.GetTestSubId()
+		ev.Time = sightingTime(rep, s)
+
+		for _, od := range s.GetDatas() {
+			ev.Data = append(ev.Data, NormalizeObservation(od))
+		}
+		events = append(events, &ev)
+	}
+
+	return events
+}
+
+// WriteEventsJSON writes events as newline-delimited JSON.
+func WriteEventsJSON(w io.Writer, events []*Event) error {
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestDecodeEvents(t *testing.T) {
+	rep := &Report{
+		OrganizationId: []byte{0xab, 0xcd},
+		SystemId:       []byte{0x01, 0x02},
+		SystemType:     proto.Uint32(2),
+		ApplicationId:  []byte("com.example.app"),
+		UserId:         []byte{0xff, 0xfe},
+		TimeBase:       proto.Uint32(1500000000),
+		Sightings: []*Sighting{
+			{
+				SightingType: proto.Uint32(4),
+				Confidence:   proto.Uint32(3),
+				Impact:       proto.Uint32(4),
+				TestId:       proto.Uint32(300),
+				TimeDelta:    proto.Uint32(60),
+				Datas: []*ObservationData{
+					{DataType: proto.Uint32(20), Data: []byte{10, 0, 0, 1}},
+					{DataType: proto.Uint32(24), Data: []byte{0, 0x1b, 0x44, 0x11, 0x3a, 0xb7}},
+					{DataType: proto.Uint32(3), Data: []byte{0xde, 0xad}},
+					{DataType: proto.Uint32(15), Data: []byte("/system/bin/su")},
+					{DataType: proto.Uint32(200), Data: []byte{0xff}},
+				},
+			},
+			{TestId: proto.Uint32(99), Timestamp: proto.Uint32(1600000000)},
+		},
+	}
+	data, err := proto.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := DecodeEvents(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events", len(events))
+	}
+
+	ev := events[0]
+	if ev.OrganizationId != "abcd" || ev.SystemType != "SystemTypeAndroid" ||
+		ev.ApplicationId != "com.example.app" || ev.SightingType != "SightingTypeMalwareArtifacts" ||
+		ev.Confidence != "SightingConfidenceHigh" || ev.Impact != "SightingImpactMajor" {
+		t.Errorf("event fields: %+v", ev)
+	}
+	if ev.ApplicationIdEncoding != "" || ev.UserId != "fffe" || ev.UserIdEncoding != "hex" {
+		t.Errorf("id encodings: %+v", ev)
+	}
+	if ev.Time == nil || ev.Time.Unix() != 1500000060 {
+		t.Errorf("time: %v", ev.Time)
+	}
+	if events[1].Time == nil || events[1].Time.Unix() != 1600000000 {
+		t.Errorf("timestamp: %v", events[1].Time)
+	}
+
+	want := []string{"10.0.0.1", "00:1b:44:11:3a:b7", "dead", "/system/bin/su"}
+	for i, w := range want {
+		if ev.Data[i].Value != w {
+			t.Errorf("data %d: got %q want %q", i, ev.Data[i].Value, w)
+		}
+	}
+	if ev.Data[4].Value != "ff" || ev.Data[4].Encoding != "hex" || ev.Data[4].Type != "200" {
+		t.Errorf("unknown data type: %+v", ev.Data[4])
+	}
+
+	var b bytes.Buffer
+	if err := WriteEventsJSON(&b, events); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(b.Bytes(), []byte("\n")) != 2 {
+		t.Errorf("ndjson: %s", b.String())
+	}
+}
+
+func TestDecodeEventsTestData(t *testing.T) {
+	for _, name := range []string{"testdata/test_msg_sp.bin", "testdata/test_msg_fp.bin"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeEvents(data); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
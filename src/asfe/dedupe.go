@@ -0,0 +1,265 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DedupeDefaultWindow  = 10 * time.Minute
+	DedupeDefaultEntries = 100000
+
+	// DefaultContentStorageKey names objects by body digest, so a resent
+	// report overwrites itself
+	DefaultContentStorageKey = "/{org}/{app}_{systypecode}/{sysid}/{hash}"
+
+	seenRecordSize = reportDigestSize + 8
+)
+
+// DedupeConfig enables duplicate suppression: a report whose body was
+// already accepted within the window is acknowledged but not stored or
+// queued again.  Path, when set, keeps the seen-set across restarts.
+type DedupeConfig struct {
+	WindowSeconds int    `json:"windowSeconds,omitempty"`
+	MaxEntries    int    `json:"maxEntries,omitempty"`
+	Path          string `json:"path,omitempty"`
+}
+
+type seenDigest [reportDigestSize]byte
+
+type seenEntry struct {
+	digest seenDigest
+	at     int64 // unix nanos
+}
+
+// seenSet is a bounded set of recently accepted report digests.  Entries
+// leave it when they age out of the window, or oldest first once it is full.
+type seenSet struct {
+	mu      sync.Mutex
+	window  time.Duration
+	max     int
+	entries map[seenDigest]int64
+	order   []seenEntry // oldest first; may hold stale duplicates of a digest
+	file    *os.File
+	written int
+}
+
+func openSeenSet(dc *DedupeConfig, now time.Time) (*seenSet, error) {
+	ss := &seenSet{
+		window:  DedupeDefaultWindow,
+		max:     DedupeDefaultEntries,
+		entries: make(map[seenDigest]int64),
+	}
+	if dc.WindowSeconds > 0 {
+		ss.window = time.Duration(dc.WindowSeconds) * time.Second
+	}
+	if dc.MaxEntries > 0 {
+		ss.max = dc.MaxEntries
+	}
+
+	if dc.Path == "" {
+		return ss, nil
+	}
+
+	if f, err := os.Open(dc.Path); err == nil {
+		err = ss.load(f, now)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := ss.compact(dc.Path); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// load reads (digest, time) records; a torn last record is ignored
+func (ss *seenSet) load(r io.Reader, now time.Time) error {
+	br := bufio.NewReader(r)
+	var rec [seenRecordSize]byte
+	for {
+		if _, err := io.ReadFull(br, rec[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		var e seenEntry
+		copy(e.digest[:], rec[:reportDigestSize])
+		e.at = int64(binary.BigEndian.Uint64(rec[reportDigestSize:]))
+		ss.insert(e)
+	}
+	ss.expire(now.UnixNano())
+	return nil
+}
+
+// compact rewrites the file from memory and reopens it for appending
+func (ss *seenSet) compact(path string) error {
+	if ss.file != nil {
+		ss.file.Close()
+		ss.file = nil
+	}
+
+	tmp, err := os.Create(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp"))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	for _, e := range ss.order {
+		if ss.entries[e.digest] == e.at {
+			bw.Write(e.record())
+		}
+	}
+	if err = bw.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	ss.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	ss.written = len(ss.entries)
+	return err
+}
+
+func (e *seenEntry) record() []byte {
+	var rec [seenRecordSize]byte
+	copy(rec[:], e.digest[:])
+	binary.BigEndian.PutUint64(rec[reportDigestSize:], uint64(e.at))
+	return rec[:]
+}
+
+func (ss *seenSet) insert(e seenEntry) {
+	ss.entries[e.digest] = e.at
+	ss.order = append(ss.order, e)
+
+	for len(ss.entries) > ss.max {
+		ss.pop()
+	}
+}
+
+// pop drops the oldest entry
+func (ss *seenSet) pop() {
+	e := ss.order[0]
+	ss.order = ss.order[1:]
+	if ss.entries[e.digest] == e.at {
+		delete(ss.entries, e.digest)
+	}
+}
+
+func (ss *seenSet) expire(now int64) {
+	limit := now - int64(ss.window)
+	for len(ss.order) > 0 && ss.order[0].at <= limit {
+		ss.pop()
+	}
+}
+
+// Seen reports whether digest was added within the window
+func (ss *seenSet) Seen(digest []byte, now time.Time) bool {
+	var d seenDigest
+	copy(d[:], digest)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	at, ok := ss.entries[d]
+	return ok && at > now.UnixNano()-int64(ss.window)
+}
+
+// Claim records digest before its report is handled, so copies sent at
+// the same time are handled once.  It returns false when digest was
+// already claimed or added within the window.  A claim stays in memory
+// until Add keeps it, or Release drops it.
+func (ss *seenSet) Claim(digest []byte, now time.Time) bool {
+	e := seenEntry{at: now.UnixNano()}
+	copy(e.digest[:], digest)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if at, ok := ss.entries[e.digest]; ok && at > e.at-int64(ss.window) {
+		return false
+	}
+	ss.expire(e.at)
+	ss.insert(e)
+	return true
+}
+
+// Release drops the claim of a report that was not accepted, so a resend
+// is handled
+func (ss *seenSet) Release(digest []byte) {
+	var d seenDigest
+	copy(d[:], digest)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.entries, d)
+}
+
+// Add records an accepted report
+func (ss *seenSet) Add(digest []byte, now time.Time) error {
+	e := seenEntry{at: now.UnixNano()}
+	copy(e.digest[:], digest)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expire(e.at)
+	ss.insert(e)
+
+	if ss.file == nil {
+		return nil
+	}
+	if _, err := ss.file.Write(e.record()); err != nil {
+		return err
+	}
+	ss.written++
+	if ss.written > 2*ss.max {
+		return ss.compact(ss.file.Name())
+	}
+	return nil
+}
+
+func (ss *seenSet) Len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.entries)
+}
+
+func (ss *seenSet) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.file == nil {
+		return nil
+	}
+	err := ss.file.Close()
+	ss.file = nil
+	return err
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSeenSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1500000000, 0)
+	dc := &DedupeConfig{WindowSeconds: 60, MaxEntries: 2, Path: filepath.Join(dir, "seen")}
+	ss, err := openSeenSet(dc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b, c := reportDigest([]byte("a")), reportDigest([]byte("b")), reportDigest([]byte("c"))
+	ss.Add(a, now)
+	if !ss.Seen(a, now.Add(59*time.Second)) || ss.Seen(a, now.Add(60*time.Second)) {
+		t.Error("window")
+	}
+
+	// Bounded: the oldest goes first
+	ss.Add(b, now.Add(time.Second))
+	ss.Add(c, now.Add(2*time.Second))
+	if ss.Seen(a, now) || !ss.Seen(b, now) || !ss.Seen(c, now) || ss.Len() != 2 {
+		t.Error("eviction")
+	}
+	ss.Close()
+
+	// Survives a restart, minus what aged out meanwhile
+	ss, err = openSeenSet(dc, now.Add(61*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	if ss.Seen(b, now.Add(61*time.Second)) || !ss.Seen(c, now.Add(61*time.Second)) || ss.Len() != 1 {
+		t.Errorf("reload: %d", ss.Len())
+	}
+}
+
+func TestServerDuplicate(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clock int64 = 1500000000
+	now := func() time.Time { return time.Unix(atomic.LoadInt64(&clock), 0) }
+	m, q := newMemStorage(), &memQueue{}
+	s, err := NewServer(WithAddr(""), WithStorage(m, nil), WithQueues(nil, q), WithClock(now),
+		WithConfig(&Config{
+			ContentKeys: true,
+			Dedupe:      &DedupeConfig{WindowSeconds: 60},
+			Atypical:    &AtypicalConfig{Rules: []AtypicalRule{{Tests: []uint32{407}}}},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := postMsg(s, data); code != 200 {
+			t.Fatalf("post: %d", code)
+		}
+	}
+	if m.len() != 1 || atomic.LoadUint64(&s.Stats().Duplicate) != 2 {
+		t.Errorf("stored %d, duplicates %d", m.len(), atomic.LoadUint64(&s.Stats().Duplicate))
+	}
+
+	// Outside the window it is accepted again, under the same content key
+	atomic.AddInt64(&clock, 61)
+	postMsg(s, data)
+	if m.len() != 1 || atomic.LoadUint64(&s.Stats().StoredPrimary) != 2 {
+		t.Errorf("after window: stored %d", m.len())
+	}
+
+	s.Shutdown(context.Background())
+	if q.len() != 2 {
+		t.Errorf("atypical queued %d", q.len())
+	}
+}
+
+func TestServerDuplicateClaim(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil), WithConfig(&Config{ContentKeys: true, Dedupe: &DedupeConfig{}}))
+
+	// A report that was not stored can be sent again
+	m.fail = true
+	if code := postMsg(s, data); code != 500 {
+		t.Fatalf("failed store: %d", code)
+	}
+	m.fail = false
+
+	// Copies sent at once are stored once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postMsg(s, data)
+		}()
+	}
+	wg.Wait()
+	if st := s.Stats(); st.StoredPrimary != 1 || st.Duplicate != 7 {
+		t.Errorf("stored %d, duplicates %d", st.StoredPrimary, st.Duplicate)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ShutdownDefaultDeadline = 25 * time.Second
+
+	drainKeyParseError = "parseError"
+	drainKeyAtypical   = "atypical"
+)
+
+// ShutdownConfig bounds a graceful shutdown.  Queued parse error and
+// atypical reports that cannot reach their queue before the deadline are
+// written to DrainPath, and sent on the next start.
+type ShutdownConfig struct {
+	DeadlineSeconds int    `json:"deadlineSeconds,omitempty"`
+	DrainPath       string `json:"drainPath,omitempty"`
+}
+
+// ShutdownTimeout is the configured shutdown deadline
+func (s *Server) ShutdownTimeout() time.Duration {
+	mc := s.loadConfig()
+	if mc.Shutdown != nil && mc.Shutdown.DeadlineSeconds > 0 {
+		return time.Duration(mc.Shutdown.DeadlineSeconds) * time.Second
+	}
+	return ShutdownDefaultDeadline
+}
+
+func (s *Server) drainQueue(mc *Config) func(key string) Queue {
+	return func(key string) Queue {
+		switch key {
+		case drainKeyParseError:
+			return mc.queueParseError
+		case drainKeyAtypical:
+			return mc.queueAtypical
+		}
+		return nil
+	}
+}
+
+// drainChannel empties ch into its queue, falling back to the drain spool
+// once the queue fails or ctx is done
+func (s *Server) drainChannel(ctx context.Context, ch chan []byte, key string) {
+	queue := s.drainQueue(s.loadConfig())(key)
+
+	for {
+		var data []byte
+		select {
+		case data = <-ch:
+		default:
+			return
+		}
+
+		if queue != nil && ctx.Err() == nil {
+			if err := queue.Send(data); err == nil {
+				atomic.AddUint64(&s.stats.Drained, 1)
+				continue
+			}
+		}
+
+		if s.drain == nil || s.drain.Append(key, data) != nil {
+			atomic.AddUint64(&s.stats.ErrDrain, 1)
+			continue
+		}
+		atomic.AddUint64(&s.stats.DrainSpooled, 1)
+	}
+}
+
+// discardQueues empties the queues that are not drained, counting what
+// is lost
+func (s *Server) discardQueues() {
+	var n uint64
+	for {
+		select {
+		case <-s.chanExport:
+		case <-s.chanSplunk:
+		case <-s.chanSyslog:
+		case <-s.chanTaxii:
+		case <-s.chanParquet:
+		case <-s.chanKafka:
+		case <-s.chanRoute:
+		default:
+			atomic.AddUint64(&s.stats.DrainDropped, n)
+			return
+		}
+		n++
+	}
+}
+
+// drainReplay sends reports left on disk by a previous shutdown
+func (s *Server) drainReplay() {
+	queues := s.drainQueue(s.loadConfig())
+
+	_, err := s.drain.Replay(func(key string, r io.ReadSeeker) error {
+		queue := queues(key)
+		if queue == nil {
+			// Not configured any more; nothing to deliver to
+			return nil
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err = queue.Send(data); err != nil {
+			return err
+		}
+		atomic.AddUint64(&s.stats.DrainReplayed, 1)
+		return nil
+	})
+	if err != nil {
+		atomic.AddUint64(&s.stats.ErrDrain, 1)
+	}
+}
@@ -16,11 +16,12 @@
 package asfe
 
 import (
-	"bytes"
-	"io/ioutil"
+	"context"
+	"encoding/hex"
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -31,91 +32,207 @@ var (
 	pool sync.Pool = sync.Pool{New: func() interface{} { return make([]byte, MaxStandardLength) }}
 )
 
-func handleMsg(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleMsg(w http.ResponseWriter, r *http.Request) {
 	var body []byte
-	var err error
-	atomic.AddUint64(&StatRequest, 1)
+	mc := s.loadConfig()
+	atomic.AddUint64(&s.stats.Request, 1)
+
+	start := time.Now()
+	path := PathError
+	defer func() {
+		s.metrics.requestDuration.With(path).ObserveSince(start)
+		s.metrics.requestSize.With(path).Observe(float64(len(body)))
+	}()
 
 	// We need a POST w/ a non-zero body length
 	if r.Method != "POST" || r.ContentLength == 0 {
-		atomic.AddUint64(&StatErrDiscarded, 1)
+		atomic.AddUint64(&s.stats.ErrDiscarded, 1)
 		w.WriteHeader(200)
 		return
 	}
 
-	// Attempt to re-use a pool buffer
-	if r.ContentLength > 1 && r.ContentLength < MaxStandardLength {
-		poolBuf := pool.Get().([]byte)
-		defer pool.Put(poolBuf)
+	// Shed load before taking on more than the backends can keep up with
+	done := s.opAdmit(mc, w)
+	if done == nil {
+		return
+	}
+	defer done()
 
-		// Read into our existing buffer
-		n, err := r.Body.Read(poolBuf)
-		if err != nil {
-			atomic.AddUint64(&StatErrBodyRead, 1)
-			w.WriteHeader(500)
-			return
+	// Read the whole body, decompressed, into a pool buffer if it fits
+	body, release, err := s.readBody(r, mc.maxBodyLength())
+	if err != nil {
+		s.bodyError(w, err)
+		return
+	}
+	defer release()
+	if len(body) == 0 {
+		atomic.AddUint64(&s.stats.ErrDiscarded, 1)
+		w.WriteHeader(200)
+		return
+	}
+
+	// Signatures are checked, when the config asks for them, before parsing
+	var auth authResult
+	if mc.auth != nil {
+		auth = s.authenticate(mc.auth, r.Header, body)
+		if auth.err == nil {
+			switch s.replay.claim(auth.sig, s.now(), mc.auth.window) {
+			case AuthReplayError:
+				// Already accepted, or being handled; the device did not get our answer
+				atomic.AddUint64(&s.stats.AuthReplay, 1)
+				w.WriteHeader(200)
+				return
+			case AuthReplayFullError:
+				atomic.AddUint64(&s.stats.ErrAuthReplayFull, 1)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
 		}
+	}
 
-		// Slice the buffer down to the body length
-		body = poolBuf[0:n]
+	res := s.handleReport(r.Context(), mc, body, auth)
+	path = res.path
+	if res.code != 200 && mc.auth != nil && auth.err == nil {
+		s.replay.release(auth.sig)
+	}
+	if res.code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", retryAfter(res.retry))
+	}
+	w.WriteHeader(res.code)
+}
 
-	} else {
-		atomic.AddUint64(&StatNonPool, 1)
-
-		// Read in the body
-		body, err = ioutil.ReadAll(r.Body)
-		if err != nil {
-			atomic.AddUint64(&StatErrBodyRead, 1)
-			w.WriteHeader(500)
-			return
+// reportResult is the answer to one report
+type reportResult struct {
+	path  string        // parse path, for metrics
+	code  int           // HTTP status
+	retry time.Duration // for a 429
+}
+
+// handleReport takes one report through parsing, the admission checks and
+// the flows.  auth is the signature check of the request it came in.
+func (s *Server) handleReport(ctx context.Context, mc *Config, body []byte, auth authResult) reportResult {
+	res := reportResult{path: PathError, code: 200}
+
+	// Parse the protobuf to minimum necessary values
+	parseStart := time.Now()
+	pi, err := parseMsgRules(body, mc.atypicalRules())
+	if err == nil {
+		res.path = PathFast
+		if pi.Fallback {
+			res.path = PathFallback
+			atomic.AddUint64(&s.stats.ParseFallback, 1)
+		}
+	}
+	s.metrics.parseDuration.With(res.path).ObserveSince(parseStart)
+
+	// The signed org has to be the report's; an unparsable report only
+	// has the org it claims
+	if mc.auth != nil {
+		org := auth.org
+		if err == nil {
+			org = hex.EncodeToString(pi.OrgId)
+			if auth.err == nil && auth.org != org {
+				atomic.AddUint64(&s.stats.ErrAuthSignature, 1)
+				auth.err = AuthSignatureError
+			}
+		}
+		if auth.err == nil {
+			atomic.AddUint64(&s.stats.AuthVerified, 1)
+		} else if code := s.opAuthPolicy(mc, org, body); code != 0 {
+			res.code = code
+			return res
 		}
 	}
 
-	// Parse the protobuf to minimum necessary values
-	pi, err := parseMsg(body)
 	if err != nil {
 		// Not parsable; if we return 500, the device will keep re-sending.
 		// So we have to return 200 in order for device to purge from queue.
-		atomic.AddUint64(&StatErrParse, 1)
-		opQueueParseError(body)
-		w.WriteHeader(200)
-		return
+		atomic.AddUint64(&s.stats.ErrParse, 1)
+		s.opQueueParseError(body)
+		s.opForwardKafka(body, nil)
+		return res
 	}
 
-	// Create key
-	key, err := createStorageKey(body, pi)
-	if err != nil {
-		atomic.AddUint64(&StatErrCreateKey, 1)
-		w.WriteHeader(500)
-		return
+	// Reports from orgs and apps we do not know are kept apart
+	if mc.allowlist != nil {
+		if code := s.opAllowlist(mc, body, pi); code != 0 {
+			res.code = code
+			return res
+		}
 	}
 
-	// Wrap the data in a readseeker
-	rdr := bytes.NewReader(body)
+	// Noisy devices and orgs are held to their rate
+	if mc.rateLimit != nil {
+		if code, wait := s.opRateLimit(mc, pi); code != 0 {
+			res.code, res.retry = code, wait
+			return res
+		}
+	}
 
-	// Try to write to primary
-	err = opStorePrimary(rdr, key)
-	if err != nil {
-		// Failed to put to primary; try secondary
-		err = opStoreSecondary(rdr, key)
-		if err != nil {
-			// Failed to save to secondary
-			atomic.AddUint64(&StatErrStore, 1)
-			w.WriteHeader(500)
-			return
-		} else {
-			atomic.AddUint64(&StatStoredSecondary, 1)
+	// A resend of a report we already accepted, or are handling, is
+	// acknowledged, and nothing more
+	var digest []byte
+	if s.seen != nil {
+		digest = reportDigest(body)
+		if !s.seen.Claim(digest, s.now()) {
+			atomic.AddUint64(&s.stats.Duplicate, 1)
+			return res
 		}
+	}
+
+	// Routes, when one matches, replace the default flow
+	if routes := mc.matchRoutes(body, pi); len(routes) > 0 {
+		err = s.opRoute(ctx, mc, routes, body, pi)
 	} else {
-		atomic.AddUint64(&StatStoredPrimary, 1)
+		err = s.opDefaultFlow(ctx, mc, body, pi)
+	}
+	if err != nil {
+		if s.seen != nil {
+			s.seen.Release(digest)
+		}
+		res.code = 500
+		return res
 	}
 
+	if s.seen != nil {
+		if err = s.seen.Add(digest, s.now()); err != nil {
+			atomic.AddUint64(&s.stats.ErrDedupe, 1)
+		}
+	}
+
+	atomic.AddUint64(&s.stats.OK, 1)
+	return res
+}
+
+// opDefaultFlow stores a report, then hands it to every configured output
+// and, if atypical, to the atypical queue
+func (s *Server) opDefaultFlow(ctx context.Context, mc *Config, body []byte, pi *ParsedInfo) error {
+	key, err := s.storeReport(ctx, mc, body, pi, nil)
+	if err != nil {
+		return err
+	}
+
+	// Optionally store the decoded events next to the raw object
+	if key != "" {
+		s.opExportDecoded(body, key)
+	}
+
+	// Optionally add the sightings to the Parquet export
+	s.opExportParquet(body)
+
+	// Optionally forward the decoded events to SIEM outputs
+	s.opForwardSplunk(body)
+	s.opForwardSyslog(body)
+	s.opPublishTaxii(body)
+
+	// Optionally produce the report to Kafka
+	s.opForwardKafka(body, pi)
+
 	// If there is something atypical in the msg, then submit it for further inspection
 	if pi.Atypical {
-		atomic.AddUint64(&StatAtypical, 1)
-		opQueueAtypical(body)
+		atomic.AddUint64(&s.stats.Atypical, 1)
+		s.opQueueAtypical(body)
 	}
-
-	atomic.AddUint64(&StatOK, 1)
-	w.WriteHeader(200)
+	return nil
 }
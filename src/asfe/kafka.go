@@ -0,0 +1,324 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	QUEUE_SIZE_KAFKA = 1000
+
+	KafkaDefaultVersion  = "2.1.0"
+	KafkaDefaultClientId = "asfe"
+)
+
+// KafkaConfig configures the Kafka output.  Each topic is optional; raw
+// and atypical carry the report body, decoded carries one JSON event per
+// sighting, parse errors carry the unparsable body.  Messages are keyed by
+// SystemId, so one device's messages stay ordered on one partition.
+type KafkaConfig struct {
+	Brokers         []string `json:"brokers"`
+	ClientId        string   `json:"clientId,omitempty"`
+	Version         string   `json:"version,omitempty"`
+	TopicRaw        string   `json:"topicRaw,omitempty"`
+	TopicDecoded    string   `json:"topicDecoded,omitempty"`
+	TopicAtypical   string   `json:"topicAtypical,omitempty"`
+	TopicParseError string   `json:"topicParseError,omitempty"`
+	Compression     string   `json:"compression,omitempty"`
+	TLS             bool     `json:"tls,omitempty"`
+}
+
+// equal compares by value, so a refresh that leaves the config unchanged
+// keeps the producer
+func (kc *KafkaConfig) equal(o *KafkaConfig) bool {
+	if len(kc.Brokers) != len(o.Brokers) {
+		return false
+	}
+	for i := range kc.Brokers {
+		if kc.Brokers[i] != o.Brokers[i] {
+			return false
+		}
+	}
+	return kc.ClientId == o.ClientId && kc.Version == o.Version &&
+		kc.TopicRaw == o.TopicRaw && kc.TopicDecoded == o.TopicDecoded &&
+		kc.TopicAtypical == o.TopicAtypical && kc.TopicParseError == o.TopicParseError &&
+		kc.Compression == o.Compression && kc.TLS == o.TLS
+}
+
+type kafkaItem struct {
+	data       []byte
+	pi         *ParsedInfo // nil for parse errors
+	atypical   bool
+	parseError bool
+}
+
+func kafkaCodec(name string) (sarama.CompressionCodec, error) {
+	switch name {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	}
+	return sarama.CompressionNone, fmt.Errorf("kafka: unknown compression %q", name)
+}
+
+// kafkaSaramaConfig builds an idempotent producer config: acks from all
+// in-sync replicas, one in-flight request per broker, so retries neither
+// duplicate nor reorder messages.
+func kafkaSaramaConfig(kc *KafkaConfig) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+
+	version := kc.Version
+	if version == "" {
+		version = KafkaDefaultVersion
+	}
+	v, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if !v.IsAtLeast(sarama.V0_11_0_0) {
+		return nil, errors.New("kafka: idempotent producer needs version 0.11 or later")
+	}
+	c.Version = v
+
+	c.ClientID = kc.ClientId
+	if c.ClientID == "" {
+		c.ClientID = KafkaDefaultClientId
+	}
+	if c.Producer.Compression, err = kafkaCodec(kc.Compression); err != nil {
+		return nil, err
+	}
+	c.Producer.Idempotent = true
+	c.Producer.RequiredAcks = sarama.WaitForAll
+	c.Producer.Retry.Max = 10
+	c.Producer.Return.Successes = true
+	c.Producer.Return.Errors = true
+	c.Producer.Partitioner = sarama.NewHashPartitioner
+	c.Net.MaxOpenRequests = 1
+	if kc.TLS {
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = &tls.Config{}
+	}
+	return c, c.Validate()
+}
+
+func kafkaValidate(kc *KafkaConfig) error {
+	if len(kc.Brokers) == 0 {
+		return errors.New("kafka: brokers required")
+	}
+	if kc.TopicRaw == "" && kc.TopicDecoded == "" && kc.TopicAtypical == "" && kc.TopicParseError == "" {
+		return errors.New("kafka: no topics")
+	}
+	_, err := kafkaSaramaConfig(kc)
+	return err
+}
+
+func (s *Server) newKafkaProducer(kc *KafkaConfig) (sarama.AsyncProducer, error) {
+	if s.kafkaProducer != nil {
+		return s.kafkaProducer, nil
+	}
+	c, err := kafkaSaramaConfig(kc)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewAsyncProducer(kc.Brokers, c)
+}
+
+func kafkaMessage(topic string, pi *ParsedInfo, value []byte) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)}
+	if pi != nil {
+		msg.Key = sarama.ByteEncoder(pi.SysId)
+		msg.Headers = []sarama.RecordHeader{
+			{Key: []byte("org"), Value: []byte(hex.EncodeToString(pi.OrgId))},
+			{Key: []byte("app"), Value: pi.AppId},
+			{Key: []byte("systype"), Value: []byte(strconv.FormatUint(uint64(pi.SysType), 10))},
+		}
+	}
+	return msg
+}
+
+// kafkaMessages maps a queued item to its messages under the current config
+func (s *Server) kafkaMessages(kc *KafkaConfig, item *kafkaItem) []*sarama.ProducerMessage {
+	if item.parseError {
+		if kc.TopicParseError == "" {
+			return nil
+		}
+		return []*sarama.ProducerMessage{kafkaMessage(kc.TopicParseError, nil, item.data)}
+	}
+
+	var msgs []*sarama.ProducerMessage
+	if kc.TopicRaw != "" {
+		msgs = append(msgs, kafkaMessage(kc.TopicRaw, item.pi, item.data))
+	}
+	if kc.TopicDecoded != "" {
+		events, err := DecodeEvents(item.data)
+		if err != nil {
+			atomic.AddUint64(&s.stats.ErrKafka, 1)
+		}
+		for _, ev := range events {
+			js, err := json.Marshal(ev)
+			if err != nil {
+				atomic.AddUint64(&s.stats.ErrKafka, 1)
+				continue
+			}
+			msgs = append(msgs, kafkaMessage(kc.TopicDecoded, item.pi, js))
+		}
+	}
+	if item.atypical && kc.TopicAtypical != "" {
+		msgs = append(msgs, kafkaMessage(kc.TopicAtypical, item.pi, item.data))
+	}
+	return msgs
+}
+
+func (s *Server) kafkaWorker() {
+	var p sarama.AsyncProducer
+	var current *KafkaConfig
+	var successes <-chan *sarama.ProducerMessage
+	var errs <-chan *sarama.ProducerError
+
+	// closeProducer flushes what is in flight and counts its results
+	closeProducer := func() {
+		if p == nil {
+			return
+		}
+		p.AsyncClose()
+		for successes != nil || errs != nil {
+			select {
+			case _, ok := <-successes:
+				if !ok {
+					successes = nil
+					continue
+				}
+				atomic.AddUint64(&s.stats.KafkaSent, 1)
+			case _, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				atomic.AddUint64(&s.stats.ErrKafka, 1)
+			}
+		}
+		p = nil
+	}
+
+	produce := func(item *kafkaItem) {
+		mc := s.loadConfig()
+		if mc.Kafka == nil {
+			return
+		}
+
+		// Pick up config refreshes
+		if current == nil || !current.equal(mc.Kafka) {
+			if s.kafkaProducer == nil {
+				closeProducer()
+			}
+			np, err := s.newKafkaProducer(mc.Kafka)
+			if err != nil {
+				atomic.AddUint64(&s.stats.ErrKafka, 1)
+				return
+			}
+			kc := *mc.Kafka
+			kc.Brokers = append([]string(nil), mc.Kafka.Brokers...)
+			p, current = np, &kc
+			successes, errs = p.Successes(), p.Errors()
+		}
+
+		for _, msg := range s.kafkaMessages(mc.Kafka, item) {
+			// Keep reading results while the input is busy
+			for sent := false; !sent; {
+				select {
+				case p.Input() <- msg:
+					sent = true
+				case <-successes:
+					atomic.AddUint64(&s.stats.KafkaSent, 1)
+				case <-errs:
+					atomic.AddUint64(&s.stats.ErrKafka, 1)
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case item := <-s.chanKafka:
+			produce(&item)
+		case _, ok := <-successes:
+			if ok {
+				atomic.AddUint64(&s.stats.KafkaSent, 1)
+			}
+		case _, ok := <-errs:
+			if ok {
+				atomic.AddUint64(&s.stats.ErrKafka, 1)
+			}
+		case <-s.done:
+			// Hand over what is queued, then flush
+			for {
+				select {
+				case item := <-s.chanKafka:
+					produce(&item)
+					continue
+				default:
+				}
+				break
+			}
+			closeProducer()
+			return
+		}
+	}
+}
+
+// opForwardKafka queues a report for the Kafka output, if configured.  A
+// full queue drops the report rather than holding up the request.
+func (s *Server) opForwardKafka(data []byte, pi *ParsedInfo) {
+	mc := s.loadConfig()
+	if mc.Kafka == nil {
+		return
+	}
+
+	item := kafkaItem{data: append([]byte(nil), data...), parseError: pi == nil}
+	if pi != nil {
+		// pi slices into the body, which may live in a pool buffer
+		item.pi = &ParsedInfo{
+			OrgId:   append([]byte(nil), pi.OrgId...),
+			SysId:   append([]byte(nil), pi.SysId...),
+			AppId:   append([]byte(nil), pi.AppId...),
+			SysType: pi.SysType,
+		}
+		item.atypical = pi.Atypical
+	}
+
+	select {
+	case s.chanKafka <- item:
+		// No op, it was submitted to the channel
+	default:
+		atomic.AddUint64(&s.stats.QueueFullKafka, 1)
+	}
+}
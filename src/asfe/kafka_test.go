@@ -0,0 +1,130 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestKafkaValidate(t *testing.T) {
+	if err := kafkaValidate(&KafkaConfig{Brokers: []string{"b:9092"}, TopicRaw: "raw"}); err != nil {
+		t.Error(err)
+	}
+	bad := []*KafkaConfig{
+		{TopicRaw: "raw"},
+		{Brokers: []string{"b:9092"}},
+		{Brokers: []string{"b:9092"}, TopicRaw: "raw", Version: "0.10.2.0"},
+		{Brokers: []string{"b:9092"}, TopicRaw: "raw", Compression: "brotli"},
+	}
+	for i, kc := range bad {
+		if kafkaValidate(kc) == nil {
+			t.Errorf("config %d accepted", i)
+		}
+	}
+
+	c, _ := kafkaSaramaConfig(&KafkaConfig{Brokers: []string{"b:9092"}, TopicRaw: "raw"})
+	if !c.Producer.Idempotent || c.Producer.RequiredAcks != sarama.WaitForAll || c.Net.MaxOpenRequests != 1 {
+		t.Error("producer is not idempotent")
+	}
+
+	kc := &KafkaConfig{Brokers: []string{"a:9092", "b:9092"}, TopicRaw: "raw"}
+	if !kc.equal(&KafkaConfig{Brokers: []string{"a:9092", "b:9092"}, TopicRaw: "raw"}) ||
+		kc.equal(&KafkaConfig{Brokers: []string{"a:9092"}, TopicRaw: "raw"}) ||
+		kc.equal(&KafkaConfig{Brokers: []string{"a:9092", "c:9092"}, TopicRaw: "raw"}) ||
+		kc.equal(&KafkaConfig{Brokers: []string{"a:9092", "b:9092"}, TopicRaw: "raw", TLS: true}) {
+		t.Error("config comparison")
+	}
+}
+
+func TestKafkaOutput(t *testing.T) {
+	kc := &KafkaConfig{
+		Brokers:         []string{"b:9092"},
+		TopicRaw:        "raw",
+		TopicDecoded:    "decoded",
+		TopicAtypical:   "atypical",
+		TopicParseError: "parse-error",
+	}
+	sc, err := kafkaSaramaConfig(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := mocks.NewAsyncProducer(t, sc)
+
+	check := func(topic string, keyed bool) mocks.MessageChecker {
+		return func(msg *sarama.ProducerMessage) error {
+			if msg.Topic != topic {
+				return fmt.Errorf("topic %s, want %s", msg.Topic, topic)
+			}
+			if !keyed {
+				if msg.Key != nil || len(msg.Headers) != 0 {
+					return errors.New("parse error message is keyed")
+				}
+				return nil
+			}
+			key, _ := msg.Key.Encode()
+			if !bytes.Equal(key, []byte{0x01, 0x02}) {
+				return fmt.Errorf("key %x", key)
+			}
+			headers := make(map[string]string)
+			for _, h := range msg.Headers {
+				headers[string(h.Key)] = string(h.Value)
+			}
+			if headers["org"] != "abcd" || headers["app"] != "com.app" || headers["systype"] != "1" {
+				return fmt.Errorf("headers %v", headers)
+			}
+			return nil
+		}
+	}
+	mp.ExpectInputWithMessageCheckerFunctionAndSucceed(check("raw", true))
+	mp.ExpectInputWithMessageCheckerFunctionAndSucceed(check("decoded", true))
+	mp.ExpectInputWithMessageCheckerFunctionAndSucceed(check("decoded", true))
+	mp.ExpectInputWithMessageCheckerFunctionAndSucceed(check("atypical", true))
+	mp.ExpectInputWithMessageCheckerFunctionAndFail(check("parse-error", false), sarama.ErrNotLeaderForPartition)
+
+	mc := &Config{Kafka: kc, Atypical: &AtypicalConfig{Rules: []AtypicalRule{{Tests: []uint32{300}}}}}
+	s := newTestServer(t, WithConfig(mc), WithKafkaProducer(mp))
+
+	data, err := proto.Marshal(testStixReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := postMsg(s, data); code != 200 {
+		t.Fatalf("status %d", code)
+	}
+	if code := postMsg(s, []byte{0xff, 0xff, 0xff}); code != 200 {
+		t.Fatalf("status %d", code)
+	}
+
+	// Shutdown flushes and closes the producer, which checks the expectations
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&s.stats.KafkaSent); n != 4 {
+		t.Errorf("KafkaSent %d", n)
+	}
+	if n := atomic.LoadUint64(&s.stats.ErrKafka); n != 1 {
+		t.Errorf("ErrKafka %d", n)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ListenDefaultReadHeaderTimeout = 10 * time.Second
+	ListenDefaultReadTimeout       = 30 * time.Second
+	ListenDefaultWriteTimeout      = 30 * time.Second
+	ListenDefaultIdleTimeout       = 120 * time.Second
+	TLSDefaultReload               = 60 * time.Second
+
+	unixPrefix = "unix:"
+)
+
+// ListenConfig describes the ingest listener.  It is read once, at Start;
+// only the TLS certificates are picked up again while running.  Address is
+// "host:port" or "unix:/path/to.sock".  Timeouts left at 0 use the
+// defaults; HTTP/2 is offered over TLS unless DisableHTTP2 is set.
+type ListenConfig struct {
+	Address                  string     `json:"address,omitempty"`
+	SocketMode               string     `json:"socketMode,omitempty"` // octal, e.g. "0660"
+	TLS                      *TLSConfig `json:"tls,omitempty"`
+	DisableHTTP2             bool       `json:"disableHTTP2,omitempty"`
+	ReadHeaderTimeoutSeconds int        `json:"readHeaderTimeoutSeconds,omitempty"`
+	ReadTimeoutSeconds       int        `json:"readTimeoutSeconds,omitempty"`
+	WriteTimeoutSeconds      int        `json:"writeTimeoutSeconds,omitempty"`
+	IdleTimeoutSeconds       int        `json:"idleTimeoutSeconds,omitempty"`
+	MaxHeaderBytes           int        `json:"maxHeaderBytes,omitempty"`
+}
+
+// TLSConfig enables TLS.  The certificate, key and client CA files are
+// checked every ReloadSeconds and reloaded when they change.  With
+// ClientCAFile set, ClientAuth picks how client certificates are treated:
+// "require" (the default: a valid certificate is needed), "verify" (checked
+// if presented) or "request" (asked for, not checked).
+type TLSConfig struct {
+	CertFile      string `json:"certFile"`
+	KeyFile       string `json:"keyFile"`
+	ClientCAFile  string `json:"clientCAFile,omitempty"`
+	ClientAuth    string `json:"clientAuth,omitempty"`
+	MinVersion    string `json:"minVersion,omitempty"` // "1.2" (default) or "1.3"
+	ReloadSeconds int    `json:"reloadSeconds,omitempty"`
+}
+
+func tlsClientAuth(tc *TLSConfig) (tls.ClientAuthType, error) {
+	if tc.ClientCAFile == "" {
+		if tc.ClientAuth != "" {
+			return tls.NoClientCert, errors.New("tls: clientAuth requires clientCAFile")
+		}
+		return tls.NoClientCert, nil
+	}
+	switch tc.ClientAuth {
+	case "", "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "verify":
+		return tls.VerifyClientCertIfGiven, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("tls: unknown clientAuth %q", tc.ClientAuth)
+}
+
+func tlsMinVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls: unknown minVersion %q", v)
+}
+
+func listenValidate(lc *ListenConfig) error {
+	if lc.SocketMode != "" {
+		if !strings.HasPrefix(lc.Address, unixPrefix) {
+			return errors.New("listen: socketMode needs a unix address")
+		}
+		if _, err := strconv.ParseUint(lc.SocketMode, 8, 32); err != nil {
+			return fmt.Errorf("listen: bad socketMode %q", lc.SocketMode)
+		}
+	}
+	if lc.ReadHeaderTimeoutSeconds < 0 || lc.ReadTimeoutSeconds < 0 || lc.WriteTimeoutSeconds < 0 ||
+		lc.IdleTimeoutSeconds < 0 || lc.MaxHeaderBytes < 0 {
+		return errors.New("listen: timeouts and maxHeaderBytes cannot be negative")
+	}
+	if tc := lc.TLS; tc != nil {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return errors.New("tls: certFile and keyFile required")
+		}
+		if _, err := tlsClientAuth(tc); err != nil {
+			return err
+		}
+		if _, err := tlsMinVersion(tc.MinVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen opens the listener an address names
+func listen(addr, mode string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	// A socket left behind by an earlier run would fail the bind
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		m, _ := strconv.ParseUint(mode, 8, 32)
+		if err = os.Chmod(path, os.FileMode(m)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func seconds(n int, def time.Duration) time.Duration {
+	if n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return def
+}
+
+// newHTTPServer applies the listener timeouts; lc may be nil
+func (s *Server) newHTTPServer(lc *ListenConfig) *http.Server {
+	if lc == nil {
+		lc = &ListenConfig{}
+	}
+	srv := &http.Server{
+		Handler:           s.mux,
+		ErrorLog:          s.logger,
+		ReadHeaderTimeout: seconds(lc.ReadHeaderTimeoutSeconds, ListenDefaultReadHeaderTimeout),
+		ReadTimeout:       seconds(lc.ReadTimeoutSeconds, ListenDefaultReadTimeout),
+		WriteTimeout:      seconds(lc.WriteTimeoutSeconds, ListenDefaultWriteTimeout),
+		IdleTimeout:       seconds(lc.IdleTimeoutSeconds, ListenDefaultIdleTimeout),
+		MaxHeaderBytes:    lc.MaxHeaderBytes,
+	}
+	if lc.DisableHTTP2 {
+		// A non-nil, empty map turns HTTP/2 off
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return srv
+}
+
+// certReloader serves the current TLS config, rebuilt whenever the files
+// it comes from change
+type certReloader struct {
+	tc         *TLSConfig
+	clientAuth tls.ClientAuthType
+	minVersion uint16
+	nextProtos []string
+
+	mu      sync.Mutex
+	current *tls.Config
+	stamp   string // sizes and mtimes of the files
+}
+
+func newCertReloader(tc *TLSConfig, http2 bool) (*certReloader, error) {
+	r := &certReloader{tc: tc, nextProtos: []string{"http/1.1"}}
+	if http2 {
+		r.nextProtos = []string{"h2", "http/1.1"}
+	}
+	var err error
+	if r.clientAuth, err = tlsClientAuth(tc); err != nil {
+		return nil, err
+	}
+	if r.minVersion, err = tlsMinVersion(tc.MinVersion); err != nil {
+		return nil, err
+	}
+	if _, err = r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) fileStamp() string {
+	var sb strings.Builder
+	for _, name := range []string{r.tc.CertFile, r.tc.KeyFile, r.tc.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&sb, "%d:%d;", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return sb.String()
+}
+
+// reload rebuilds the TLS config if a file changed.  On error the current
+// config stays in use.
+func (r *certReloader) reload() (bool, error) {
+	stamp := r.fileStamp()
+	r.mu.Lock()
+	same := r.current != nil && stamp == r.stamp
+	r.mu.Unlock()
+	if same {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.tc.CertFile, r.tc.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+		MinVersion:   r.minVersion,
+		NextProtos:   r.nextProtos,
+	}
+	if r.tc.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.tc.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return false, errors.New("tls: no certificates in " + r.tc.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.current, r.stamp = c, stamp
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *certReloader) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current, nil
+}
+
+func (s *Server) certWorker(r *certReloader) {
+	tick := time.NewTicker(seconds(r.tc.ReloadSeconds, TLSDefaultReload))
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				s.logger.Println("tls reload:", err)
+				atomic.AddUint64(&s.stats.ErrTLSReload, 1)
+			} else if reloaded {
+				atomic.AddUint64(&s.stats.TLSReload, 1)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// openListener opens the configured listener and builds the HTTP server
+// for it, without serving yet
+func (s *Server) openListener() error {
+	lc := s.loadConfig().Listen
+	addr, mode := s.addr, ""
+	if lc != nil {
+		if !s.addrSet && lc.Address != "" {
+			addr = lc.Address
+		}
+		mode = lc.SocketMode
+	}
+	if addr == "" {
+		return nil
+	}
+
+	srv := s.newHTTPServer(lc)
+	var certs *certReloader
+	if lc != nil && lc.TLS != nil {
+		var err error
+		if certs, err = newCertReloader(lc.TLS, !lc.DisableHTTP2); err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{GetConfigForClient: certs.config, NextProtos: certs.nextProtos}
+	}
+
+	l, err := listen(addr, mode)
+	if err != nil {
+		return err
+	}
+	if srv.TLSConfig != nil {
+		l = tls.NewListener(l, srv.TLSConfig)
+	}
+	s.listener, s.http, s.certs = l, srv, certs
+	return nil
+}
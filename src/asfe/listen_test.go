@@ -0,0 +1,233 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert issues a certificate, self-signed when parent is nil
+func newTestCert(t *testing.T, serial int64, parent *testCert, client bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "asfe test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage, tmpl.ExtKeyUsage = x509.KeyUsageCertSign|x509.KeyUsageDigitalSignature, nil
+	} else {
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (tc *testCert) write(t *testing.T, certFile, keyFile string) {
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	kd, _ := x509.MarshalECPrivateKey(tc.key)
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kd}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tc *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+func newListenServer(t *testing.T, lc *ListenConfig) *Server {
+	s, err := NewServer(WithConfig(&Config{Listen: lc}), WithStorage(newMemStorage(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func TestListenMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, 1, nil, false)
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	newTestCert(t, 2, ca, false).write(t, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+
+	s := newListenServer(t, &ListenConfig{
+		Address: "127.0.0.1:0",
+		TLS: &TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"),
+			ClientCAFile: filepath.Join(dir, "ca.pem")},
+	})
+	url := "https://" + s.Addr().String() + "/metrics"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+
+	resp, err := client(newTestCert(t, 3, ca, true).tlsCert()).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("got %d over %s", resp.StatusCode, resp.Proto)
+	}
+
+	// No client certificate, or one from another CA
+	if resp, err = client().Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("accepted a client without a certificate")
+	}
+	other := newTestCert(t, 4, nil, false)
+	if resp, err = client(newTestCert(t, 5, other, true).tlsCert()).Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("accepted a client certificate from an unknown CA")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, 10, nil, false).write(t, certFile, keyFile)
+
+	r, err := newCertReloader(&TLSConfig{CertFile: certFile, KeyFile: keyFile}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		c, _ := r.config(nil)
+		leaf, _ := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+	if reloaded, err := r.reload(); reloaded || err != nil {
+		t.Errorf("unchanged files: %v %v", reloaded, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	newTestCert(t, 11, nil, false).write(t, certFile, keyFile)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if reloaded, err := r.reload(); !reloaded || err != nil {
+		t.Fatalf("changed files: %v %v", reloaded, err)
+	}
+	if serial() != 11 {
+		t.Errorf("serving serial %d", serial())
+	}
+
+	// A broken certificate keeps the old one in use
+	ioutil.WriteFile(keyFile, []byte("junk"), 0600)
+	if _, err := r.reload(); err == nil {
+		t.Error("loaded a broken key")
+	}
+	if serial() != 11 {
+		t.Errorf("serving serial %d after a failed reload", serial())
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asfe.sock")
+	newListenServer(t, &ListenConfig{Address: "unix:" + path, SocketMode: "0600", ReadTimeoutSeconds: 5})
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v", fi.Mode().Perm())
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://asfe/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d", resp.StatusCode)
+	}
+}
+
+func TestListenValidate(t *testing.T) {
+	bad := []*ListenConfig{
+		{Address: ":5000", SocketMode: "0600"},
+		{Address: "unix:/tmp/x.sock", SocketMode: "rw"},
+		{ReadTimeoutSeconds: -1},
+		{TLS: &TLSConfig{CertFile: "c.pem"}},
+		{TLS: &TLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientAuth: "require"}},
+		{TLS: &TLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem", ClientAuth: "maybe"}},
+		{TLS: &TLSConfig{CertFile: "c.pem", KeyFile: "k.pem", MinVersion: "1.0"}},
+	}
+	for i, lc := range bad {
+		if listenValidate(lc) == nil {
+			t.Errorf("%d: accepted", i)
+		}
+	}
+	ok := &ListenConfig{Address: "unix:/run/asfe.sock", SocketMode: "0660",
+		TLS: &TLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem", ClientAuth: "verify", MinVersion: "1.3"}}
+	if err := listenValidate(ok); err != nil {
+		t.Error(err)
+	}
+}
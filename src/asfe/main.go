@@ -16,25 +16,58 @@
 package asfe
 
 import (
+	"context"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
+// Main runs a server: asfe <source>[,<source>...] [last known good path]
+// Sources are files, file://, http(s)://, s3:// or env: (see
+// NewConfigSource); SIGHUP reloads them.  $ASFE_CONFIG_KEYS names a file of
+// pinned keys config documents must be signed with (see LoadConfigKeys).
 func Main() {
+	if len(os.Args) < 2 {
+		log.Fatal("usage: asfe <source>[,<source>...] [last known good path]")
+	}
 
-	// Fetch the initial config
-	if err := ConfigInit(os.Args[1]); err != nil {
+	// The listen address comes from the config, else DefaultAddr
+	opts := []Option{WithConfigURL(os.Args[1])}
+	if len(os.Args) > 2 {
+		opts = append(opts, WithLastGoodPath(os.Args[2]))
+	}
+	if path := os.Getenv(ConfigKeysEnv); path != "" {
+		keys, err := LoadConfigKeys(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithConfigKeys(keys))
+	}
+	s, err := NewServer(opts...)
+	if err != nil {
 		panic(err)
 	}
+	if err = s.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.Reload()
+		}
+	}()
 
-	// Initialize our sub-modules
-	parseInit()
-	utilsInit()
-	statsInit()
-	opInit()
+	// Stop accepting, finish in-flight requests and drain the queues
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
 
-	// Configure and run our HTTP server
-	http.HandleFunc("/v1/msg", handleMsg)
-	log.Fatal(http.ListenAndServe(":5000", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout())
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
 }
@@ -0,0 +1,219 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Label values for the parse path and store histograms
+const (
+	PathFast     = "fast"
+	PathFallback = "fallback"
+	PathError    = "error"
+
+	StorePrimary   = "primary"
+	StoreSecondary = "secondary"
+)
+
+var (
+	latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072}
+)
+
+// serverMetrics holds a Server's histograms
+type serverMetrics struct {
+	requestDuration *HistogramVec
+	requestSize     *HistogramVec
+	parseDuration   *HistogramVec
+	storeDuration   *HistogramVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requestDuration: newHistogramVec("asfe_request_duration_seconds",
+			"Time to handle a /v1/msg request", "parse", latencyBuckets, PathFast, PathFallback, PathError),
+		requestSize: newHistogramVec("asfe_request_body_bytes",
+			"Request body size", "parse", sizeBuckets, PathFast, PathFallback, PathError),
+		parseDuration: newHistogramVec("asfe_parse_duration_seconds",
+			"Time to parse a report", "parse", latencyBuckets, PathFast, PathFallback, PathError),
+		storeDuration: newHistogramVec("asfe_storage_put_duration_seconds",
+			"Time to put a report to storage", "store", latencyBuckets, StorePrimary, StoreSecondary),
+	}
+}
+
+func (m *serverMetrics) histograms() []*HistogramVec {
+	return []*HistogramVec{m.requestDuration, m.requestSize, m.parseDuration, m.storeDuration}
+}
+
+// Histogram is a lock-free cumulative histogram.
+type Histogram struct {
+	upper  []float64
+	counts []uint64 // one per upper bound, plus +Inf
+	sum    uint64   // float64 bits
+	count  uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.upper) && v > h.upper[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		nv := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, nv) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// HistogramVec is a fixed set of histograms keyed by one label.
+type HistogramVec struct {
+	name   string
+	help   string
+	label  string
+	values []string
+	hists  map[string]*Histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64, values ...string) *HistogramVec {
+	hv := &HistogramVec{name: name, help: help, label: label, values: values,
+		hists: make(map[string]*Histogram)}
+	for _, v := range values {
+		hv.hists[v] = NewHistogram(buckets)
+	}
+	return hv
+}
+
+// With returns the histogram for a label value; values are fixed at creation.
+func (hv *HistogramVec) With(value string) *Histogram {
+	return hv.hists[value]
+}
+
+func writeMetricHeader(b *bytes.Buffer, name, help, typ string) {
+	b.WriteString("# HELP ")
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(help)
+	b.WriteString("\n# TYPE ")
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(typ)
+	b.WriteByte('\n')
+}
+
+func writeFloat(b *bytes.Buffer, v float64) {
+	if math.IsInf(v, 1) {
+		b.WriteString("+Inf")
+		return
+	}
+	b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (hv *HistogramVec) write(b *bytes.Buffer) {
+	writeMetricHeader(b, hv.name, hv.help, "histogram")
+
+	for _, lv := range hv.values {
+		h := hv.hists[lv]
+		var cum uint64
+		for i := range h.counts {
+			cum += atomic.LoadUint64(&h.counts[i])
+			le := math.Inf(1)
+			if i < len(h.upper) {
+				le = h.upper[i]
+			}
+			b.WriteString(hv.name)
+			b.WriteString("_bucket{")
+			b.WriteString(hv.label)
+			b.WriteString("=\"")
+			b.WriteString(lv)
+			b.WriteString("\",le=\"")
+			writeFloat(b, le)
+			b.WriteString("\"} ")
+			b.WriteString(strconv.FormatUint(cum, 10))
+			b.WriteByte('\n')
+		}
+
+		b.WriteString(hv.name)
+		b.WriteString("_sum{")
+		b.WriteString(hv.label)
+		b.WriteString("=\"")
+		b.WriteString(lv)
+		b.WriteString("\"} ")
+		writeFloat(b, math.Float64frombits(atomic.LoadUint64(&h.sum)))
+		b.WriteByte('\n')
+
+		b.WriteString(hv.name)
+		b.WriteString("_count{")
+		b.WriteString(hv.label)
+		b.WriteString("=\"")
+		b.WriteString(lv)
+		b.WriteString("\"} ")
+		b.WriteString(strconv.FormatUint(atomic.LoadUint64(&h.count), 10))
+		b.WriteByte('\n')
+	}
+}
+
+// WriteMetrics renders the server's counters and histograms in the
+// Prometheus text exposition format (version 0.0.4).
+func (s *Server) WriteMetrics(w io.Writer) error {
+	var b bytes.Buffer
+
+	for _, sc := range statCounters {
+		writeMetricHeader(&b, sc.Metric, sc.Help, "counter")
+		b.WriteString(sc.Metric)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatUint(atomic.LoadUint64(sc.Value(s.stats)), 10))
+		b.WriteByte('\n')
+	}
+
+	if s.spool != nil {
+		writeMetricHeader(&b, "asfe_spool_bytes", "Bytes held in the local spool", "gauge")
+		b.WriteString("asfe_spool_bytes ")
+		b.WriteString(strconv.FormatInt(s.spool.Size(), 10))
+		b.WriteByte('\n')
+	}
+
+	for _, hv := range s.metrics.histograms() {
+		hv.write(&b)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.WriteMetrics(w)
+}
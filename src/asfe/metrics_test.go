@@ -0,0 +1,64 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	hv := newHistogramVec("test_seconds", "Test", "parse", []float64{1, 2}, PathFast)
+	hv.With(PathFast).Observe(0.5)
+	hv.With(PathFast).Observe(1.5)
+	hv.With(PathFast).Observe(3)
+
+	var b bytes.Buffer
+	hv.write(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE test_seconds histogram\n",
+		"test_seconds_bucket{parse=\"fast\",le=\"1\"} 1\n",
+		"test_seconds_bucket{parse=\"fast\",le=\"2\"} 2\n",
+		"test_seconds_bucket{parse=\"fast\",le=\"+Inf\"} 3\n",
+		"test_seconds_sum{parse=\"fast\"} 5\n",
+		"test_seconds_count{parse=\"fast\"} 3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := newTestServer(t)
+	var b bytes.Buffer
+	if err := s.WriteMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+
+	for _, sc := range statCounters {
+		if !strings.Contains(out, "# TYPE "+sc.Metric+" counter\n") {
+			t.Errorf("counter %s not exported", sc.Metric)
+		}
+	}
+	if !strings.Contains(out, "asfe_storage_put_duration_seconds_count{store=\"secondary\"}") {
+		t.Error("store histogram not exported")
+	}
+}
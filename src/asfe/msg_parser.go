@@ -18,14 +18,12 @@ package asfe
 import (
 	//"log"
 	"errors"
-	"sync/atomic"
 
 	"github.com/golang/protobuf/proto"
 )
 
 var (
 	MsgParseError error = errors.New("Message parse error")
-	AtypicalMap   [512]byte
 )
 
 type ParsedInfo struct {
@@ -35,69 +33,80 @@ type ParsedInfo struct {
 	SysType  uint32
 	Atypical bool
 	Fdc      bool
+	Fallback bool
 }
 
-func parseInit() {
-	AtypicalMap[250] = 1
-	AtypicalMap[251] = 1
-	AtypicalMap[252] = 1
-	AtypicalMap[253] = 1
-	AtypicalMap[254] = 1
-	AtypicalMap[255] = 1
-
-	AtypicalMap[300] = 1
-	AtypicalMap[302] = 1
-	AtypicalMap[305] = 1
-	AtypicalMap[306] = 1
-	AtypicalMap[307] = 1
-	AtypicalMap[308] = 1
-	AtypicalMap[309] = 1
-	AtypicalMap[310] = 1
-	AtypicalMap[311] = 1
-	AtypicalMap[312] = 1
-	AtypicalMap[313] = 1
-	AtypicalMap[314] = 1
-	AtypicalMap[315] = 1
-	AtypicalMap[317] = 1
-	AtypicalMap[318] = 1
-
-	AtypicalMap[400] = 1
-	AtypicalMap[401] = 1
-	AtypicalMap[402] = 1
-	AtypicalMap[403] = 1
-	AtypicalMap[405] = 1
-	AtypicalMap[406] = 1
-	AtypicalMap[409] = 1
-	AtypicalMap[410] = 1
-	AtypicalMap[411] = 1
-	AtypicalMap[412] = 1
-	AtypicalMap[413] = 1
-	AtypicalMap[414] = 1
-	AtypicalMap[416] = 1
-	AtypicalMap[417] = 1
-	AtypicalMap[418] = 1
-
-	AtypicalMap[500] = 1
-	AtypicalMap[501] = 1
-	AtypicalMap[502] = 1
-	AtypicalMap[503] = 1
-	AtypicalMap[504] = 1
-	AtypicalMap[505] = 1
-
-}
-
-func processTest(test uint32, pi *ParsedInfo) {
-	//log.Println("Test: ", test);
-	if test == 99 {
+func processSighting(si *sightingInfo, rules []atypicalRule, pi *ParsedInfo) {
+	//log.Println("Test: ", si.test);
+	if si.test == 99 {
 		pi.Fdc = true
-	} else if test < 250 || test > 512 {
-		return
-	} else if AtypicalMap[test] > 0 {
+	} else if !pi.Atypical && matchAtypical(rules, si, pi.SysType) {
 		pi.Atypical = true
 	}
 }
 
+// parseSightingDetail walks the (sub) tags of one encoded Sighting for the
+// fields the atypical rules can look at.  Returns false if the encoding is
+// not something we want to handle here.
+func parseSightingDetail(data []byte, si *sightingInfo) bool {
+	var offset, L uint32 = 0, uint32(len(data))
+
+	varint := func() (uint32, bool) {
+		var v uint32
+		for shift := uint(0); shift < 35; shift += 7 {
+			if offset >= L {
+				return 0, false
+			}
+			b := data[offset]
+			offset++
+			v |= uint32(b&0x7f) << shift
+			if b < 0x80 {
+				return v, true
+			}
+		}
+		return 0, false
+	}
+
+	for offset < L {
+		tag, ok := varint()
+		if !ok {
+			return false
+		}
+		switch tag & 7 {
+		case 0: // varint
+			v, ok := varint()
+			if !ok {
+				return false
+			}
+			switch tag >> 3 {
+			case 1:
+				si.sightingType = v
+			case 3:
+				si.confidence = v
+			case 4:
+				si.impact = v
+			case 6:
+				si.test = v
+			}
+		case 2: // length delimited (datas)
+			l, ok := varint()
+			if !ok || L-offset < l {
+				return false
+			}
+			offset += l
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseMsg parses a report against the default atypical rules
 func parseMsg(data []byte) (*ParsedInfo, error) {
+	return parseMsgRules(data, defaultAtypical)
+}
+
+func parseMsgRules(data []byte, ar *atypicalRules) (*ParsedInfo, error) {
 
 	// Addition Security uses a hand-crafted, deterministic protobuf encoder.  So we will
 	// first parse against that encoder, since it *should* be the only thing we encounter.
@@ -155,6 +164,7 @@ func parseMsg(data []byte) (*ParsedInfo, error) {
 
 		// Walk the Sightings (tag=8, variable length)
 		var slen, test, end uint32
+		rules := ar.forApp(pi.OrgId, pi.AppId)
 		for L > offset && data[offset] == 0x42 { // Sightings tag
 			offset++
 
@@ -193,7 +203,11 @@ func parseMsg(data []byte) (*ParsedInfo, error) {
 			}
 			//offset++
 
-			processTest(test, pi)
+			si := sightingInfo{test: test}
+			if ar.detail && !parseSightingDetail(data[end-slen:end], &si) {
+				goto fallback
+			}
+			processSighting(&si, rules, pi)
 
 			offset = end
 		}
@@ -206,7 +220,7 @@ func parseMsg(data []byte) (*ParsedInfo, error) {
 	}
 
 fallback:
-	atomic.AddUint64(&StatParseFallback, 1)
+	pi.Fallback = true
 
 	rep := &Report{}
 	err := proto.Unmarshal(data, rep)
@@ -225,8 +239,15 @@ fallback:
 
 	sightings := rep.GetSightings()
 	if sightings != nil {
+		rules := ar.forApp(pi.OrgId, pi.AppId)
 		for _, s := range sightings {
-			processTest(s.GetTestId(), pi)
+			si := sightingInfo{
+				test:         s.GetTestId(),
+				sightingType: s.GetSightingType(),
+				confidence:   s.GetConfidence(),
+				impact:       s.GetImpact(),
+			}
+			processSighting(&si, rules, pi)
 		}
 	}
 
@@ -19,10 +19,11 @@ import (
 	"io/ioutil"
 	"log"
 	"testing"
+	"time"
 )
 
 func TestMsgParserSlowPath(t *testing.T) {
-	utilsInit()
+	kg := newKeyGen(time.Now)
 	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
 	if err != nil {
 		panic(err)
@@ -33,7 +34,7 @@ func TestMsgParserSlowPath(t *testing.T) {
 		t.Fail()
 	}
 
-	key, err := createStorageKey(data, pi)
+	key, err := kg.createStorageKey(defaultKeyTemplate, data, pi)
 	if err != nil {
 		t.Fail()
 	}
@@ -53,7 +54,7 @@ func BenchmarkMsgParserSlowPath(b *testing.B) {
 }
 
 func TestMsgParserFastPath(t *testing.T) {
-	utilsInit()
+	kg := newKeyGen(time.Now)
 	data, err := ioutil.ReadFile("testdata/test_msg_fp.bin")
 	if err != nil {
 		panic(err)
@@ -64,7 +65,7 @@ func TestMsgParserFastPath(t *testing.T) {
 		t.Fail()
 	}
 
-	key, err := createStorageKey(data, pi)
+	key, err := kg.createStorageKey(defaultKeyTemplate, data, pi)
 	if err != nil {
 		t.Fail()
 	}
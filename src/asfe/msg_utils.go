@@ -17,62 +17,63 @@ package asfe
 
 import (
 	"encoding/binary"
-	"encoding/hex"
 	"sync/atomic"
 	"time"
-	//"github.com/minio/blake2b-simd"
-)
 
-var (
-	ctr uint64 = 1
-	ts  []byte
+	"golang.org/x/crypto/blake2b"
 )
 
-func utilsInit() {
-
-	ts = []byte(time.Now().Format(time.RFC3339)[0:19] + "_")
+const (
+	reportDigestSize = 16
+)
 
-	go func() {
-		for _ = range time.Tick(time.Duration(1) * time.Second) {
-			ts = []byte(time.Now().Format(time.RFC3339)[0:19] + "_")
-		}
-	}()
+// keyGen creates storage keys; the timestamp component is cached per second
+type keyGen struct {
+	now func() time.Time
+	ctr uint64
+	ts  atomic.Value // *keyTime
 }
 
-func createStorageKey(data []byte, pi *ParsedInfo) (string, error) {
-
-	digest := make([]byte, 12)
-	l := binary.PutUvarint(digest, atomic.AddUint64(&ctr, 1))
-	digest = digest[0:l]
-
-	// Allocate an output buffer
-	// "/" + org + "/" + app "_" + type + "/" + sys + "/" + ts + digest
-	out := make([]byte, (1 + 64 + 1 + len(pi.AppId) + 2 + 1 + 64 + 1 + len(ts) + (len(digest) * 2)))
+type keyTime struct {
+	sec int64
+	ts  []byte // 2006-01-02T15:04:05
+}
 
-	// Piece together our values
-	out[0] = '/'
-	hex.Encode(out[1:], pi.OrgId)
+func newKeyGen(now func() time.Time) *keyGen {
+	return &keyGen{now: now, ctr: 1}
+}
 
-	out[65] = '/'
-	copy(out[66:], pi.AppId)
+func (kg *keyGen) timestamp() *keyTime {
+	t := kg.now()
+	if kt, ok := kg.ts.Load().(*keyTime); ok && kt.sec == t.Unix() {
+		return kt
+	}
+	kt := &keyTime{sec: t.Unix(), ts: []byte(t.Format(time.RFC3339)[0:19])}
+	kg.ts.Store(kt)
+	return kt
+}
 
-	off := 66 + len(pi.AppId)
-	out[off] = '_'
-	off++
-	out[off] = byte(0x40 + pi.SysType)
-	off++
+// reportDigest is a truncated blake2b-256 of the report body
+func reportDigest(data []byte) []byte {
+	sum := blake2b.Sum256(data)
+	return sum[:reportDigestSize]
+}
 
-	out[off] = '/'
-	off++
-	hex.Encode(out[off:], pi.SysId)
-	off += 64
+func (kg *keyGen) createStorageKey(t *keyTemplate, data []byte, pi *ParsedInfo) (string, error) {
+	v := keyVars{pi: pi, data: data, kt: kg.timestamp()}
 
-	out[off] = '/'
-	off++
-	copy(out[off:], ts)
-	off += len(ts)
+	if t.hasSeq {
+		var seq [binary.MaxVarintLen64]byte
+		l := binary.PutUvarint(seq[:], atomic.AddUint64(&kg.ctr, 1))
+		v.seq = seq[0:l]
+	}
 
-	hex.Encode(out[off:], digest)
+	return t.render(&v), nil
+}
 
-	return string(out), nil
+// createPartition renders a partition template, which has no per-report
+// unique values
+func (kg *keyGen) createPartition(t *keyTemplate, pi *ParsedInfo) string {
+	v := keyVars{pi: pi, kt: kg.timestamp()}
+	return t.render(&v)
 }
@@ -19,10 +19,11 @@ import (
 	//"log"
 	"io/ioutil"
 	"testing"
+	"time"
 )
 
 func BenchmarkCreateStorageKey(b *testing.B) {
-	utilsInit()
+	kg := newKeyGen(time.Now)
 	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
 	if err != nil {
 		panic(err)
@@ -34,6 +35,6 @@ func BenchmarkCreateStorageKey(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		createStorageKey(data, pi)
+		kg.createStorageKey(defaultKeyTemplate, data, pi)
 	}
 }
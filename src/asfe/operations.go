@@ -15,134 +15,366 @@
 package asfe
 
 import (
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"io"
 	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const (
 	QUEUE_SIZE_PARSEERROR = 1000
 	QUEUE_SIZE_ATYPICAL   = 1000
+	QUEUE_SIZE_EXPORT     = 1000
+
+	ExportDecodedSuffix = ".json"
 )
 
 var (
-	sess = session.Must(session.NewSession())
-	cfg  = aws.NewConfig().WithMaxRetries(2)
-
 	NotConfiguredError = errors.New("Not configured")
-
-	chanParseError = make(chan []byte, QUEUE_SIZE_PARSEERROR)
-	chanAtypical   = make(chan []byte, QUEUE_SIZE_ATYPICAL)
 )
 
-func opInit() {
+// Queue is a destination for reports that need further handling (parse
+// errors, atypical reports).  Send must be safe for concurrent use.
+type Queue interface {
+	Send(data []byte) error
+}
+
+type sqsQueue struct {
+	client *sqs.SQS
+	url    string
+}
+
+// newSQSQueue builds a queue from the positional [region, url] config form
+func newSQSQueue(q []string) (Queue, error) {
+	if len(q) < 2 {
+		return nil, errors.New("queue requires [region, url]")
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &sqsQueue{
+		client: sqs.New(sess, aws.NewConfig().WithMaxRetries(2).WithRegion(q[0])),
+		url:    q[1],
+	}, nil
+}
 
-	go func() {
-		for data := range chanParseError {
-			_opQueueParseError(data)
+func (q *sqsQueue) Send(data []byte) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.url),
+		MessageBody: aws.String(base64.StdEncoding.EncodeToString(data)),
+	}
+	_, err := q.client.SendMessage(input)
+	return err
+}
+
+func (s *Server) opInit() error {
+
+	// The spool is a local resource, so it is taken from the initial config only
+	mc := s.loadConfig()
+	if mc.Spool != nil {
+		sp, err := OpenSpool(mc.Spool.Path, mc.Spool.MaxBytes)
+		if err != nil {
+			return err
 		}
-	}()
+		s.spool = sp
+	}
+	if mc.Shutdown != nil && mc.Shutdown.DrainPath != "" {
+		dr, err := OpenSpool(mc.Shutdown.DrainPath, 0)
+		if err != nil {
+			return err
+		}
+		s.drain = dr
+	}
+	if mc.Dedupe != nil {
+		ss, err := openSeenSet(mc.Dedupe, s.now())
+		if err != nil {
+			return err
+		}
+		s.seen = ss
+	}
 
-	go func() {
-		for data := range chanAtypical {
-			_opQueueAtypical(data)
+	// Batching mode, like the spool, is fixed at start
+	if mc.Batch != nil {
+		bw, err := newBatchWriter(s, mc.Batch, mc.Listen)
+		if err != nil {
+			return err
+		}
+		if err = bw.recover(); err != nil {
+			return err
 		}
-	}()
+		s.batch = bw
+	}
+	if mc.Parquet != nil {
+		pw, err := newParquetWriter(s, mc.Parquet)
+		if err != nil {
+			return err
+		}
+		s.parquet = pw
+	}
+	return nil
+}
+
+// opStart launches the background workers
+func (s *Server) opStart() {
+	mc := s.loadConfig()
+	if s.spool != nil {
+		interval := SpoolDefaultReplay
+		if mc.Spool != nil && mc.Spool.ReplaySeconds > 0 {
+			interval = time.Duration(mc.Spool.ReplaySeconds) * time.Second
+		}
+		s.goWorker(func() { s.spoolReplayer(interval) })
+	}
+	if s.drain != nil && s.drain.Size() > 0 {
+		s.goWorker(s.drainReplay)
+	}
+	if s.batch != nil {
+		s.goWorker(func() { s.batch.worker(s.done) })
+	}
+	if s.parquet != nil {
+		s.goWorker(s.parquetWorker)
+	}
+
+	s.goWorker(func() {
+		for {
+			select {
+			case data := <-s.chanParseError:
+				s._opQueueParseError(data)
+			case <-s.done:
+				return
+			}
+		}
+	})
+
+	s.goWorker(func() {
+		for {
+			select {
+			case data := <-s.chanAtypical:
+				s._opQueueAtypical(data)
+			case <-s.done:
+				return
+			}
+		}
+	})
+
+	s.goWorker(func() {
+		for {
+			select {
+			case item := <-s.chanRoute:
+				s._opQueueRoute(item)
+			case <-s.done:
+				return
+			}
+		}
+	})
+
+	s.goWorker(func() {
+		for {
+			select {
+			case item := <-s.chanExport:
+				s._opExportDecoded(item)
+			case <-s.done:
+				return
+			}
+		}
+	})
+
+	s.goWorker(s.splunkWorker)
+	s.goWorker(s.syslogWorker)
+	s.goWorker(s.taxiiWorker)
+	s.goWorker(s.kafkaWorker)
 }
 
-func _opQueueParseError(data []byte) {
-	mc := (*Config)(atomic.LoadPointer(&MainConfig))
-	if mc.QueueParseError == nil {
+func (s *Server) _opQueueParseError(data []byte) {
+	mc := s.loadConfig()
+	if mc.queueParseError == nil {
 		return
 	}
-	sqsc := sqs.New(sess, cfg.WithRegion(mc.QueueParseError[0]))
+	if err := mc.queueParseError.Send(data); err != nil {
+		atomic.AddUint64(&s.stats.ErrQueueParseError, 1)
+	}
+}
 
-	input := &sqs.SendMessageInput{
-		QueueUrl:    aws.String(mc.QueueParseError[1]),
-		MessageBody: aws.String(base64.StdEncoding.EncodeToString(data)),
+func (s *Server) opQueueParseError(data []byte) {
+	// The body may live in a pool buffer, so take a copy
+	data = append([]byte(nil), data...)
+
+	select {
+	case s.chanParseError <- data:
+		// No op, it was submitted to the channel
+	default:
+		// Channel is full, so handle synchronously
+		atomic.AddUint64(&s.stats.QueueFullParseError, 1)
+		s._opQueueParseError(data)
 	}
+}
 
-	if _, err := sqsc.SendMessage(input); err != nil {
-		atomic.AddUint64(&StatErrQueueParseError, 1)
+func (s *Server) _opQueueAtypical(data []byte) {
+	mc := s.loadConfig()
+	if mc.queueAtypical == nil {
+		return
+	}
+	if err := mc.queueAtypical.Send(data); err != nil {
+		atomic.AddUint64(&s.stats.ErrQueueAtypical, 1)
 	}
 }
 
-func opQueueParseError(data []byte) {
+func (s *Server) opQueueAtypical(data []byte) {
+	// The body may live in a pool buffer, so take a copy
+	data = append([]byte(nil), data...)
+
 	select {
-	case chanParseError <- data:
+	case s.chanAtypical <- data:
 		// No op, it was submitted to the channel
 	default:
 		// Channel is full, so handle synchronously
-		atomic.AddUint64(&StatQueueFullParseError, 1)
-		_opQueueParseError(data)
+		atomic.AddUint64(&s.stats.QueueFullAtypical, 1)
+		s._opQueueAtypical(data)
 	}
 }
 
-func _opQueueAtypical(data []byte) {
-	mc := (*Config)(atomic.LoadPointer(&MainConfig))
-	if mc.QueueAtypical == nil {
+type exportItem struct {
+	key  string
+	data []byte
+}
+
+func (s *Server) _opExportDecoded(item exportItem) {
+	events, err := DecodeEvents(item.data)
+	if err != nil {
+		atomic.AddUint64(&s.stats.ErrExport, 1)
+		return
+	}
+	if len(events) == 0 {
 		return
 	}
-	sqsc := sqs.New(sess, cfg.WithRegion(mc.QueueAtypical[0]))
 
-	input := &sqs.SendMessageInput{
-		QueueUrl:    aws.String(mc.QueueAtypical[1]),
-		MessageBody: aws.String(base64.StdEncoding.EncodeToString(data)),
+	var buffer bytes.Buffer
+	if err = WriteEventsJSON(&buffer, events); err != nil {
+		atomic.AddUint64(&s.stats.ErrExport, 1)
+		return
 	}
 
-	if _, err := sqsc.SendMessage(input); err != nil {
-		atomic.AddUint64(&StatErrQueueAtypical, 1)
+	rdr := bytes.NewReader(buffer.Bytes())
+	key := item.key + ExportDecodedSuffix
+	if err = s.opStorePrimary(rdr, key); err != nil {
+		if err = s.opStoreSecondary(rdr, key); err != nil {
+			atomic.AddUint64(&s.stats.ErrExport, 1)
+			return
+		}
 	}
+	atomic.AddUint64(&s.stats.Exported, 1)
 }
 
-func opQueueAtypical(data []byte) {
+// opExportDecoded stores the normalized JSON events of a report next to the
+// raw object, if enabled in config
+func (s *Server) opExportDecoded(data []byte, key string) {
+	mc := s.loadConfig()
+	if !mc.ExportDecoded {
+		return
+	}
+
+	// The body may live in a pool buffer, so take a copy
+	item := exportItem{key: key, data: append([]byte(nil), data...)}
+
 	select {
-	case chanAtypical <- data:
+	case s.chanExport <- item:
 		// No op, it was submitted to the channel
 	default:
 		// Channel is full, so handle synchronously
-		atomic.AddUint64(&StatQueueFullAtypical, 1)
-		_opQueueAtypical(data)
+		atomic.AddUint64(&s.stats.QueueFullExport, 1)
+		s._opExportDecoded(item)
 	}
 }
 
-func opStorePrimary(r io.ReadSeeker, key string) error {
-	// TODO: move this into a ticker:
-	mc := (*Config)(atomic.LoadPointer(&MainConfig))
-	s3c := s3.New(sess, cfg.WithRegion(mc.StoragePrimary[0]))
+func (s *Server) opStorePrimary(r io.ReadSeeker, key string) error {
+	mc := s.loadConfig()
+	defer s.metrics.storeDuration.With(StorePrimary).ObserveSince(time.Now())
+	return mc.primary.Put(key, r)
+}
 
-	r.Seek(0, 0)
-	inp := &s3.PutObjectInput{
-		Body:   r,
-		Bucket: aws.String(mc.StoragePrimary[1]),
-		Key:    aws.String(key),
+func (s *Server) opStoreSecondary(r io.ReadSeeker, key string) error {
+	mc := s.loadConfig()
+	if mc.secondary == nil {
+		return NotConfiguredError
 	}
+	defer s.metrics.storeDuration.With(StoreSecondary).ObserveSince(time.Now())
+	return mc.secondary.Put(key, r)
+}
 
-	_, err := s3c.PutObject(inp)
-	return err
+// opStore writes a report to primary storage, else secondary, else parks
+// it in the local spool, which is replayed into storage once a backend
+// comes back
+func (s *Server) opStore(data []byte, key string) error {
+	rdr := bytes.NewReader(data)
+
+	if err := s.opStorePrimary(rdr, key); err == nil {
+		atomic.AddUint64(&s.stats.StoredPrimary, 1)
+		return nil
+	}
+	if err := s.opStoreSecondary(rdr, key); err == nil {
+		atomic.AddUint64(&s.stats.StoredSecondary, 1)
+		return nil
+	}
+	if err := s.opSpool(data, key); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.stats.Spooled, 1)
+	return nil
+}
+
+// opPutObject stores a derived object (batch, export file) through the same
+// primary, secondary, spool chain as reports.  Objects too large for the
+// spool fail with SpoolTooLargeError; the caller keeps them to retry.
+func (s *Server) opPutObject(data []byte, key string) error {
+	rdr := bytes.NewReader(data)
+	if err := s.opStorePrimary(rdr, key); err == nil {
+		return nil
+	}
+	if err := s.opStoreSecondary(rdr, key); err == nil {
+		return nil
+	}
+	return s.opSpool(data, key)
 }
 
-func opStoreSecondary(r io.ReadSeeker, key string) error {
-	// TODO: move this into a ticker:
-	mc := (*Config)(atomic.LoadPointer(&MainConfig))
-	if mc.StorageSecondary == nil {
+func (s *Server) opSpool(data []byte, key string) error {
+	if s.spool == nil {
 		return NotConfiguredError
 	}
-	s3c := s3.New(sess, cfg.WithRegion(mc.StorageSecondary[0]))
+	return s.spool.Append(key, data)
+}
 
-	r.Seek(0, 0)
-	inp := &s3.PutObjectInput{
-		Body:   r,
-		Bucket: aws.String(mc.StorageSecondary[1]),
-		Key:    aws.String(key),
+func (s *Server) opStoreReplay(key string, r io.ReadSeeker) error {
+	if err := s.opStorePrimary(r, key); err != nil {
+		if err = s.opStoreSecondary(r, key); err != nil {
+			return err
+		}
 	}
+	atomic.AddUint64(&s.stats.SpoolReplayed, 1)
+	return nil
+}
 
-	_, err := s3c.PutObject(inp)
-	return err
+func (s *Server) spoolReplayer(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-s.done:
+			return
+		}
+
+		if s.spool.Size() == 0 {
+			continue
+		}
+		if _, err := s.spool.Replay(s.opStoreReplay); err != nil {
+			atomic.AddUint64(&s.stats.ErrSpoolReplay, 1)
+		}
+	}
 }
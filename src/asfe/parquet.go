@@ -0,0 +1,374 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+const (
+	QUEUE_SIZE_PARQUET = 1000
+
+	ParquetDefaultPartition = "/parquet/dt={yyyy}-{mm}-{dd}/org={org}"
+	ParquetDefaultRotate    = 5 * time.Minute
+	ParquetDefaultMaxRows   = 100000
+	ParquetSuffix           = ".parquet"
+	parquetTick             = 1 * time.Second
+)
+
+// ParquetConfig enables the Parquet export.  Rows are buffered per
+// partition and written as one file every RotateSeconds, or sooner at
+// MaxRows.  Compression is snappy (default), zstd, gzip or none.
+type ParquetConfig struct {
+	Partition     string `json:"partition,omitempty"`
+	RotateSeconds int    `json:"rotateSeconds,omitempty"`
+	MaxRows       int    `json:"maxRows,omitempty"`
+	Compression   string `json:"compression,omitempty"`
+}
+
+// SightingRow is the Parquet schema: one row per ObservationData, or one
+// row with null data_* columns for a sighting without data.  report_id (the
+// body digest) and sighting_index tie rows of a report and sighting back
+// together.  Enum columns carry both the numeric id and its name; data_value
+// is normalized as in the JSON export, with data_encoding "hex" or "base64"
+// when the value is not text.
+type SightingRow struct {
+	ReportId          string  `parquet:"report_id"`
+	ReceivedAt        int64   `parquet:"received_at,timestamp(millisecond)"`
+	OrganizationId    string  `parquet:"organization_id"`
+	SystemId          string  `parquet:"system_id"`
+	SystemIdSecondary *string `parquet:"system_id_secondary"`
+	SystemTypeId      int32   `parquet:"system_type_id"`
+	SystemType        string  `parquet:"system_type"`
+	ApplicationId     string  `parquet:"application_id"`
+	UserId            *string `parquet:"user_id"`
+	UserIdSecondary   *string `parquet:"user_id_secondary"`
+
+	SightingIndex  int32  `parquet:"sighting_index"`
+	SightingTypeId int32  `parquet:"sighting_type_id"`
+	SightingType   string `parquet:"sighting_type"`
+	ConfidenceId   int32  `parquet:"confidence_id"`
+	Confidence     string `parquet:"confidence"`
+	ImpactId       int32  `parquet:"impact_id"`
+	Impact         string `parquet:"impact"`
+	TestId         int32  `parquet:"test_id"`
+	TestSubId      int32  `parquet:"test_sub_id"`
+	SightingTime   *int64 `parquet:"sighting_time,timestamp(millisecond)"`
+
+	DataIndex    *int32  `parquet:"data_index"`
+	DataTypeId   *int32  `parquet:"data_type_id"`
+	DataType     *string `parquet:"data_type"`
+	DataValue    *string `parquet:"data_value"`
+	DataEncoding *string `parquet:"data_encoding"`
+	DataNum      *int32  `parquet:"data_num"`
+}
+
+func optString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// FlattenReport turns a report into Parquet rows
+func FlattenReport(rep *Report, reportId string, received time.Time) []SightingRow {
+	events := NormalizeReport(rep)
+	rows := make([]SightingRow, 0, len(events))
+
+	for i, ev := range events {
+		row := SightingRow{
+			ReportId:          reportId,
+			ReceivedAt:        received.UnixNano() / int64(time.Millisecond),
+			OrganizationId:    ev.OrganizationId,
+			SystemId:          ev.SystemId,
+			SystemIdSecondary: optString(ev.SystemIdSecondary),
+			SystemTypeId:      int32(ev.SystemTypeId),
+			SystemType:        ev.SystemType,
+			ApplicationId:     ev.ApplicationId,
+			UserId:            optString(ev.UserId),
+			UserIdSecondary:   optString(ev.UserIdSecondary),
+			SightingIndex:     int32(i),
+			SightingTypeId:    int32(ev.SightingTypeId),
+			SightingType:      ev.SightingType,
+			ConfidenceId:      int32(ev.ConfidenceId),
+			Confidence:        ev.Confidence,
+			ImpactId:          int32(ev.ImpactId),
+			Impact:            ev.Impact,
+			TestId:            int32(ev.TestId),
+			TestSubId:         int32(ev.TestSubId),
+		}
+		if ev.Time != nil {
+			ms := ev.Time.UnixNano() / int64(time.Millisecond)
+			row.SightingTime = &ms
+		}
+
+		if len(ev.Data) == 0 {
+			rows = append(rows, row)
+			continue
+		}
+		for j, ed := range ev.Data {
+			r := row
+			idx, typeId := int32(j), int32(ed.TypeId)
+			r.DataIndex, r.DataTypeId = &idx, &typeId
+			r.DataType = optString(ed.Type)
+			r.DataValue = optString(ed.Value)
+			r.DataEncoding = optString(ed.Encoding)
+			if ed.Num != nil {
+				num := int32(*ed.Num)
+				r.DataNum = &num
+			}
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+func parquetCodec(name string) (compress.Codec, error) {
+	switch name {
+	case "", "snappy":
+		return &parquet.Snappy, nil
+	case "zstd":
+		return &parquet.Zstd, nil
+	case "gzip":
+		return &parquet.Gzip, nil
+	case "none":
+		return &parquet.Uncompressed, nil
+	}
+	return nil, fmt.Errorf("parquet: unknown compression %q", name)
+}
+
+func parquetValidate(pc *ParquetConfig) error {
+	if _, err := parquetCodec(pc.Compression); err != nil {
+		return err
+	}
+	partition := pc.Partition
+	if partition == "" {
+		partition = ParquetDefaultPartition
+	}
+	_, err := compilePartitionTemplate(partition)
+	return err
+}
+
+// ParquetManifest lists the files this process wrote to a partition.  It is
+// rewritten at <partition>/_manifest-<instance>.json after every file, so
+// each writer instance owns its own manifest.  Once the partition's time
+// (e.g. its day) has passed, the manifest is rewritten a last time, Closed.
+type ParquetManifest struct {
+	Partition string                `json:"partition"`
+	Instance  string                `json:"instance"`
+	Updated   time.Time             `json:"updated"`
+	Closed    bool                  `json:"closed,omitempty"`
+	Files     []ParquetManifestFile `json:"files"`
+}
+
+type ParquetManifestFile struct {
+	Key     string    `json:"key"`
+	Rows    int       `json:"rows"`
+	Bytes   int       `json:"bytes"`
+	Created time.Time `json:"created"`
+}
+
+type parquetPartition struct {
+	pi       *ParsedInfo // of the first report, to tell when the partition's time is over
+	rows     []SightingRow
+	opened   time.Time
+	manifest ParquetManifest
+}
+
+type parquetWriter struct {
+	s         *Server
+	partition *keyTemplate
+	codec     compress.Codec
+	rotate    time.Duration
+	maxRows   int
+	instance  string
+	seq       uint64
+
+	// Owned by the worker goroutine
+	partitions map[string]*parquetPartition
+}
+
+func newParquetWriter(s *Server, pc *ParquetConfig) (*parquetWriter, error) {
+	if err := parquetValidate(pc); err != nil {
+		return nil, err
+	}
+
+	w := &parquetWriter{
+		s:          s,
+		rotate:     ParquetDefaultRotate,
+		maxRows:    ParquetDefaultMaxRows,
+		partitions: make(map[string]*parquetPartition),
+	}
+	partition := pc.Partition
+	if partition == "" {
+		partition = ParquetDefaultPartition
+	}
+	w.partition, _ = compilePartitionTemplate(partition)
+	w.codec, _ = parquetCodec(pc.Compression)
+	if pc.RotateSeconds > 0 {
+		w.rotate = time.Duration(pc.RotateSeconds) * time.Second
+	}
+	if pc.MaxRows > 0 {
+		w.maxRows = pc.MaxRows
+	}
+
+	var id [6]byte
+	rand.Read(id[:])
+	w.instance = hex.EncodeToString(id[:])
+	return w, nil
+}
+
+func (w *parquetWriter) add(partition string, pi *ParsedInfo, rows []SightingRow) {
+	p := w.partitions[partition]
+	if p == nil {
+		p = &parquetPartition{pi: pi, manifest: ParquetManifest{Partition: partition, Instance: w.instance}}
+		w.partitions[partition] = p
+	}
+	if len(p.rows) == 0 {
+		p.opened = w.s.now()
+	}
+	p.rows = append(p.rows, rows...)
+	if len(p.rows) >= w.maxRows {
+		w.write(partition, p)
+	}
+}
+
+// write stores a partition's rows as one file and updates its manifest.
+// Rows that cannot be stored are dropped, as the report itself was stored.
+func (w *parquetWriter) write(partition string, p *parquetPartition) {
+	rows := p.rows
+	p.rows = nil
+
+	var buf bytes.Buffer
+	pw := parquet.NewGenericWriter[SightingRow](&buf, parquet.Compression(w.codec))
+	_, err := pw.Write(rows)
+	if err == nil {
+		err = pw.Close()
+	}
+	if err != nil {
+		atomic.AddUint64(&w.s.stats.ErrParquet, 1)
+		return
+	}
+
+	seq := atomic.AddUint64(&w.seq, 1)
+	key := fmt.Sprintf("%s/%s_%s_%x%s", partition, w.s.keys.timestamp().ts, w.instance, seq, ParquetSuffix)
+	if err = w.s.opPutObject(buf.Bytes(), key); err != nil {
+		atomic.AddUint64(&w.s.stats.ErrParquet, 1)
+		return
+	}
+	atomic.AddUint64(&w.s.stats.ParquetFiles, 1)
+	atomic.AddUint64(&w.s.stats.ParquetRows, uint64(len(rows)))
+
+	p.manifest.Files = append(p.manifest.Files, ParquetManifestFile{Key: key, Rows: len(rows), Bytes: buf.Len(),
+		Created: w.s.now().UTC()})
+	w.putManifest(partition, p)
+}
+
+func (w *parquetWriter) putManifest(partition string, p *parquetPartition) {
+	p.manifest.Updated = w.s.now().UTC()
+	data, _ := json.Marshal(&p.manifest)
+	if err := w.s.opPutObject(data, fmt.Sprintf("%s/_manifest-%s.json", partition, w.instance)); err != nil {
+		atomic.AddUint64(&w.s.stats.ErrParquet, 1)
+	}
+}
+
+// rotateDue writes partitions whose rows are older than the rotation
+// interval; all writes every partition with rows.  Partitions no new
+// report can land in any more are written, closed and forgotten.
+func (w *parquetWriter) rotateDue(all bool) {
+	now := w.s.now()
+	for partition, p := range w.partitions {
+		over := w.s.keys.createPartition(w.partition, p.pi) != partition
+		if len(p.rows) > 0 && (all || over || now.Sub(p.opened) >= w.rotate) {
+			w.write(partition, p)
+		}
+		if over {
+			p.manifest.Closed = true
+			w.putManifest(partition, p)
+			delete(w.partitions, partition)
+		}
+	}
+}
+
+func (w *parquetWriter) addReport(data []byte) {
+	rep, err := DecodeReport(data)
+	if err != nil {
+		atomic.AddUint64(&w.s.stats.ErrParquet, 1)
+		return
+	}
+	pi := &ParsedInfo{OrgId: rep.GetOrganizationId(), SysId: rep.GetSystemId(),
+		AppId: rep.GetApplicationId(), SysType: rep.GetSystemType()}
+
+	rows := FlattenReport(rep, hex.EncodeToString(reportDigest(data)), w.s.now())
+	if len(rows) > 0 {
+		w.add(w.s.keys.createPartition(w.partition, pi), pi, rows)
+	}
+}
+
+func (s *Server) parquetWorker() {
+	tick := time.NewTicker(parquetTick)
+	defer tick.Stop()
+
+	for {
+		select {
+		case data := <-s.chanParquet:
+			s.parquet.addReport(data)
+		case <-tick.C:
+			s.parquet.rotateDue(false)
+		case <-s.done:
+			// Shutdown writes out the rest
+			return
+		}
+	}
+}
+
+// flushParquet takes what is queued, then writes every partition out.
+// Only call it once the worker has stopped.
+func (s *Server) flushParquet() {
+	for {
+		select {
+		case data := <-s.chanParquet:
+			s.parquet.addReport(data)
+		default:
+			s.parquet.rotateDue(true)
+			return
+		}
+	}
+}
+
+// opExportParquet hands a stored report to the Parquet writer, if enabled.
+// A full queue drops the report rather than holding up the request.
+func (s *Server) opExportParquet(data []byte) {
+	if s.parquet == nil {
+		return
+	}
+
+	select {
+	case s.chanParquet <- append([]byte(nil), data...):
+		// No op, it was submitted to the channel
+	default:
+		atomic.AddUint64(&s.stats.QueueFullParquet, 1)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestFlattenReport(t *testing.T) {
+	received := time.Unix(1500000000, 0)
+	rows := FlattenReport(testStixReport(), "r1", received)
+
+	// Three data rows for the first sighting, one bare row for the second
+	if len(rows) != 4 {
+		t.Fatalf("rows: %d", len(rows))
+	}
+	if rows[0].DataIndex == nil || *rows[0].DataIndex != 0 || *rows[0].DataValue != "10.0.0.1" ||
+		rows[0].SightingIndex != 0 || rows[0].TestId != 300 || rows[0].ReceivedAt != 1500000000000 {
+		t.Errorf("row 0: %+v", rows[0])
+	}
+	if rows[3].SightingIndex != 1 || rows[3].DataIndex != nil || rows[3].DataValue != nil {
+		t.Errorf("row 3: %+v", rows[3])
+	}
+	if rows[0].SightingTime == nil || *rows[0].SightingTime != 1500000000000 {
+		t.Error("sighting time")
+	}
+}
+
+func TestParquetExport(t *testing.T) {
+	data, err := proto.Marshal(testStixReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	clock := func() time.Time { return time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC) }
+	s, err := NewServer(WithAddr(""), WithStorage(m, nil), WithClock(clock),
+		WithConfig(&Config{Parquet: &ParquetConfig{Compression: "zstd"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	postMsg(s, data)
+	postMsg(s, data)
+	s.Shutdown(context.Background())
+
+	var file, manifest []byte
+	for k, v := range m.objects {
+		if strings.HasPrefix(k, "/parquet/dt=2019-05-01/org=abcd/") {
+			if strings.HasSuffix(k, ParquetSuffix) {
+				file = v
+			} else if strings.Contains(k, "/_manifest-") {
+				manifest = v
+			}
+		}
+	}
+	if file == nil || manifest == nil {
+		t.Fatalf("objects: %d", m.len())
+	}
+
+	rows, err := parquet.Read[SightingRow](bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 8 || rows[0].OrganizationId != "abcd" || *rows[2].DataValue != "1.0" {
+		t.Errorf("read back %d rows: %+v", len(rows), rows[0])
+	}
+
+	var pm ParquetManifest
+	if err = json.Unmarshal(manifest, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if len(pm.Files) != 1 || pm.Files[0].Rows != 8 {
+		t.Errorf("manifest: %+v", pm)
+	}
+}
+
+func TestParquetPartitionClose(t *testing.T) {
+	data, err := proto.Marshal(testStixReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemStorage()
+	now := time.Date(2019, 5, 1, 23, 0, 0, 0, time.UTC)
+	s, err := NewServer(WithAddr(""), WithStorage(m, nil), WithClock(func() time.Time { return now }),
+		WithConfig(&Config{Parquet: &ParquetConfig{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	postMsg(s, data)
+	s.flushParquet()
+	if len(s.parquet.partitions) != 1 {
+		t.Fatalf("%d partitions", len(s.parquet.partitions))
+	}
+
+	// The next day, the flushed partition is closed out and dropped
+	now = now.Add(2 * time.Hour)
+	s.parquet.rotateDue(false)
+	if len(s.parquet.partitions) != 0 {
+		t.Errorf("%d partitions kept", len(s.parquet.partitions))
+	}
+	var pm ParquetManifest
+	for k, v := range m.objects {
+		if strings.Contains(k, "/_manifest-") {
+			json.Unmarshal(v, &pm)
+		}
+	}
+	if !pm.Closed || len(pm.Files) != 1 {
+		t.Errorf("manifest: %+v", pm)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+// Quarantine reasons; each is the top level prefix of the quarantined keys
+const (
+	QuarantineAuth       = "auth"
+	QuarantineUnknownOrg = "unknown-org"
+	QuarantineUnknownApp = "unknown-app"
+)
+
+// quarantineKey places a report under its reason, and its org when it
+// parsed (pi is nil when it did not)
+func (s *Server) quarantineKey(reason string, body []byte, pi *ParsedInfo) string {
+	key := "/" + reason + "/"
+	if pi != nil {
+		key += hex.EncodeToString(pi.OrgId) + "/"
+	}
+	return key + string(s.keys.timestamp().ts) + "_" + hex.EncodeToString(reportDigest(body))
+}
+
+// opQuarantine writes a report to the quarantine storage, apart from the
+// reports the gateway accepts
+func (s *Server) opQuarantine(mc *Config, reason string, body []byte, pi *ParsedInfo) error {
+	if mc.quarantine == nil {
+		atomic.AddUint64(&s.stats.ErrQuarantine, 1)
+		return NotConfiguredError
+	}
+	if err := mc.quarantine.Put(s.quarantineKey(reason, body, pi), bytes.NewReader(body)); err != nil {
+		atomic.AddUint64(&s.stats.ErrQuarantine, 1)
+		return err
+	}
+	atomic.AddUint64(&s.stats.Quarantined, 1)
+	return nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RateLimitMaxBuckets = 100000
+
+	RatePolicyReject = "reject"
+	RatePolicyDrop   = "drop"
+)
+
+// RateLimitConfig sets token buckets per org and per device (SystemId
+// within its org), with per org overrides, and a limit on the requests
+// handled at once.  A request over a bucket is answered 429 with
+// Retry-After under the "reject" policy (the default), or 200 and dropped
+// under "drop".  Requests over MaxConcurrent are answered 503 before their
+// body is read.
+type RateLimitConfig struct {
+	Org           *RateLimit               `json:"org,omitempty"`
+	System        *RateLimit               `json:"system,omitempty"`
+	Policy        string                   `json:"policy,omitempty"`
+	Orgs          map[string]*OrgRateLimit `json:"orgs,omitempty"`
+	MaxConcurrent int                      `json:"maxConcurrent,omitempty"`
+	MaxBuckets    int                      `json:"maxBuckets,omitempty"`
+}
+
+// RateLimit is a bucket refilled at Rate reports a second, holding up to
+// Burst (at least Rate, and 1)
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// OrgRateLimit overrides the defaults for one org; nil fields keep them
+type OrgRateLimit struct {
+	Org    *RateLimit `json:"org,omitempty"`
+	System *RateLimit `json:"system,omitempty"`
+	Policy string     `json:"policy,omitempty"`
+}
+
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+type orgRateLimit struct {
+	org    *rateLimit
+	system *rateLimit
+	policy string
+}
+
+type rateLimits struct {
+	orgRateLimit
+	orgs          map[string]*orgRateLimit
+	maxConcurrent int
+	maxBuckets    int
+}
+
+func compileRateLimit(name string, rl *RateLimit) (*rateLimit, error) {
+	if rl == nil {
+		return nil, nil
+	}
+	if rl.Rate <= 0 || rl.Burst < 0 {
+		return nil, fmt.Errorf("rateLimit: %s needs a positive rate and a burst that is not negative", name)
+	}
+	burst := math.Max(math.Max(float64(rl.Burst), math.Ceil(rl.Rate)), 1)
+	return &rateLimit{rate: rl.Rate, burst: burst}, nil
+}
+
+func validRatePolicy(p string) bool {
+	return p == "" || p == RatePolicyReject || p == RatePolicyDrop
+}
+
+func compileRateLimits(rc *RateLimitConfig) (*rateLimits, error) {
+	if rc.MaxConcurrent < 0 || rc.MaxBuckets < 0 {
+		return nil, errors.New("rateLimit: maxConcurrent and maxBuckets cannot be negative")
+	}
+	if !validRatePolicy(rc.Policy) {
+		return nil, fmt.Errorf("rateLimit: unknown policy %q", rc.Policy)
+	}
+
+	rl := &rateLimits{orgs: make(map[string]*orgRateLimit, len(rc.Orgs)), maxConcurrent: rc.MaxConcurrent,
+		maxBuckets: RateLimitMaxBuckets}
+	if rc.MaxBuckets > 0 {
+		rl.maxBuckets = rc.MaxBuckets
+	}
+	rl.policy = rc.Policy
+	if rl.policy == "" {
+		rl.policy = RatePolicyReject
+	}
+	var err error
+	if rl.org, err = compileRateLimit("org", rc.Org); err != nil {
+		return nil, err
+	}
+	if rl.system, err = compileRateLimit("system", rc.System); err != nil {
+		return nil, err
+	}
+
+	for org, oc := range rc.Orgs {
+		if b, err := hex.DecodeString(org); err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("rateLimit: org %q is not hex", org)
+		}
+		if oc == nil {
+			continue
+		}
+		if !validRatePolicy(oc.Policy) {
+			return nil, fmt.Errorf("rateLimit: org %s: unknown policy %q", org, oc.Policy)
+		}
+		o := rl.orgRateLimit
+		if oc.Org != nil {
+			if o.org, err = compileRateLimit("orgs."+org+".org", oc.Org); err != nil {
+				return nil, err
+			}
+		}
+		if oc.System != nil {
+			if o.system, err = compileRateLimit("orgs."+org+".system", oc.System); err != nil {
+				return nil, err
+			}
+		}
+		if oc.Policy != "" {
+			o.policy = oc.Policy
+		}
+		rl.orgs[strings.ToLower(org)] = &o
+	}
+	return rl, nil
+}
+
+func (rl *rateLimits) forOrg(org string) *orgRateLimit {
+	if o := rl.orgs[org]; o != nil {
+		return o
+	}
+	return &rl.orgRateLimit
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// bucketStore holds the buckets; they outlive config changes, so a reload
+// does not hand every device a fresh burst.  Past the limit, the least
+// recently used bucket goes.
+type bucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List // of *bucket, most recently used first
+}
+
+func newBucketStore() *bucketStore {
+	return &bucketStore{buckets: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns key's bucket, refilled to now
+func (bs *bucketStore) get(key string, l *rateLimit, now time.Time, max int) *bucket {
+	if e := bs.buckets[key]; e != nil {
+		bs.lru.MoveToFront(e)
+		b := e.Value.(*bucket)
+		if d := now.Sub(b.last); d > 0 {
+			b.tokens = math.Min(l.burst, b.tokens+d.Seconds()*l.rate)
+			b.last = now
+		}
+		return b
+	}
+
+	for len(bs.buckets) >= max {
+		e := bs.lru.Back()
+		delete(bs.buckets, e.Value.(*bucket).key)
+		bs.lru.Remove(e)
+	}
+	b := &bucket{key: key, tokens: l.burst, last: now}
+	bs.buckets[key] = bs.lru.PushFront(b)
+	return b
+}
+
+// bucketClaim is a token wanted from a bucket
+type bucketClaim struct {
+	key   string
+	limit *rateLimit
+}
+
+// take removes a token from each claimed bucket if every one has a token,
+// and otherwise none.  It returns the index of the first bucket short of a
+// token, or -1, and how long until all of them have one.
+func (bs *bucketStore) take(now time.Time, max int, claims ...bucketClaim) (int, time.Duration) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	short, wait := -1, time.Duration(0)
+	got := make([]*bucket, len(claims))
+	for i, c := range claims {
+		b := bs.get(c.key, c.limit, now, max)
+		if b.tokens < 1 {
+			if short < 0 {
+				short = i
+			}
+			if d := time.Duration((1 - b.tokens) / c.limit.rate * float64(time.Second)); d > wait {
+				wait = d
+			}
+		}
+		got[i] = b
+	}
+	if short >= 0 {
+		return short, wait
+	}
+	for _, b := range got {
+		b.tokens--
+	}
+	return -1, 0
+}
+
+// concurrencyLimit admits up to n requests at once; n follows the config
+type concurrencyLimit struct {
+	mu  sync.Mutex
+	sem chan struct{}
+}
+
+// acquire returns the release func, or nil when the limit is reached
+func (cl *concurrencyLimit) acquire(n int) func() {
+	cl.mu.Lock()
+	if cl.sem == nil || cap(cl.sem) != n {
+		cl.sem = make(chan struct{}, n)
+	}
+	sem := cl.sem
+	cl.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }
+	default:
+		return nil
+	}
+}
+
+// opAdmit applies the concurrency limit; the caller calls the returned
+// release when done, unless it is nil, in which case the request was
+// answered
+func (s *Server) opAdmit(mc *Config, w http.ResponseWriter) (release func()) {
+	if mc.rateLimit == nil || mc.rateLimit.maxConcurrent == 0 {
+		return func() {}
+	}
+	if release = s.inflight.acquire(mc.rateLimit.maxConcurrent); release == nil {
+		atomic.AddUint64(&s.stats.LoadShed, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return release
+}
+
+// opRateLimit checks a report against its device's and org's buckets.  It
+// returns the status to answer with, or 0 when the report may go on, and
+// for a 429 how long until it may be sent again.
+func (s *Server) opRateLimit(mc *Config, pi *ParsedInfo) (int, time.Duration) {
+	org := hex.EncodeToString(pi.OrgId)
+	ol := mc.rateLimit.forOrg(org)
+	now := s.now()
+
+	// A report over either bucket takes a token from neither
+	var claims []bucketClaim
+	if ol.system != nil {
+		claims = append(claims, bucketClaim{org + "/" + hex.EncodeToString(pi.SysId), ol.system})
+	}
+	if ol.org != nil {
+		claims = append(claims, bucketClaim{org, ol.org})
+	}
+	short, wait := s.buckets.take(now, mc.rateLimit.maxBuckets, claims...)
+	if short < 0 {
+		return 0, 0
+	}
+	if claims[short].limit == ol.system {
+		atomic.AddUint64(&s.stats.RateLimitedSys, 1)
+	} else {
+		atomic.AddUint64(&s.stats.RateLimitedOrg, 1)
+	}
+
+	if ol.policy == RatePolicyDrop {
+		return http.StatusOK, 0
+	}
+	return http.StatusTooManyRequests, wait
+}
+
+// retryAfter renders a wait as Retry-After seconds, rounded up
+func retryAfter(wait time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10)
+}
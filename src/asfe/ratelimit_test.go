@@ -0,0 +1,125 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := parseMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := hex.EncodeToString(pi.OrgId)
+
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := newMemStorage()
+	s := newTestServer(t, WithStorage(m, nil), WithClock(func() time.Time { return now }),
+		WithConfig(&Config{RateLimit: &RateLimitConfig{Org: &RateLimit{Rate: 0.5, Burst: 2}}}))
+
+	post := func() (int, string) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/v1/msg", bytes.NewReader(data)))
+		return rec.Code, rec.Header().Get("Retry-After")
+	}
+	for i := 0; i < 2; i++ {
+		if code, _ := post(); code != 200 {
+			t.Fatalf("%d: %d inside the burst", i, code)
+		}
+	}
+	if code, after := post(); code != 429 || after != "2" {
+		t.Errorf("over the limit: %d, Retry-After %q", code, after)
+	}
+	now = now.Add(2 * time.Second)
+	if code, _ := post(); code != 200 || m.len() != 3 {
+		t.Errorf("after refill: %d, %d stored", code, m.len())
+	}
+
+	// A per org device limit, dropping what is over it
+	s.installConfig(&Config{RateLimit: &RateLimitConfig{Org: &RateLimit{Rate: 100},
+		Orgs: map[string]*OrgRateLimit{org: {System: &RateLimit{Rate: 1}, Policy: RatePolicyDrop}}}})
+	now = now.Add(time.Minute)
+	if code, _ := post(); code != 200 || m.len() != 4 {
+		t.Errorf("device limit: %d, %d stored", code, m.len())
+	}
+	if code, _ := post(); code != 200 || m.len() != 4 {
+		t.Errorf("device over limit: %d, %d stored", code, m.len())
+	}
+	if st := s.Stats(); st.RateLimitedOrg != 1 || st.RateLimitedSys != 1 {
+		t.Errorf("stats %+v", st)
+	}
+
+	// Over the concurrency limit, requests are shed before being read
+	s.installConfig(&Config{RateLimit: &RateLimitConfig{MaxConcurrent: 1}})
+	release := s.inflight.acquire(1)
+	if code, after := post(); code != 503 || after != "1" {
+		t.Errorf("shed: %d, Retry-After %q", code, after)
+	}
+	release()
+	if code, _ := post(); code != 200 || s.Stats().LoadShed != 1 {
+		t.Errorf("admitted: %d", code)
+	}
+}
+
+func TestBucketStore(t *testing.T) {
+	bs := newBucketStore()
+	l := &rateLimit{rate: 1, burst: 1}
+	now := time.Now()
+
+	// The least recently used bucket goes
+	bs.take(now, 2, bucketClaim{"a", l})
+	bs.take(now, 2, bucketClaim{"b", l})
+	bs.take(now, 2, bucketClaim{"a", l})
+	bs.take(now, 2, bucketClaim{"c", l})
+	if _, ok := bs.buckets["b"]; ok || len(bs.buckets) != 2 || bs.lru.Len() != 2 {
+		t.Errorf("buckets kept: %v", bs.buckets)
+	}
+
+	// A claim short on one bucket takes from none
+	sys := &rateLimit{rate: 1, burst: 5}
+	if short, wait := bs.take(now, 10, bucketClaim{"org/sys", sys}, bucketClaim{"a", l}); short != 1 || wait != time.Second {
+		t.Errorf("short %d, wait %v", short, wait)
+	}
+	if b := bs.buckets["org/sys"].Value.(*bucket); b.tokens != 5 {
+		t.Errorf("%v tokens left", b.tokens)
+	}
+}
+
+func TestRateLimitInvalid(t *testing.T) {
+	bad := []*RateLimitConfig{
+		{MaxConcurrent: -1},
+		{Policy: "queue"},
+		{Org: &RateLimit{}},
+		{System: &RateLimit{Rate: 1, Burst: -1}},
+		{Orgs: map[string]*OrgRateLimit{"xy": {}}},
+		{Orgs: map[string]*OrgRateLimit{"aa": {Org: &RateLimit{Rate: -1}}}},
+	}
+	for i, rc := range bad {
+		if _, err := compileRateLimits(rc); err == nil {
+			t.Errorf("%d: accepted", i)
+		}
+	}
+}
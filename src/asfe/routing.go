@@ -0,0 +1,447 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	QUEUE_SIZE_ROUTE = 1000
+
+	RouteStore   = "store"
+	RouteQueue   = "queue"
+	RouteForward = "forward"
+	RouteDrop    = "drop"
+	RouteSample  = "sample"
+
+	// Queue names that refer to the dedicated queues
+	RouteQueueAtypical   = "atypical"
+	RouteQueueParseError = "parseError"
+)
+
+// RouteForwardTargets are the outputs a forward action can name
+var RouteForwardTargets = []string{"export", "parquet", "splunk", "syslog", "taxii", "kafka"}
+
+// RouteConfig sends matching reports through its actions instead of the
+// default flow.  Routes are tried in order and the first match wins, unless
+// it sets Continue, in which case later routes are tried too.
+type RouteConfig struct {
+	Name     string        `json:"name,omitempty"`
+	Match    RouteMatch    `json:"match"`
+	Actions  []RouteAction `json:"actions"`
+	Continue bool          `json:"continue,omitempty"`
+}
+
+// RouteMatch holds when every condition it sets holds; unset conditions
+// match anything.  Orgs are hex, Paths are "fast" or "fallback".  The
+// sighting conditions hold when at least one sighting meets all of them.
+type RouteMatch struct {
+	Orgs        []string `json:"orgs,omitempty"`
+	Apps        []string `json:"apps,omitempty"`
+	SystemTypes []uint32 `json:"systemTypes,omitempty"`
+	Paths       []string `json:"paths,omitempty"`
+	Atypical    *bool    `json:"atypical,omitempty"`
+
+	Tests         []uint32    `json:"tests,omitempty"`
+	TestRanges    [][2]uint32 `json:"testRanges,omitempty"`
+	SightingTypes []uint32    `json:"sightingTypes,omitempty"`
+	MinConfidence uint32      `json:"minConfidence,omitempty"`
+	MinImpact     uint32      `json:"minImpact,omitempty"`
+}
+
+// RouteAction is one step of a route:
+//
+//	store    stores the report, under Key if set (a storage key template)
+//	queue    sends the report to Queue: "atypical", "parseError" or a name
+//	         from Config.Queues
+//	forward  hands the report to Target, one of RouteForwardTargets
+//	drop     acknowledges the report and stops
+//	sample   goes on with the remaining actions for a Rate (0..1) share of
+//	         reports, picked by body digest so a resend gets the same outcome
+type RouteAction struct {
+	Action string  `json:"action"`
+	Key    string  `json:"key,omitempty"`
+	Queue  string  `json:"queue,omitempty"`
+	Target string  `json:"target,omitempty"`
+	Rate   float64 `json:"rate,omitempty"`
+}
+
+type routeAction struct {
+	RouteAction
+	key       *keyTemplate
+	threshold uint64 // sample: digest prefix below this is kept
+}
+
+type route struct {
+	name     string
+	orgs     map[string]bool // raw org id bytes
+	apps     map[string]bool
+	sysTypes map[uint32]bool
+	fast     bool
+	fallback bool
+	atypical *bool
+	sighting *atypicalRule // nil without sighting conditions
+	actions  []routeAction
+	cont     bool
+}
+
+type routeItem struct {
+	queue string
+	data  []byte
+}
+
+func compileRoute(i int, rc *RouteConfig, queues map[string][]string) (*route, error) {
+	name := rc.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", i)
+	}
+	fail := func(format string, args ...interface{}) (*route, error) {
+		return nil, fmt.Errorf("route %s: "+format, append([]interface{}{name}, args...)...)
+	}
+
+	r := &route{name: name, atypical: rc.Match.Atypical, cont: rc.Continue,
+		sysTypes: uint32Set(rc.Match.SystemTypes)}
+
+	if len(rc.Match.Orgs) > 0 {
+		r.orgs = make(map[string]bool)
+		for _, o := range rc.Match.Orgs {
+			org, err := hex.DecodeString(o)
+			if err != nil || len(org) == 0 {
+				return fail("bad org %q", o)
+			}
+			r.orgs[string(org)] = true
+		}
+	}
+	if len(rc.Match.Apps) > 0 {
+		r.apps = make(map[string]bool)
+		for _, a := range rc.Match.Apps {
+			r.apps[a] = true
+		}
+	}
+	if len(rc.Match.Paths) == 0 {
+		r.fast, r.fallback = true, true
+	}
+	for _, p := range rc.Match.Paths {
+		switch p {
+		case PathFast:
+			r.fast = true
+		case PathFallback:
+			r.fallback = true
+		default:
+			return fail("unknown path %q", p)
+		}
+	}
+
+	m := &rc.Match
+	if len(m.Tests) > 0 || len(m.TestRanges) > 0 || len(m.SightingTypes) > 0 || m.MinConfidence > 0 || m.MinImpact > 0 {
+		rules, _, err := compileAtypicalRules([]AtypicalRule{{Tests: m.Tests, TestRanges: m.TestRanges,
+			SightingTypes: m.SightingTypes, MinConfidence: m.MinConfidence, MinImpact: m.MinImpact}})
+		if err != nil {
+			return fail("%v", err)
+		}
+		r.sighting = &rules[0]
+	}
+
+	if len(rc.Actions) == 0 {
+		return fail("no actions")
+	}
+	for _, a := range rc.Actions {
+		ra := routeAction{RouteAction: a}
+		switch a.Action {
+		case RouteStore:
+			if a.Key != "" {
+				kt, err := compileKeyTemplate(a.Key)
+				if err != nil {
+					return fail("%v", err)
+				}
+				ra.key = kt
+			}
+		case RouteQueue:
+			if _, ok := queues[a.Queue]; !ok && a.Queue != RouteQueueAtypical && a.Queue != RouteQueueParseError {
+				return fail("unknown queue %q", a.Queue)
+			}
+		case RouteForward:
+			ok := false
+			for _, t := range RouteForwardTargets {
+				ok = ok || t == a.Target
+			}
+			if !ok {
+				return fail("unknown forward target %q", a.Target)
+			}
+		case RouteDrop:
+		case RouteSample:
+			if a.Rate < 0 || a.Rate > 1 {
+				return fail("sample rate must be within [0, 1]")
+			}
+			if a.Rate == 1 {
+				ra.threshold = math.MaxUint64
+			} else {
+				ra.threshold = uint64(a.Rate * (1 << 64))
+			}
+		default:
+			return fail("unknown action %q", a.Action)
+		}
+		r.actions = append(r.actions, ra)
+	}
+	return r, nil
+}
+
+func compileRoutes(l []RouteConfig, queues map[string][]string) ([]*route, error) {
+	routes := make([]*route, 0, len(l))
+	for i := range l {
+		r, err := compileRoute(i, &l[i], queues)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// reportSightings walks the top level of an encoded Report for the rule
+// fields of each Sighting (tag=8)
+func reportSightings(data []byte) ([]sightingInfo, error) {
+	var sightings []sightingInfo
+
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, MsgParseError
+		}
+		data = data[n:]
+
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return nil, MsgParseError
+			}
+		case 1:
+			n = 8
+		case 2:
+			l, m := binary.Uvarint(data)
+			if m <= 0 || uint64(len(data)-m) < l {
+				return nil, MsgParseError
+			}
+			if tag>>3 == 8 {
+				var si sightingInfo
+				if !parseSightingDetail(data[m:m+int(l)], &si) {
+					return nil, MsgParseError
+				}
+				sightings = append(sightings, si)
+			}
+			n = m + int(l)
+		case 5:
+			n = 4
+		default:
+			return nil, MsgParseError
+		}
+		if n > len(data) {
+			return nil, MsgParseError
+		}
+		data = data[n:]
+	}
+	return sightings, nil
+}
+
+// matchRoutes returns the routes a report takes; none means the default flow
+func (c *Config) matchRoutes(data []byte, pi *ParsedInfo) []*route {
+	var matched []*route
+	var sightings []sightingInfo
+	var walked bool
+
+	for _, r := range c.routes {
+		if r.orgs != nil && !r.orgs[string(pi.OrgId)] {
+			continue
+		}
+		if r.apps != nil && !r.apps[string(pi.AppId)] {
+			continue
+		}
+		if r.sysTypes != nil && !r.sysTypes[pi.SysType] {
+			continue
+		}
+		if (pi.Fallback && !r.fallback) || (!pi.Fallback && !r.fast) {
+			continue
+		}
+		if r.atypical != nil && *r.atypical != pi.Atypical {
+			continue
+		}
+		if r.sighting != nil {
+			if !walked {
+				// Already parsed once, so this is not expected to fail
+				sightings, _ = reportSightings(data)
+				walked = true
+			}
+			ok := false
+			for i := 0; !ok && i < len(sightings); i++ {
+				ok = r.sighting.match(&sightings[i], pi.SysType)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		matched = append(matched, r)
+		if !r.cont {
+			break
+		}
+	}
+	return matched
+}
+
+// opRoute runs the actions of the matched routes.  A failed store fails the
+// request, so the device sends the report again.
+func (s *Server) opRoute(ctx context.Context, mc *Config, routes []*route, body []byte, pi *ParsedInfo) error {
+	atomic.AddUint64(&s.stats.Routed, 1)
+
+	var key string
+	var sample uint64
+	for _, r := range routes {
+	actions:
+		for i := range r.actions {
+			a := &r.actions[i]
+			switch a.Action {
+			case RouteStore:
+				k, err := s.storeReport(ctx, mc, body, pi, a.key)
+				if err != nil {
+					return err
+				}
+				if k != "" {
+					key = k
+				}
+			case RouteQueue:
+				s.opQueueRoute(a.Queue, body)
+			case RouteForward:
+				s.opForward(a.Target, body, pi, key)
+			case RouteDrop:
+				atomic.AddUint64(&s.stats.RouteDropped, 1)
+				return nil
+			case RouteSample:
+				if sample == 0 {
+					sample = binary.BigEndian.Uint64(reportDigest(body))
+				}
+				if sample >= a.threshold {
+					atomic.AddUint64(&s.stats.RouteSampledOut, 1)
+					break actions
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// storeReport stores a report on its own, under kt or the configured key,
+// or in batching mode adds it to its batch (only when kt is nil).  Returns
+// the object key, "" for a batched report.
+func (s *Server) storeReport(ctx context.Context, mc *Config, body []byte, pi *ParsedInfo, kt *keyTemplate) (string, error) {
+	if s.batch != nil && kt == nil {
+		// Batching mode: the report joins its partition's batch object
+		if err := s.batch.add(ctx, s.keys.createPartition(s.batch.partition, pi), body); err != nil {
+			atomic.AddUint64(&s.stats.ErrStore, 1)
+			return "", err
+		}
+		return "", nil
+	}
+
+	if kt == nil {
+		kt = mc.storageKey()
+	}
+	key, err := s.keys.createStorageKey(kt, body, pi)
+	if err != nil {
+		atomic.AddUint64(&s.stats.ErrCreateKey, 1)
+		return "", err
+	}
+	if err = s.opStore(body, key); err != nil {
+		atomic.AddUint64(&s.stats.ErrStore, 1)
+		return "", err
+	}
+	return key, nil
+}
+
+// opForward hands a report to one output; export needs the key the report
+// was stored under
+func (s *Server) opForward(target string, body []byte, pi *ParsedInfo, key string) {
+	switch target {
+	case "export":
+		if key != "" {
+			s.opExportDecoded(body, key)
+		}
+	case "parquet":
+		s.opExportParquet(body)
+	case "splunk":
+		s.opForwardSplunk(body)
+	case "syslog":
+		s.opForwardSyslog(body)
+	case "taxii":
+		s.opPublishTaxii(body)
+	case "kafka":
+		s.opForwardKafka(body, pi)
+	}
+}
+
+func (s *Server) _opQueueRoute(item routeItem) {
+	mc := s.loadConfig()
+	q := mc.queues[item.queue]
+	if q == nil {
+		return
+	}
+	if err := q.Send(item.data); err != nil {
+		atomic.AddUint64(&s.stats.ErrQueueRoute, 1)
+	}
+}
+
+// drainRouteQueues sends what is still queued for named queues.  Only call
+// it once the workers have stopped.
+func (s *Server) drainRouteQueues() {
+	for {
+		select {
+		case item := <-s.chanRoute:
+			s._opQueueRoute(item)
+		default:
+			return
+		}
+	}
+}
+
+// opQueueRoute sends a report to a named queue
+func (s *Server) opQueueRoute(name string, data []byte) {
+	switch name {
+	case RouteQueueAtypical:
+		atomic.AddUint64(&s.stats.Atypical, 1)
+		s.opQueueAtypical(data)
+		return
+	case RouteQueueParseError:
+		s.opQueueParseError(data)
+		return
+	}
+
+	// The body may live in a pool buffer, so take a copy
+	item := routeItem{queue: name, data: append([]byte(nil), data...)}
+
+	select {
+	case s.chanRoute <- item:
+		// No op, it was submitted to the channel
+	default:
+		// Channel is full, so handle synchronously
+		atomic.AddUint64(&s.stats.QueueFullRoute, 1)
+		s._opQueueRoute(item)
+	}
+}
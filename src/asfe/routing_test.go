@@ -0,0 +1,130 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestReportSightings(t *testing.T) {
+	data, err := proto.Marshal(testStixReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sightings, err := reportSightings(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sightings) != 2 || sightings[0].test != 300 || sightings[0].confidence != 3 {
+		t.Errorf("sightings %+v", sightings)
+	}
+	if _, err = reportSightings(data[:len(data)-1]); err == nil {
+		t.Error("truncated report walked")
+	}
+}
+
+func TestCompileRoutes(t *testing.T) {
+	queues := map[string][]string{"android": {"us-east-1", "https://sqs/android"}}
+	bad := []RouteConfig{
+		{Actions: []RouteAction{{Action: "mirror"}}},
+		{Actions: []RouteAction{{Action: RouteQueue, Queue: "nope"}}},
+		{Actions: []RouteAction{{Action: RouteForward, Target: "email"}}},
+		{Actions: []RouteAction{{Action: RouteSample, Rate: 1.5}}},
+		{Actions: []RouteAction{{Action: RouteStore, Key: "/{org}"}}},
+		{Match: RouteMatch{Orgs: []string{"xyz"}}, Actions: []RouteAction{{Action: RouteDrop}}},
+		{Match: RouteMatch{Paths: []string{"slow"}}, Actions: []RouteAction{{Action: RouteDrop}}},
+		{},
+	}
+	for i := range bad {
+		if _, err := compileRoutes(bad[i:i+1], queues); err == nil {
+			t.Errorf("route %d accepted", i)
+		}
+	}
+	if _, err := compileRoutes([]RouteConfig{{Actions: []RouteAction{{Action: RouteQueue, Queue: "android"}}}}, queues); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	report := func(org []byte, app string) []byte {
+		rep := testStixReport()
+		rep.OrganizationId, rep.ApplicationId = org, []byte(app)
+		data, err := proto.Marshal(rep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	mc := &Config{
+		Queues: map[string][]string{"android": {"us-east-1", "https://sqs/android"}},
+		Routes: []RouteConfig{
+			{
+				Name:  "android-malware",
+				Match: RouteMatch{Orgs: []string{"abcd"}, SystemTypes: []uint32{1}, Tests: []uint32{300}, MinConfidence: 3},
+				Actions: []RouteAction{
+					{Action: RouteStore, Key: "/android/{sysid}/{hash}"},
+					{Action: RouteQueue, Queue: "android"},
+				},
+			},
+			{Match: RouteMatch{Orgs: []string{"eeee"}}, Actions: []RouteAction{{Action: RouteDrop}}},
+			{
+				Match:   RouteMatch{Apps: []string{"sampled"}},
+				Actions: []RouteAction{{Action: RouteSample, Rate: 0}, {Action: RouteStore}},
+			},
+		},
+	}
+	ms, q := newMemStorage(), &memQueue{}
+	s := newTestServer(t, WithConfig(mc), WithStorage(ms, nil), WithQueue("android", q))
+
+	for _, data := range [][]byte{
+		report([]byte{0xab, 0xcd}, "com.app"),
+		report([]byte{0xee, 0xee}, "com.app"),
+		report([]byte{0x12, 0x34}, "sampled"),
+		report([]byte{0x12, 0x34}, "com.app"),
+	} {
+		if code := postMsg(s, data); code != 200 {
+			t.Fatalf("status %d", code)
+		}
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The routed report and the one that took the default flow
+	if ms.len() != 2 {
+		t.Errorf("%d objects stored", ms.len())
+	}
+	found := false
+	for key := range ms.objects {
+		found = found || strings.HasPrefix(key, "/android/0102/")
+	}
+	if !found {
+		t.Error("routed report not stored under its route's key")
+	}
+	if q.len() != 1 {
+		t.Errorf("%d reports queued", q.len())
+	}
+
+	st := s.Stats()
+	if st.Routed != 3 || st.RouteDropped != 1 || st.RouteSampledOut != 1 || st.OK != 4 {
+		t.Errorf("stats %+v", st)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/IBM/sarama"
+)
+
+const (
+	DefaultAddr = ":5000"
+)
+
+var (
+	NoConfigError       = errors.New("No config source")
+	AlreadyStartedError = errors.New("Server already started")
+)
+
+// Server is one ingestion front end: its config, backends, workers and
+// counters.  Several servers can run in one process.
+type Server struct {
+	config unsafe.Pointer // *Config
+
+	configSource string
+	configs      *configLoader
+	configKeys   ConfigKeys
+	reload       chan struct{}
+	static       *Config
+	lastGoodPath string
+	addr         string
+	addrSet      bool
+	logger       *log.Logger
+	auditLog     io.Writer
+	auditMu      sync.Mutex
+	now          func() time.Time
+
+	// Backend overrides; nil uses what the config describes
+	primary         Storage
+	secondary       Storage
+	quarantine      Storage
+	queueParseError Queue
+	queueAtypical   Queue
+	queues          map[string]Queue
+	kafkaProducer   sarama.AsyncProducer
+
+	stats    *Stats
+	metrics  *serverMetrics
+	keys     *keyGen
+	spool    *Spool
+	drain    *Spool
+	seen     *seenSet
+	replay   *replayCache
+	buckets  *bucketStore
+	inflight concurrencyLimit
+	batch    *batchWriter
+	parquet  *parquetWriter
+	taxii    *taxiiStore
+
+	chanParseError chan []byte
+	chanAtypical   chan []byte
+	chanExport     chan exportItem
+	chanSplunk     chan []byte
+	chanSyslog     chan []byte
+	chanTaxii      chan []byte
+	chanParquet    chan []byte
+	chanKafka      chan kafkaItem
+	chanRoute      chan routeItem
+
+	mux      *http.ServeMux
+	http     *http.Server
+	listener net.Listener
+	certs    *certReloader
+	started  bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithConfigURL loads the config from a comma separated list of sources
+// (see NewConfigSource), later ones overriding earlier ones, and refreshes
+// it periodically
+func WithConfigURL(sources string) Option {
+	return func(s *Server) { s.configSource = sources }
+}
+
+// WithConfig uses a fixed config
+func WithConfig(c *Config) Option {
+	return func(s *Server) { s.static = c }
+}
+
+// WithConfigKeys requires config documents to be signed by one of keys
+func WithConfigKeys(keys ConfigKeys) Option {
+	return func(s *Server) { s.configKeys = keys }
+}
+
+// WithAuditLog writes config audit records to w, one JSON object per line,
+// instead of the log
+func WithAuditLog(w io.Writer) Option {
+	return func(s *Server) { s.auditLog = w }
+}
+
+// WithLastGoodPath keeps a copy of every installed config at path, and
+// starts from it when the config source fails
+func WithLastGoodPath(path string) Option {
+	return func(s *Server) { s.lastGoodPath = path }
+}
+
+// WithAddr sets the listen address, overriding the config's; "" serves
+// only through Handler()
+func WithAddr(addr string) Option {
+	return func(s *Server) { s.addr, s.addrSet = addr, true }
+}
+
+// WithStorage replaces the configured storage backends
+func WithStorage(primary, secondary Storage) Option {
+	return func(s *Server) { s.primary, s.secondary = primary, secondary }
+}
+
+// WithQuarantine replaces the configured quarantine storage
+func WithQuarantine(q Storage) Option {
+	return func(s *Server) { s.quarantine = q }
+}
+
+// WithQueues replaces the configured parse error and atypical queues
+func WithQueues(parseError, atypical Queue) Option {
+	return func(s *Server) { s.queueParseError, s.queueAtypical = parseError, atypical }
+}
+
+// WithQueue replaces a named route queue, or adds one the config can use
+// without describing it
+func WithQueue(name string, q Queue) Option {
+	return func(s *Server) {
+		if s.queues == nil {
+			s.queues = make(map[string]Queue)
+		}
+		s.queues[name] = q
+	}
+}
+
+// WithKafkaProducer replaces the producer the Kafka config describes; the
+// server closes it on shutdown
+func WithKafkaProducer(p sarama.AsyncProducer) Option {
+	return func(s *Server) { s.kafkaProducer = p }
+}
+
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) { s.logger = l }
+}
+
+// WithClock sets the time source used for storage keys
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) { s.now = now }
+}
+
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		addr:           DefaultAddr,
+		logger:         log.New(os.Stderr, "asfe: ", log.LstdFlags),
+		now:            time.Now,
+		stats:          &Stats{},
+		metrics:        newServerMetrics(),
+		taxii:          newTaxiiStore(),
+		replay:         newReplayCache(replayCacheMax),
+		buckets:        newBucketStore(),
+		chanParseError: make(chan []byte, QUEUE_SIZE_PARSEERROR),
+		chanAtypical:   make(chan []byte, QUEUE_SIZE_ATYPICAL),
+		chanExport:     make(chan exportItem, QUEUE_SIZE_EXPORT),
+		chanSplunk:     make(chan []byte, QUEUE_SIZE_SPLUNK),
+		chanSyslog:     make(chan []byte, QUEUE_SIZE_SYSLOG),
+		chanTaxii:      make(chan []byte, QUEUE_SIZE_TAXII),
+		chanParquet:    make(chan []byte, QUEUE_SIZE_PARQUET),
+		chanKafka:      make(chan kafkaItem, QUEUE_SIZE_KAFKA),
+		chanRoute:      make(chan routeItem, QUEUE_SIZE_ROUTE),
+		reload:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.keys = newKeyGen(s.now)
+
+	// Load the initial config
+	if err := s.initialConfig(); err != nil {
+		return nil, err
+	}
+
+	if err := s.opInit(); err != nil {
+		return nil, err
+	}
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/v1/msg", s.handleMsg)
+	s.mux.HandleFunc("/v1/batch", s.handleBatch)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc(TaxiiRoot, s.handleTaxii)
+
+	return s, nil
+}
+
+// Handler serves the ingestion, metrics and TAXII endpoints
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Stats returns the server's live counters
+func (s *Server) Stats() *Stats {
+	return s.stats
+}
+
+// Addr returns the listening address, once started
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Server) goWorker(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// Start launches the background workers and, if an address is set, the
+// HTTP listener (see ListenConfig).  It does not block.
+func (s *Server) Start() error {
+	if s.started {
+		return AlreadyStartedError
+	}
+
+	if err := s.openListener(); err != nil {
+		return err
+	}
+	s.started = true
+
+	s.opStart()
+	s.goWorker(s.statsWorker)
+	if s.configs != nil {
+		s.goWorker(s.configRefresher)
+	}
+
+	if s.certs != nil {
+		s.goWorker(func() { s.certWorker(s.certs) })
+	}
+
+	if s.listener != nil {
+		go func() {
+			if err := s.http.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+				s.logger.Println("serve:", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Shutdown stops the listener, waits for in-flight requests, stops the
+// workers, then sends what is left in the parse error and atypical
+// channels.  Whatever cannot be sent before ctx is done goes to the drain
+// path, if configured.  A final stats report is published.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if s.http != nil {
+		err = s.http.Shutdown(ctx)
+	}
+
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		if s.batch != nil {
+			s.batch.flushDue(true)
+		}
+		if s.parquet != nil {
+			s.flushParquet()
+		}
+		s.drainChannel(ctx, s.chanParseError, drainKeyParseError)
+		s.drainChannel(ctx, s.chanAtypical, drainKeyAtypical)
+		s.drainRouteQueues()
+		s.publishStats()
+	case <-ctx.Done():
+		// Out of time; what is left can still go to disk
+		s.drainChannel(ctx, s.chanParseError, drainKeyParseError)
+		s.drainChannel(ctx, s.chanAtypical, drainKeyAtypical)
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	s.discardQueues()
+
+	if s.spool != nil {
+		s.spool.Close()
+	}
+	if s.drain != nil {
+		s.drain.Close()
+	}
+	if s.seen != nil {
+		s.seen.Close()
+	}
+	return err
+}
@@ -0,0 +1,264 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memStorage keeps objects in memory
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    bool
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string][]byte)}
+}
+
+func (m *memStorage) Put(key string, r io.ReadSeeker) error {
+	r.Seek(0, 0)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return errors.New("put failed")
+	}
+	m.objects[key] = data
+	return nil
+}
+
+func (m *memStorage) get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	return data, ok
+}
+
+func (m *memStorage) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.objects)
+}
+
+// memQueue collects sent messages
+type memQueue struct {
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+func (q *memQueue) Send(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.msgs = append(q.msgs, data)
+	return nil
+}
+
+func (q *memQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs)
+}
+
+// newTestServer builds a started server with in-memory storage and no
+// listener; options after the defaults override them.
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	opts = append([]Option{WithConfig(&Config{}), WithAddr(""), WithStorage(newMemStorage(), nil)}, opts...)
+	s, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func postMsg(s *Server, body []byte) int {
+	req := httptest.NewRequest("POST", "/v1/msg", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestServersIsolated(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/test_msg_sp.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := func() time.Time { return time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC) }
+	ma, mb := newMemStorage(), newMemStorage()
+	qa := &memQueue{}
+	a := newTestServer(t, WithStorage(ma, nil), WithQueues(qa, nil), WithClock(clock))
+	b := newTestServer(t, WithStorage(mb, nil))
+
+	for i := 0; i < 3; i++ {
+		if code := postMsg(a, data); code != 200 {
+			t.Fatalf("a: %d", code)
+		}
+	}
+	if code := postMsg(b, data); code != 200 {
+		t.Fatalf("b: %d", code)
+	}
+	postMsg(a, []byte("garbage"))
+
+	if ma.len() != 3 || mb.len() != 1 {
+		t.Errorf("stored a=%d b=%d", ma.len(), mb.len())
+	}
+	for k := range ma.objects {
+		if !bytes.Contains([]byte(k), []byte("/2019-05-01T12:00:00_")) {
+			t.Errorf("key not from clock: %s", k)
+		}
+	}
+
+	if n := atomic.LoadUint64(&a.Stats().StoredPrimary); n != 3 {
+		t.Errorf("a stored %d", n)
+	}
+	if n := atomic.LoadUint64(&b.Stats().StoredPrimary); n != 1 {
+		t.Errorf("b stored %d", n)
+	}
+	if atomic.LoadUint64(&a.Stats().ErrParse) != 1 || atomic.LoadUint64(&b.Stats().ErrParse) != 0 {
+		t.Error("parse errors not isolated")
+	}
+
+	// The parse error reaches a's queue via its worker
+	for i := 0; i < 100 && qa.len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if qa.len() != 1 {
+		t.Errorf("parse error queue: %d", qa.len())
+	}
+}
+
+func TestServerListen(t *testing.T) {
+	s, err := NewServer(WithConfig(&Config{}), WithAddr("127.0.0.1:0"), WithStorage(newMemStorage(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Start() != AlreadyStartedError {
+		t.Error("second start")
+	}
+	if s.Addr() == nil {
+		t.Fatal("no listener")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerNoStorage(t *testing.T) {
+	if _, err := NewServer(WithConfig(&Config{}), WithAddr("")); err == nil {
+		t.Error("server without storage")
+	}
+	if _, err := NewServer(WithAddr("")); err != NoConfigError {
+		t.Errorf("no config: %v", err)
+	}
+}
+
+type failQueue struct{}
+
+func (failQueue) Send(data []byte) error {
+	return errors.New("send failed")
+}
+
+func TestShutdownDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newServer := func(q Queue) *Server {
+		s, err := NewServer(WithConfig(&Config{Shutdown: &ShutdownConfig{DrainPath: dir}}), WithAddr(""),
+			WithStorage(newMemStorage(), nil), WithQueues(q, q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// Not started, so the reports stay in the channel until shutdown
+	q := &memQueue{}
+	s := newServer(q)
+	postMsg(s, []byte("garbage"))
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if q.len() != 1 || atomic.LoadUint64(&s.Stats().Drained) != 1 {
+		t.Errorf("drained to queue: %d", q.len())
+	}
+
+	// The queue is down, so the reports go to disk
+	s = newServer(failQueue{})
+	postMsg(s, []byte("garbage1"))
+	postMsg(s, []byte("garbage2"))
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadUint64(&s.Stats().DrainSpooled) != 2 {
+		t.Errorf("drain spooled: %d", atomic.LoadUint64(&s.Stats().DrainSpooled))
+	}
+
+	// An expired deadline skips the queue
+	s = newServer(q)
+	postMsg(s, []byte("garbage3"))
+	s.chanSplunk <- []byte("forward")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+	if q.len() != 1 || atomic.LoadUint64(&s.Stats().DrainSpooled) != 1 {
+		t.Errorf("expired deadline: %d", q.len())
+	}
+	if st := s.Stats(); st.DrainDropped != 1 {
+		t.Errorf("%d dropped from forwarding queues", st.DrainDropped)
+	}
+
+	// The next start sends them
+	q = &memQueue{}
+	s = newServer(q)
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && q.len() < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if q.len() != 3 || string(q.msgs[0]) != "garbage1" {
+		t.Errorf("replayed: %d", q.len())
+	}
+	s.Shutdown(context.Background())
+}
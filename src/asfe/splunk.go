@@ -0,0 +1,382 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QUEUE_SIZE_SPLUNK = 1000
+
+	SplunkDefaultBatchSize  = 100
+	SplunkDefaultFlush      = 5 * time.Second
+	SplunkDefaultRetries    = 5
+	SplunkDefaultAckTimeout = 60 * time.Second
+	SplunkMaxBackoff        = 30 * time.Second
+	SplunkDefaultSource     = "asfe"
+	SplunkDefaultSourceType = "addsec:sighting"
+)
+
+var (
+	// Tests shorten this
+	splunkBackoffBase = 500 * time.Millisecond
+)
+
+// SplunkConfig configures the HTTP Event Collector forwarder.  URL is the
+// HEC base (e.g. https://splunk:8088).  Indexer acknowledgement needs
+// UseAck and a Channel (a GUID registered with the token).
+type SplunkConfig struct {
+	URL                string `json:"url"`
+	Token              string `json:"token"`
+	Index              string `json:"index,omitempty"`
+	Source             string `json:"source,omitempty"`
+	SourceType         string `json:"sourceType,omitempty"`
+	Channel            string `json:"channel,omitempty"`
+	UseAck             bool   `json:"useAck,omitempty"`
+	BatchSize          int    `json:"batchSize,omitempty"`
+	FlushSeconds       int    `json:"flushSeconds,omitempty"`
+	MaxRetries         int    `json:"maxRetries,omitempty"`
+	AckTimeoutSeconds  int    `json:"ackTimeoutSeconds,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+type hecEvent struct {
+	Time       int64  `json:"time"`
+	Host       string `json:"host,omitempty"`
+	Source     string `json:"source,omitempty"`
+	SourceType string `json:"sourcetype,omitempty"`
+	Index      string `json:"index,omitempty"`
+	Event      *Event `json:"event"`
+}
+
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckId *int64 `json:"ackId,omitempty"`
+}
+
+type hecPending struct {
+	payload []byte
+	count   int
+	sent    time.Time
+}
+
+type splunkForwarder struct {
+	sc      *SplunkConfig
+	stats   *Stats
+	tr      *http.Transport
+	client  *http.Client
+	done    <-chan struct{} // cuts retry backoff short on shutdown
+	batch   bytes.Buffer
+	count   int
+	pending map[int64]*hecPending
+}
+
+func newSplunkForwarder(sc *SplunkConfig, stats *Stats) *splunkForwarder {
+	tr := &http.Transport{}
+	if sc.InsecureSkipVerify {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &splunkForwarder{
+		sc:      sc,
+		stats:   stats,
+		tr:      tr,
+		client:  &http.Client{Transport: tr, Timeout: 30 * time.Second},
+		pending: make(map[int64]*hecPending),
+	}
+}
+
+// close gives back the connections of a forwarder being replaced
+func (f *splunkForwarder) close() {
+	f.tr.CloseIdleConnections()
+}
+
+func (f *splunkForwarder) batchSize() int {
+	if f.sc.BatchSize > 0 {
+		return f.sc.BatchSize
+	}
+	return SplunkDefaultBatchSize
+}
+
+// add queues the events of one report, flushing when the batch is full
+func (f *splunkForwarder) add(events []*Event) {
+	source, sourceType := f.sc.Source, f.sc.SourceType
+	if source == "" {
+		source = SplunkDefaultSource
+	}
+	if sourceType == "" {
+		sourceType = SplunkDefaultSourceType
+	}
+
+	enc := json.NewEncoder(&f.batch)
+	for _, ev := range events {
+		he := hecEvent{
+			Time:       time.Now().Unix(),
+			Host:       ev.SystemId,
+			Source:     source,
+			SourceType: sourceType,
+			Index:      f.sc.Index,
+			Event:      ev,
+		}
+		if ev.Time != nil {
+			he.Time = ev.Time.Unix()
+		}
+		if err := enc.Encode(&he); err != nil {
+			atomic.AddUint64(&f.stats.SplunkDropped, 1)
+			continue
+		}
+		f.count++
+	}
+
+	if f.count >= f.batchSize() {
+		f.flush()
+	}
+}
+
+func (f *splunkForwarder) post(path string, payload []byte, out interface{}) (int, error) {
+	req, err := http.NewRequest("POST", strings.TrimRight(f.sc.URL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Splunk "+f.sc.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if f.sc.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", f.sc.Channel)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, fmt.Errorf("HEC %s: %d %s", path, resp.StatusCode, data)
+	}
+	if out != nil {
+		err = json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, err
+}
+
+// send posts one batch, retrying with exponential backoff on network
+// errors, 5xx and 429 (busy).  Other 4xx errors are not retryable.
+func (f *splunkForwarder) send(payload []byte, count int) error {
+	retries := f.sc.MaxRetries
+	if retries <= 0 {
+		retries = SplunkDefaultRetries
+	}
+
+	backoff := splunkBackoffBase
+	for attempt := 0; ; attempt++ {
+		resp := &hecResponse{}
+		status, err := f.post("/services/collector/event", payload, resp)
+		if err == nil {
+			if f.sc.UseAck && resp.AckId != nil {
+				f.pending[*resp.AckId] = &hecPending{payload: payload, count: count, sent: time.Now()}
+			} else {
+				atomic.AddUint64(&f.stats.SplunkSent, uint64(count))
+			}
+			return nil
+		}
+
+		if (status >= 400 && status < 500 && status != 429) || attempt >= retries {
+			return err
+		}
+
+		atomic.AddUint64(&f.stats.SplunkRetry, 1)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-f.done:
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > SplunkMaxBackoff {
+			backoff = SplunkMaxBackoff
+		}
+	}
+}
+
+func (f *splunkForwarder) flush() {
+	if f.count == 0 {
+		return
+	}
+	payload := append([]byte(nil), f.batch.Bytes()...)
+	count := f.count
+	f.batch.Reset()
+	f.count = 0
+
+	if err := f.send(payload, count); err != nil {
+		atomic.AddUint64(&f.stats.ErrSplunk, 1)
+		atomic.AddUint64(&f.stats.SplunkDropped, uint64(count))
+	}
+}
+
+// pollAcks asks HEC which pending batches are indexed.  Batches that are
+// still unacknowledged after the ack timeout are sent again, whether or not
+// HEC could be asked.
+func (f *splunkForwarder) pollAcks() {
+	if len(f.pending) == 0 {
+		return
+	}
+
+	req := struct {
+		Acks []int64 `json:"acks"`
+	}{}
+	for id := range f.pending {
+		req.Acks = append(req.Acks, id)
+	}
+	payload, _ := json.Marshal(&req)
+
+	resp := struct {
+		Acks map[string]bool `json:"acks"`
+	}{}
+	if _, err := f.post("/services/collector/ack", payload, &resp); err != nil {
+		atomic.AddUint64(&f.stats.ErrSplunk, 1)
+	}
+
+	timeout := SplunkDefaultAckTimeout
+	if f.sc.AckTimeoutSeconds > 0 {
+		timeout = time.Duration(f.sc.AckTimeoutSeconds) * time.Second
+	}
+
+	for id, p := range f.pending {
+		if resp.Acks[strconv.FormatInt(id, 10)] {
+			atomic.AddUint64(&f.stats.SplunkSent, uint64(p.count))
+			delete(f.pending, id)
+		} else if time.Since(p.sent) > timeout {
+			delete(f.pending, id)
+			atomic.AddUint64(&f.stats.SplunkRetry, 1)
+			if err := f.send(p.payload, p.count); err != nil {
+				atomic.AddUint64(&f.stats.ErrSplunk, 1)
+				atomic.AddUint64(&f.stats.SplunkDropped, uint64(p.count))
+			}
+		}
+	}
+}
+
+// adopt takes over the batches old still waits on an ack for.  Ack ids
+// only mean something on the channel that issued them, so after a change
+// of endpoint, token or channel the batches are sent again.
+func (f *splunkForwarder) adopt(old *splunkForwarder) {
+	if f.sc.URL == old.sc.URL && f.sc.Token == old.sc.Token && f.sc.Channel == old.sc.Channel {
+		f.pending = old.pending
+		return
+	}
+	for _, p := range old.pending {
+		atomic.AddUint64(&f.stats.SplunkRetry, 1)
+		if err := f.send(p.payload, p.count); err != nil {
+			atomic.AddUint64(&f.stats.ErrSplunk, 1)
+			atomic.AddUint64(&f.stats.SplunkDropped, uint64(p.count))
+		}
+	}
+}
+
+func (s *Server) splunkWorker() {
+	var f *splunkForwarder
+
+	tick := time.NewTicker(SplunkDefaultFlush)
+	defer tick.Stop()
+
+	for {
+		select {
+		case data := <-s.chanSplunk:
+			mc := s.loadConfig()
+			if mc.Splunk == nil {
+				continue
+			}
+
+			// Pick up config refreshes that change the forwarder; batches
+			// waiting on an ack go to the new one
+			if f == nil || *f.sc != *mc.Splunk {
+				nf := newSplunkForwarder(mc.Splunk, s.stats)
+				nf.done = s.done
+				if f != nil {
+					f.flush()
+					nf.adopt(f)
+					f.close()
+				}
+				f = nf
+				if mc.Splunk.FlushSeconds > 0 {
+					tick.Reset(time.Duration(mc.Splunk.FlushSeconds) * time.Second)
+				} else {
+					tick.Reset(SplunkDefaultFlush)
+				}
+			}
+
+			events, err := DecodeEvents(data)
+			if err != nil {
+				atomic.AddUint64(&s.stats.SplunkDropped, 1)
+				continue
+			}
+			f.add(events)
+
+		case <-tick.C:
+			if f != nil {
+				f.flush()
+				f.pollAcks()
+			}
+
+		case <-s.done:
+			if f != nil {
+				f.flush()
+			}
+			return
+		}
+	}
+}
+
+// opForwardSplunk hands a report to the HEC forwarder, if configured.  A
+// full queue drops the report rather than holding up the request.
+func (s *Server) opForwardSplunk(data []byte) {
+	mc := s.loadConfig()
+	if mc.Splunk == nil {
+		return
+	}
+
+	select {
+	case s.chanSplunk <- append([]byte(nil), data...):
+		// No op, it was submitted to the channel
+	default:
+		atomic.AddUint64(&s.stats.QueueFullSplunk, 1)
+	}
+}
+
+func splunkValidate(sc *SplunkConfig) error {
+	if sc.URL == "" || sc.Token == "" {
+		return errors.New("splunk requires url and token")
+	}
+	if sc.UseAck && sc.Channel == "" {
+		return errors.New("splunk useAck requires channel")
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplunkForwarder(t *testing.T) {
+	splunkBackoffBase = time.Millisecond
+
+	var posts, lines, busy int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Splunk tok" || r.Header.Get("X-Splunk-Request-Channel") != "chan" {
+			w.WriteHeader(401)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+
+		switch r.URL.Path {
+		case "/services/collector/event":
+			// First attempt is rejected as busy, to exercise the retry
+			if busy == 0 {
+				busy++
+				w.WriteHeader(503)
+				return
+			}
+			posts++
+			lines += bytes.Count(body, []byte("\n"))
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case "/services/collector/ack":
+			if !bytes.Contains(body, []byte("7")) {
+				t.Errorf("ack request %s", body)
+			}
+			w.Write([]byte(`{"acks":{"7":true}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	f := newSplunkForwarder(&SplunkConfig{URL: srv.URL, Token: "tok", Channel: "chan",
+		UseAck: true, BatchSize: 3}, &Stats{})
+
+	sent := atomic.LoadUint64(&f.stats.SplunkSent)
+	retry := atomic.LoadUint64(&f.stats.SplunkRetry)
+
+	f.add([]*Event{{TestId: 1}, {TestId: 2}})
+	if posts != 0 {
+		t.Fatal("flushed before batch was full")
+	}
+	f.add([]*Event{{TestId: 3}})
+	if posts != 1 || lines != 3 {
+		t.Fatalf("posts %d lines %d", posts, lines)
+	}
+	if atomic.LoadUint64(&f.stats.SplunkRetry) != retry+1 {
+		t.Error("retry not counted")
+	}
+	if len(f.pending) != 1 || atomic.LoadUint64(&f.stats.SplunkSent) != sent {
+		t.Fatal("batch not pending ack")
+	}
+
+	f.pollAcks()
+	if len(f.pending) != 0 || atomic.LoadUint64(&f.stats.SplunkSent) != sent+3 {
+		t.Error("ack not applied")
+	}
+}
+
+func TestSplunkNoRetryOnBadRequest(t *testing.T) {
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		w.WriteHeader(400)
+	}))
+	defer srv.Close()
+
+	f := newSplunkForwarder(&SplunkConfig{URL: srv.URL, Token: "tok"}, &Stats{})
+	dropped := atomic.LoadUint64(&f.stats.SplunkDropped)
+	f.add([]*Event{{TestId: 1}})
+	f.flush()
+
+	if posts != 1 || atomic.LoadUint64(&f.stats.SplunkDropped) != dropped+1 {
+		t.Errorf("posts %d", posts)
+	}
+}
+
+func TestSplunkBackoffShutdown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+
+	base := splunkBackoffBase
+	splunkBackoffBase = time.Hour
+	defer func() { splunkBackoffBase = base }()
+
+	done := make(chan struct{})
+	close(done)
+	f := newSplunkForwarder(&SplunkConfig{URL: srv.URL, Token: "tok"}, &Stats{})
+	f.done = done
+	f.add([]*Event{{TestId: 1}})
+	f.flush()
+	if atomic.LoadUint64(&f.stats.SplunkDropped) != 1 {
+		t.Error("batch not dropped")
+	}
+}
+
+func TestSplunkPendingAcks(t *testing.T) {
+	var events int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/services/collector/ack" {
+			w.WriteHeader(500)
+			return
+		}
+		id := atomic.AddInt64(&events, 1)
+		w.Write([]byte(`{"text":"Success","code":0,"ackId":` + strconv.FormatInt(id, 10) + `}`))
+	}))
+	defer srv.Close()
+
+	sc := SplunkConfig{URL: srv.URL, Token: "tok", Channel: "chan", UseAck: true, AckTimeoutSeconds: 1}
+	f := newSplunkForwarder(&sc, &Stats{})
+	f.add([]*Event{{TestId: 1}})
+	f.flush()
+
+	// Unacknowledged past the timeout is sent again, though HEC cannot be asked
+	for _, p := range f.pending {
+		p.sent = p.sent.Add(-time.Minute)
+	}
+	f.pollAcks()
+	if len(f.pending) != 1 || atomic.LoadInt64(&events) != 2 {
+		t.Errorf("after failed ack poll: %d pending, %d sent", len(f.pending), events)
+	}
+
+	// Acks move to a forwarder on the same channel, and are sent again on another
+	same := sc
+	same.BatchSize = 10
+	nf := newSplunkForwarder(&same, f.stats)
+	nf.adopt(f)
+	if len(nf.pending) != 1 || atomic.LoadInt64(&events) != 2 {
+		t.Errorf("same channel: %d pending, %d sent", len(nf.pending), events)
+	}
+	other := sc
+	other.Channel = "other"
+	of := newSplunkForwarder(&other, f.stats)
+	of.adopt(nf)
+	if len(of.pending) != 1 || atomic.LoadInt64(&events) != 3 {
+		t.Errorf("other channel: %d pending, %d sent", len(of.pending), events)
+	}
+}
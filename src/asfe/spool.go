@@ -0,0 +1,303 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SpoolSegmentSize   = (16 * 1024 * 1024)
+	SpoolDefaultReplay = 30 * time.Second
+	spoolSuffix        = ".spool"
+	spoolRecordHdrSize = 8
+	spoolMaxRecordSize = SpoolSegmentSize // holds a default size batch object
+)
+
+var (
+	SpoolFullError     = errors.New("Spool full")
+	SpoolCorruptError  = errors.New("Spool record corrupt")
+	SpoolTooLargeError = errors.New("Spool record too large")
+)
+
+type SpoolConfig struct {
+	Path          string `json:"path"`
+	MaxBytes      int64  `json:"maxBytes,omitempty"`
+	ReplaySeconds int    `json:"replaySeconds,omitempty"`
+}
+
+// Spool is an append-only, on-disk write-ahead log of (key, body) records.
+// Records go into numbered segment files; each record is framed as
+//
+//	[4 byte payload length][4 byte CRC32 of payload][payload]
+//
+// where payload is uvarint(len(key)) + key + body.  A torn write at the tail
+// of a segment is detected by length/CRC and truncated away at open.
+type Spool struct {
+	mu      sync.Mutex
+	dir     string
+	max     int64
+	size    int64
+	seq     uint64
+	cur     *os.File
+	curSize int64
+}
+
+func spoolSegmentName(seq uint64) string {
+	return fmt.Sprintf("%016x%s", seq, spoolSuffix)
+}
+
+// OpenSpool opens (or creates) a spool in dir, recovering any existing
+// segments.  maxBytes <= 0 means unbounded.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, max: maxBytes, seq: 1}
+
+	segs, err := s.segments(^uint64(0))
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range segs {
+		n, err := spoolRecover(filepath.Join(dir, spoolSegmentName(seq)))
+		if err != nil {
+			return nil, err
+		}
+		s.size += n
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+
+	return s, nil
+}
+
+// spoolRecover truncates a segment after its last intact record, returning
+// the resulting size.
+func spoolRecover(name string) (int64, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var good int64
+	rdr := bufio.NewReader(f)
+	for {
+		_, _, n, err := spoolReadRecord(rdr)
+		if err != nil {
+			break
+		}
+		good += n
+	}
+
+	if err := f.Truncate(good); err != nil {
+		return 0, err
+	}
+	return good, f.Sync()
+}
+
+func spoolReadRecord(r io.Reader) (string, []byte, int64, error) {
+	var hdr [spoolRecordHdrSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", nil, 0, err
+	}
+
+	l := binary.BigEndian.Uint32(hdr[0:4])
+	if l == 0 || l > spoolMaxRecordSize {
+		return "", nil, 0, SpoolCorruptError
+	}
+
+	payload := make([]byte, l)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, 0, SpoolCorruptError
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return "", nil, 0, SpoolCorruptError
+	}
+
+	kl, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < kl {
+		return "", nil, 0, SpoolCorruptError
+	}
+	key := string(payload[n : n+int(kl)])
+	body := payload[n+int(kl):]
+
+	return key, body, int64(spoolRecordHdrSize + l), nil
+}
+
+// segments lists segment sequence numbers below limit, oldest first.
+func (s *Spool) segments(limit uint64) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []uint64
+	for _, name := range names {
+		var seq uint64
+		base := strings.TrimSuffix(filepath.Base(name), spoolSuffix)
+		if _, err := fmt.Sscanf(base, "%x", &seq); err != nil {
+			continue
+		}
+		if seq < limit {
+			segs = append(segs, seq)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// Append durably writes a record; it returns once the record is synced.
+func (s *Spool) Append(key string, body []byte) error {
+	payload := make([]byte, binary.MaxVarintLen64+len(key)+len(body))
+	n := binary.PutUvarint(payload, uint64(len(key)))
+	n += copy(payload[n:], key)
+	n += copy(payload[n:], body)
+	payload = payload[0:n]
+	if len(payload) > spoolMaxRecordSize {
+		return SpoolTooLargeError
+	}
+
+	rec := make([]byte, spoolRecordHdrSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	copy(rec[spoolRecordHdrSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.max > 0 && s.size+int64(len(rec)) > s.max {
+		return SpoolFullError
+	}
+
+	if s.cur != nil && s.curSize >= SpoolSegmentSize {
+		s.cur.Close()
+		s.cur = nil
+	}
+	if s.cur == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, spoolSegmentName(s.seq)),
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		s.seq++
+		s.cur = f
+		s.curSize = 0
+	}
+
+	if _, err := s.cur.Write(rec); err != nil {
+		// Leave the torn tail for recovery; start a fresh segment next time
+		s.cur.Close()
+		s.cur = nil
+		return err
+	}
+	if err := s.cur.Sync(); err != nil {
+		return err
+	}
+
+	s.curSize += int64(len(rec))
+	s.size += int64(len(rec))
+	return nil
+}
+
+// Size returns the bytes currently held in the spool.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Replay hands every spooled record to put, oldest first.  A segment is
+// deleted once all of its records were accepted; on the first put error
+// replay stops and the remaining segments are retried on the next call.
+// Records may be handed to put more than once (after a partial replay or a
+// crash), which is harmless since keys are stable.
+func (s *Spool) Replay(put func(key string, r io.ReadSeeker) error) (int, error) {
+	// Close off the active segment so everything spooled so far is replayable
+	s.mu.Lock()
+	if s.cur != nil {
+		s.cur.Close()
+		s.cur = nil
+	}
+	limit := s.seq
+	s.mu.Unlock()
+
+	segs, err := s.segments(limit)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, seq := range segs {
+		name := filepath.Join(s.dir, spoolSegmentName(seq))
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return count, err
+		}
+
+		var good int64
+		rdr := bytes.NewReader(data)
+		for rdr.Len() > 0 {
+			key, body, n, err := spoolReadRecord(rdr)
+			if err != nil {
+				// A failed append left a torn tail; it was never counted
+				break
+			}
+			if err := put(key, bytes.NewReader(body)); err != nil {
+				return count, err
+			}
+			good += n
+			count++
+		}
+
+		if err := os.Remove(name); err != nil {
+			return count, err
+		}
+		s.mu.Lock()
+		s.size -= good
+		s.mu.Unlock()
+	}
+
+	return count, nil
+}
+
+// Close releases the active segment.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur = nil
+	return err
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolRecoverAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asfe-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append("/k1", []byte("body1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append("/k2", []byte("body2")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Simulate a crash in the middle of a third record
+	f, err := os.OpenFile(filepath.Join(dir, spoolSegmentName(1)), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 20, 1, 2})
+	f.Close()
+
+	s, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing backend leaves everything in place
+	if _, err := s.Replay(func(string, io.ReadSeeker) error { return errors.New("down") }); err == nil {
+		t.Error("replay error not reported")
+	}
+
+	got := make(map[string]string)
+	n, err := s.Replay(func(key string, r io.ReadSeeker) error {
+		b, _ := ioutil.ReadAll(r)
+		got[key] = string(b)
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("replayed %d, %v", n, err)
+	}
+	if got["/k1"] != "body1" || got["/k2"] != "body2" {
+		t.Errorf("replayed %v", got)
+	}
+	if s.Size() != 0 {
+		t.Errorf("size after replay %d", s.Size())
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asfe-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Append("/k", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append("/k", []byte("0123456789")); err != SpoolFullError {
+		t.Errorf("got %v", err)
+	}
+}
@@ -22,7 +22,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
 )
 
@@ -30,112 +29,238 @@ const (
 	StatsDuration = 1 * time.Minute
 )
 
-var (
-	StatErrParse           uint64
-	StatErrDiscarded       uint64
-	StatErrBodyRead        uint64
-	StatErrCreateKey       uint64
-	StatErrStore           uint64
-	StatErrQueueParseError uint64
-	StatErrQueueAtypical   uint64
-	StatErrConfigRefresh   uint64
-	StatErrStatReport      uint64
-
-	StatQueueFullAtypical   uint64
-	StatQueueFullParseError uint64
-
-	StatOK              uint64
-	StatRequest         uint64
-	StatAtypical        uint64
-	StatNonPool         uint64
-	StatStoredPrimary   uint64
-	StatStoredSecondary uint64
-	StatParseFallback   uint64
-	StatConfigRefresh   uint64
-)
+// Stats holds a Server's counters; update and read them atomically.
+type Stats struct {
+	ErrParse           uint64
+	ErrDiscarded       uint64
+	ErrBodyRead        uint64
+	ErrCreateKey       uint64
+	ErrStore           uint64
+	ErrQueueParseError uint64
+	ErrQueueAtypical   uint64
+	ErrConfigRefresh   uint64
+	ErrConfigSignature uint64
+	ErrStatReport      uint64
+	ErrSpoolReplay     uint64
+	ErrExport          uint64
+	ErrSplunk          uint64
+	ErrSyslog          uint64
+	ErrTaxii           uint64
+	ErrDrain           uint64
+	ErrDedupe          uint64
+	ErrBatch           uint64
+	ErrParquet         uint64
+	ErrKafka           uint64
+	ErrQueueRoute      uint64
+	ErrTLSReload       uint64
+	ErrAuthMissing     uint64
+	ErrAuthSignature   uint64
+	ErrAuthExpired     uint64
+	ErrAuthReplayFull  uint64
+	ErrQuarantine      uint64
+	ErrBodyTooLarge    uint64
+	ErrBodyEncoding    uint64
+	ErrBatchFrame      uint64
+	ErrBatchDeadline   uint64
+
+	QueueFullAtypical   uint64
+	QueueFullParseError uint64
+	QueueFullExport     uint64
+	QueueFullSplunk     uint64
+	QueueFullSyslog     uint64
+	QueueFullTaxii      uint64
+	QueueFullParquet    uint64
+	QueueFullKafka      uint64
+	QueueFullRoute      uint64
+
+	OK              uint64
+	Request         uint64
+	Atypical        uint64
+	NonPool         uint64
+	StoredPrimary   uint64
+	StoredSecondary uint64
+	ParseFallback   uint64
+	ConfigRefresh   uint64
+	ConfigRejected  uint64
+	ConfigUnchanged uint64
+	Spooled         uint64
+	SpoolReplayed   uint64
+	Exported        uint64
+	SplunkSent      uint64
+	SplunkRetry     uint64
+	SplunkDropped   uint64
+	SyslogSent      uint64
+	TaxiiObjects    uint64
+	TaxiiSkipped    uint64
+	Drained         uint64
+	DrainSpooled    uint64
+	DrainReplayed   uint64
+	DrainDropped    uint64
+	Duplicate       uint64
+	BatchObjects    uint64
+	BatchReports    uint64
+	BatchAckLate    uint64
+	ParquetFiles    uint64
+	ParquetRows     uint64
+	KafkaSent       uint64
+	Routed          uint64
+	RouteDropped    uint64
+	RouteSampledOut uint64
+	TLSReload       uint64
+	AuthVerified    uint64
+	AuthAllowed     uint64
+	AuthDropped     uint64
+	AuthReplay      uint64
+	Quarantined     uint64
+	UnknownOrg      uint64
+	UnknownApp      uint64
+	RateLimitedOrg  uint64
+	RateLimitedSys  uint64
+	LoadShed        uint64
+	Decompressed    uint64
+	BatchRequest    uint64
+	BatchItems      uint64
+}
 
-func statsWorker() {
-	sess = session.Must(session.NewSession())
-	cfg = aws.NewConfig().WithMaxRetries(2)
+// statCounter describes a Stats counter for the SNS report and /metrics
+type statCounter struct {
+	Report string
+	Metric string
+	Help   string
+	Value  func(st *Stats) *uint64
+}
 
-	for _ = range time.Tick(StatsDuration) {
+// statCounters is in SNS report order
+var statCounters = []statCounter{
+	{"Requests", "asfe_requests_total", "Requests received", func(st *Stats) *uint64 { return &st.Request }},
+	{"OK", "asfe_ok_total", "Requests accepted", func(st *Stats) *uint64 { return &st.OK }},
+	{"StoredPrimary", "asfe_stored_primary_total", "Reports stored to primary storage", func(st *Stats) *uint64 { return &st.StoredPrimary }},
+	{"StoredSecondary", "asfe_stored_secondary_total", "Reports stored to secondary storage", func(st *Stats) *uint64 { return &st.StoredSecondary }},
+	{"Atypical", "asfe_atypical_total", "Reports queued as atypical", func(st *Stats) *uint64 { return &st.Atypical }},
+	{"Nonpool", "asfe_nonpool_total", "Bodies read without a pool buffer", func(st *Stats) *uint64 { return &st.NonPool }},
+	{"ParseFallback", "asfe_parse_fallback_total", "Reports parsed by the fallback decoder", func(st *Stats) *uint64 { return &st.ParseFallback }},
+	{"ConfigRefresh", "asfe_config_refresh_total", "Successful config refreshes", func(st *Stats) *uint64 { return &st.ConfigRefresh }},
+	{"ConfigRejected", "asfe_config_rejected_total", "Configs rejected by validation", func(st *Stats) *uint64 { return &st.ConfigRejected }},
+	{"ConfigUnchanged", "asfe_config_unchanged_total", "Config refreshes with no source changed", func(st *Stats) *uint64 { return &st.ConfigUnchanged }},
+	{"Spooled", "asfe_spooled_total", "Reports written to the local spool", func(st *Stats) *uint64 { return &st.Spooled }},
+	{"SpoolReplayed", "asfe_spool_replayed_total", "Spooled reports replayed into storage", func(st *Stats) *uint64 { return &st.SpoolReplayed }},
+	{"Exported", "asfe_exported_total", "Decoded event objects stored", func(st *Stats) *uint64 { return &st.Exported }},
+	{"SplunkSent", "asfe_splunk_sent_total", "Events accepted by Splunk HEC", func(st *Stats) *uint64 { return &st.SplunkSent }},
+	{"SplunkRetry", "asfe_splunk_retry_total", "Splunk HEC batch retries", func(st *Stats) *uint64 { return &st.SplunkRetry }},
+	{"SplunkDropped", "asfe_splunk_dropped_total", "Events dropped by the Splunk forwarder", func(st *Stats) *uint64 { return &st.SplunkDropped }},
+	{"SyslogSent", "asfe_syslog_sent_total", "Events sent to syslog", func(st *Stats) *uint64 { return &st.SyslogSent }},
+	{"TaxiiObjects", "asfe_taxii_objects_total", "STIX objects added to TAXII collections", func(st *Stats) *uint64 { return &st.TaxiiObjects }},
+	{"TaxiiSkipped", "asfe_taxii_skipped_total", "Reports of orgs no TAXII principal reads, or past the collection limit", func(st *Stats) *uint64 { return &st.TaxiiSkipped }},
+	{"Drained", "asfe_drained_total", "Queued reports sent during shutdown", func(st *Stats) *uint64 { return &st.Drained }},
+	{"DrainSpooled", "asfe_drain_spooled_total", "Queued reports written to disk during shutdown", func(st *Stats) *uint64 { return &st.DrainSpooled }},
+	{"DrainReplayed", "asfe_drain_replayed_total", "Reports from a previous shutdown sent at start", func(st *Stats) *uint64 { return &st.DrainReplayed }},
+	{"DrainDropped", "asfe_drain_dropped_total", "Reports left in export and forwarding queues at shutdown", func(st *Stats) *uint64 { return &st.DrainDropped }},
+	{"Duplicate", "asfe_duplicate_total", "Duplicate reports acknowledged but not stored", func(st *Stats) *uint64 { return &st.Duplicate }},
+	{"BatchObjects", "asfe_batch_objects_total", "Batch objects stored", func(st *Stats) *uint64 { return &st.BatchObjects }},
+	{"BatchReports", "asfe_batch_reports_total", "Reports stored in batch objects", func(st *Stats) *uint64 { return &st.BatchReports }},
+	{"BatchAckLate", "asfe_batch_ack_late_total", "Stored acks answered before the batch was stored", func(st *Stats) *uint64 { return &st.BatchAckLate }},
+	{"ParquetFiles", "asfe_parquet_files_total", "Parquet files stored", func(st *Stats) *uint64 { return &st.ParquetFiles }},
+	{"ParquetRows", "asfe_parquet_rows_total", "Rows in stored Parquet files", func(st *Stats) *uint64 { return &st.ParquetRows }},
+	{"KafkaSent", "asfe_kafka_sent_total", "Messages acknowledged by Kafka", func(st *Stats) *uint64 { return &st.KafkaSent }},
+	{"Routed", "asfe_routed_total", "Reports handled by a route", func(st *Stats) *uint64 { return &st.Routed }},
+	{"RouteDropped", "asfe_route_dropped_total", "Reports dropped by a route", func(st *Stats) *uint64 { return &st.RouteDropped }},
+	{"RouteSampledOut", "asfe_route_sampled_out_total", "Reports left out by a route sample", func(st *Stats) *uint64 { return &st.RouteSampledOut }},
+	{"TLSReload", "asfe_tls_reload_total", "TLS certificate reloads", func(st *Stats) *uint64 { return &st.TLSReload }},
+	{"AuthVerified", "asfe_auth_verified_total", "Requests with a valid signature", func(st *Stats) *uint64 { return &st.AuthVerified }},
+	{"AuthAllowed", "asfe_auth_allowed_total", "Requests failing authentication accepted by policy", func(st *Stats) *uint64 { return &st.AuthAllowed }},
+	{"AuthDropped", "asfe_auth_dropped_total", "Requests failing authentication dropped by policy", func(st *Stats) *uint64 { return &st.AuthDropped }},
+	{"AuthReplay", "asfe_auth_replay_total", "Signed requests already accepted, acknowledged again", func(st *Stats) *uint64 { return &st.AuthReplay }},
+	{"Quarantined", "asfe_quarantined_total", "Reports written to quarantine storage", func(st *Stats) *uint64 { return &st.Quarantined }},
+	{"UnknownOrg", "asfe_unknown_org_total", "Reports from orgs not on the allowlist", func(st *Stats) *uint64 { return &st.UnknownOrg }},
+	{"UnknownApp", "asfe_unknown_app_total", "Reports from apps not on their org's allowlist", func(st *Stats) *uint64 { return &st.UnknownApp }},
+	{"RateLimitedOrg", "asfe_rate_limited_org_total", "Reports over their org's rate limit", func(st *Stats) *uint64 { return &st.RateLimitedOrg }},
+	{"RateLimitedSys", "asfe_rate_limited_system_total", "Reports over their device's rate limit", func(st *Stats) *uint64 { return &st.RateLimitedSys }},
+	{"LoadShed", "asfe_load_shed_total", "Requests refused over the concurrency limit", func(st *Stats) *uint64 { return &st.LoadShed }},
+	{"Decompressed", "asfe_decompressed_total", "Request bodies decompressed", func(st *Stats) *uint64 { return &st.Decompressed }},
+	{"BatchRequest", "asfe_batch_request_total", "Requests to /v1/batch", func(st *Stats) *uint64 { return &st.BatchRequest }},
+	{"BatchItems", "asfe_batch_items_total", "Reports handled from /v1/batch requests", func(st *Stats) *uint64 { return &st.BatchItems }},
+	{"ErrParse", "asfe_err_parse_total", "Unparsable reports", func(st *Stats) *uint64 { return &st.ErrParse }},
+	{"ErrDiscarded", "asfe_err_discarded_total", "Requests discarded (wrong method or empty)", func(st *Stats) *uint64 { return &st.ErrDiscarded }},
+	{"ErrBodyRead", "asfe_err_body_read_total", "Request body read failures", func(st *Stats) *uint64 { return &st.ErrBodyRead }},
+	{"ErrCreateKey", "asfe_err_create_key_total", "Storage key creation failures", func(st *Stats) *uint64 { return &st.ErrCreateKey }},
+	{"ErrStore", "asfe_err_store_total", "Reports that could not be stored", func(st *Stats) *uint64 { return &st.ErrStore }},
+	{"ErrQParse", "asfe_err_queue_parse_error_total", "Parse error queue send failures", func(st *Stats) *uint64 { return &st.ErrQueueParseError }},
+	{"ErrQAtypical", "asfe_err_queue_atypical_total", "Atypical queue send failures", func(st *Stats) *uint64 { return &st.ErrQueueAtypical }},
+	{"ErrConfigRefresh", "asfe_err_config_refresh_total", "Failed config refreshes", func(st *Stats) *uint64 { return &st.ErrConfigRefresh }},
+	{"ErrConfigSignature", "asfe_err_config_signature_total", "Config documents unsigned or failing signature checks", func(st *Stats) *uint64 { return &st.ErrConfigSignature }},
+	{"ErrStatReport", "asfe_err_stat_report_total", "Stats report publish failures", func(st *Stats) *uint64 { return &st.ErrStatReport }},
+	{"ErrSpoolReplay", "asfe_err_spool_replay_total", "Spool replay failures", func(st *Stats) *uint64 { return &st.ErrSpoolReplay }},
+	{"ErrExport", "asfe_err_export_total", "Decoded event export failures", func(st *Stats) *uint64 { return &st.ErrExport }},
+	{"ErrSplunk", "asfe_err_splunk_total", "Splunk HEC request failures", func(st *Stats) *uint64 { return &st.ErrSplunk }},
+	{"ErrSyslog", "asfe_err_syslog_total", "Syslog emit failures", func(st *Stats) *uint64 { return &st.ErrSyslog }},
+	{"ErrTaxii", "asfe_err_taxii_total", "Reports that could not be converted to STIX", func(st *Stats) *uint64 { return &st.ErrTaxii }},
+	{"ErrDrain", "asfe_err_drain_total", "Queued reports lost during shutdown, or drain replay failures", func(st *Stats) *uint64 { return &st.ErrDrain }},
+	{"ErrDedupe", "asfe_err_dedupe_total", "Seen-set write failures", func(st *Stats) *uint64 { return &st.ErrDedupe }},
+	{"ErrBatch", "asfe_err_batch_total", "Batch objects that could not be stored", func(st *Stats) *uint64 { return &st.ErrBatch }},
+	{"ErrParquet", "asfe_err_parquet_total", "Parquet export failures", func(st *Stats) *uint64 { return &st.ErrParquet }},
+	{"ErrKafka", "asfe_err_kafka_total", "Kafka messages that could not be produced", func(st *Stats) *uint64 { return &st.ErrKafka }},
+	{"ErrQRoute", "asfe_err_queue_route_total", "Route queue send failures", func(st *Stats) *uint64 { return &st.ErrQueueRoute }},
+	{"ErrTLSReload", "asfe_err_tls_reload_total", "TLS certificate reload failures", func(st *Stats) *uint64 { return &st.ErrTLSReload }},
+	{"ErrAuthMissing", "asfe_err_auth_missing_total", "Requests without a signature", func(st *Stats) *uint64 { return &st.ErrAuthMissing }},
+	{"ErrAuthSignature", "asfe_err_auth_signature_total", "Requests with a signature that does not verify", func(st *Stats) *uint64 { return &st.ErrAuthSignature }},
+	{"ErrAuthExpired", "asfe_err_auth_expired_total", "Signed requests outside the replay window", func(st *Stats) *uint64 { return &st.ErrAuthExpired }},
+	{"ErrAuthReplayFull", "asfe_err_auth_replay_full_total", "Signed requests refused while the replay cache was full", func(st *Stats) *uint64 { return &st.ErrAuthReplayFull }},
+	{"ErrQuarantine", "asfe_err_quarantine_total", "Reports that could not be quarantined", func(st *Stats) *uint64 { return &st.ErrQuarantine }},
+	{"ErrBodyTooLarge", "asfe_err_body_too_large_total", "Request bodies over the size limit", func(st *Stats) *uint64 { return &st.ErrBodyTooLarge }},
+	{"ErrBodyEncoding", "asfe_err_body_encoding_total", "Request bodies in an unsupported or broken encoding", func(st *Stats) *uint64 { return &st.ErrBodyEncoding }},
+	{"ErrBatchFrame", "asfe_err_batch_frame_total", "Batch requests with broken framing or too many reports", func(st *Stats) *uint64 { return &st.ErrBatchFrame }},
+	{"ErrBatchDeadline", "asfe_err_batch_deadline_total", "Batch reports answered 503 as the write timeout neared", func(st *Stats) *uint64 { return &st.ErrBatchDeadline }},
+	{"QFullParse", "asfe_queue_full_parse_error_total", "Parse error queue full, sent synchronously", func(st *Stats) *uint64 { return &st.QueueFullParseError }},
+	{"QFullAtypical", "asfe_queue_full_atypical_total", "Atypical queue full, sent synchronously", func(st *Stats) *uint64 { return &st.QueueFullAtypical }},
+	{"QFullExport", "asfe_queue_full_export_total", "Export queue full, exported synchronously", func(st *Stats) *uint64 { return &st.QueueFullExport }},
+	{"QFullSplunk", "asfe_queue_full_splunk_total", "Splunk queue full, report dropped", func(st *Stats) *uint64 { return &st.QueueFullSplunk }},
+	{"QFullSyslog", "asfe_queue_full_syslog_total", "Syslog queue full, report dropped", func(st *Stats) *uint64 { return &st.QueueFullSyslog }},
+	{"QFullTaxii", "asfe_queue_full_taxii_total", "TAXII queue full, report dropped", func(st *Stats) *uint64 { return &st.QueueFullTaxii }},
+	{"QFullParquet", "asfe_queue_full_parquet_total", "Parquet queue full, report dropped", func(st *Stats) *uint64 { return &st.QueueFullParquet }},
+	{"QFullKafka", "asfe_queue_full_kafka_total", "Kafka queue full, report dropped", func(st *Stats) *uint64 { return &st.QueueFullKafka }},
+	{"QFullRoute", "asfe_queue_full_route_total", "Route queue full, sent synchronously", func(st *Stats) *uint64 { return &st.QueueFullRoute }},
+}
 
-		mc := (*Config)(atomic.LoadPointer(&MainConfig))
-		if mc.TopicStats == nil {
-			continue
+// writeStatsReport renders the counters as the plain-text SNS report
+func (st *Stats) writeStatsReport(buffer *bytes.Buffer) {
+	for i, sc := range statCounters {
+		if i > 0 {
+			buffer.WriteString("\n")
 		}
+		buffer.WriteString(sc.Report)
+		buffer.WriteString(": ")
+		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(sc.Value(st)), 10))
+	}
+}
 
-		snsc := sns.New(sess, cfg.WithRegion(mc.TopicStats[0]))
-		var buffer bytes.Buffer
-
-		buffer.WriteString("Requests: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatRequest), 10))
-
-		buffer.WriteString("\nOK: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatOK), 10))
-
-		buffer.WriteString("\nStoredPrimary: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatStoredPrimary), 10))
-
-		buffer.WriteString("\nStoredSecondary: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatStoredSecondary), 10))
-
-		buffer.WriteString("\nAtypical: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatAtypical), 10))
-
-		buffer.WriteString("\nNonpool: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatNonPool), 10))
-
-		buffer.WriteString("\nParseFallback: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatParseFallback), 10))
-
-		buffer.WriteString("\nConfigRefresh: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatConfigRefresh), 10))
-
-		buffer.WriteString("\nErrParse: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrParse), 10))
-
-		buffer.WriteString("\nErrDiscarded: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrDiscarded), 10))
-
-		buffer.WriteString("\nErrBodyRead: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrBodyRead), 10))
-
-		buffer.WriteString("\nErrCreateKey: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrCreateKey), 10))
-
-		buffer.WriteString("\nErrStore: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrStore), 10))
-
-		buffer.WriteString("\nErrQParse: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrQueueParseError), 10))
-
-		buffer.WriteString("\nErrQAtypical: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrQueueAtypical), 10))
-
-		buffer.WriteString("\nErrConfigRefresh: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrConfigRefresh), 10))
+func (s *Server) publishStats() {
+	mc := s.loadConfig()
+	if mc.topicStats == nil {
+		return
+	}
 
-		buffer.WriteString("\nErrStatReport: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatErrStatReport), 10))
+	var buffer bytes.Buffer
+	s.stats.writeStatsReport(&buffer)
 
-		buffer.WriteString("\nQFullParse: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatQueueFullParseError), 10))
+	input := &sns.PublishInput{
+		Message:  aws.String(buffer.String()),
+		TopicArn: aws.String(mc.TopicStats[1]),
+	}
+	if _, err := mc.topicStats.Publish(input); err != nil {
+		atomic.AddUint64(&s.stats.ErrStatReport, 1)
+	}
+}
 
-		buffer.WriteString("\nQFullAtypical: ")
-		buffer.WriteString(strconv.FormatUint(atomic.LoadUint64(&StatQueueFullAtypical), 10))
+func (s *Server) statsWorker() {
+	tick := time.NewTicker(StatsDuration)
+	defer tick.Stop()
 
-		input := &sns.PublishInput{
-			Message:  aws.String(buffer.String()),
-			TopicArn: aws.String(mc.TopicStats[1]),
-		}
-		if _, err := snsc.Publish(input); err != nil {
-			atomic.AddUint64(&StatErrStatReport, 1)
+	for {
+		select {
+		case <-tick.C:
+			s.publishStats()
+		case <-s.done:
+			return
 		}
 	}
-
-}
-
-func statsInit() {
-	go statsWorker()
 }
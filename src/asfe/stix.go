@@ -0,0 +1,291 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	StixTimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	// RFC 4122 namespaces: STIX 2.1 SCO ids, and our own for stable SDO ids
+	stixSCONamespace  = mustParseUUID("00abedb4-aa42-466c-9c01-fed23315a9b7")
+	stixASFENamespace = mustParseUUID("9b2c3d0e-6a0f-5c8e-b1a4-41dd5ec0a7e1")
+
+	// Stable SDOs (identities, indicators) are dated at the protocol epoch
+	stixEpoch = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// StixObject is a STIX 2.1 object in its JSON form.
+type StixObject map[string]interface{}
+
+type StixBundle struct {
+	Type    string       `json:"type"`
+	Id      string       `json:"id"`
+	Objects []StixObject `json:"objects"`
+}
+
+func mustParseUUID(s string) []byte {
+	b, err := hex.DecodeString(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:36])
+	if err != nil || len(b) != 16 {
+		panic("bad uuid " + s)
+	}
+	return b
+}
+
+func formatUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func uuidV4() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b)
+}
+
+func uuidV5(ns []byte, name string) string {
+	h := sha1.New()
+	h.Write(ns)
+	h.Write([]byte(name))
+	b := h.Sum(nil)[0:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b)
+}
+
+func stixTime(t time.Time) string {
+	return t.UTC().Format(StixTimeFormat)
+}
+
+// newSCO builds a cyber observable with the deterministic id the spec
+// requires: UUIDv5 over the (sorted key) JSON of its id contributing props.
+func newSCO(typ string, props StixObject) StixObject {
+	name, _ := json.Marshal(props)
+	obj := StixObject{"type": typ, "spec_version": "2.1", "id": typ + "--" + uuidV5(stixSCONamespace, string(name))}
+	for k, v := range props {
+		obj[k] = v
+	}
+	return obj
+}
+
+func stixHashName(dt ObservationData_DataType) string {
+	switch dt {
+	case ObservationData_DataTypeHashMD5:
+		return "MD5"
+	case ObservationData_DataTypeHashSHA1:
+		return "SHA-1"
+	case ObservationData_DataTypeHashSHA256:
+		return "SHA-256"
+	}
+	return ""
+}
+
+// ObservationToSCO maps an ObservationData onto a STIX cyber observable,
+// or returns nil if there is no suitable SCO type.
+func ObservationToSCO(od *ObservationData) StixObject {
+	ed := NormalizeObservation(od)
+	if ed.Value == "" {
+		return nil
+	}
+
+	dt := ObservationData_DataType(od.GetDataType())
+	switch dt {
+	case ObservationData_DataTypeHashMD5, ObservationData_DataTypeHashSHA1, ObservationData_DataTypeHashSHA256:
+		return newSCO("file", StixObject{"hashes": map[string]string{stixHashName(dt): ed.Value}})
+	case ObservationData_DataTypeFile:
+		return newSCO("file", StixObject{"name": ed.Value})
+	case ObservationData_DataTypeIPv4:
+		if len(od.GetData()) == 4 {
+			return newSCO("ipv4-addr", StixObject{"value": ed.Value})
+		}
+	case ObservationData_DataTypeIPv6:
+		if len(od.GetData()) == 16 {
+			return newSCO("ipv6-addr", StixObject{"value": ed.Value})
+		}
+	case ObservationData_DataTypeMAC, ObservationData_DataTypeBSSID:
+		return newSCO("mac-addr", StixObject{"value": ed.Value})
+	case ObservationData_DataTypeHostname:
+		return newSCO("domain-name", StixObject{"value": ed.Value})
+	case ObservationData_DataTypeApplication:
+		return newSCO("software", StixObject{"name": ed.Value})
+	case ObservationData_DataTypeProcess, ObservationData_DataTypeCommand:
+		// Processes have no id contributing properties, so get a random id
+		return StixObject{"type": "process", "spec_version": "2.1",
+			"id": "process--" + uuidV4(), "command_line": ed.Value}
+	case ObservationData_DataTypeX509:
+		sum := sha256.Sum256(od.GetData())
+		props := StixObject{"hashes": map[string]string{"SHA-256": hex.EncodeToString(sum[:])}}
+		if cert, err := x509.ParseCertificate(od.GetData()); err == nil {
+			props["subject"] = cert.Subject.String()
+			props["issuer"] = cert.Issuer.String()
+			props["serial_number"] = cert.SerialNumber.String()
+		}
+		return newSCO("x509-certificate", props)
+	case ObservationData_DataTypeX509Subject:
+		return newSCO("x509-certificate", StixObject{"subject": ed.Value})
+	case ObservationData_DataTypeX509Issuer:
+		return newSCO("x509-certificate", StixObject{"issuer": ed.Value})
+	}
+	return nil
+}
+
+// stixConfidence maps sighting confidence onto the STIX 0-100 scale
+func stixConfidence(c uint32) int {
+	switch Sighting_SightingConfidence(c) {
+	case Sighting_SightingConfidenceLow:
+		return 15
+	case Sighting_SightingConfidenceMedium:
+		return 50
+	case Sighting_SightingConfidenceHigh:
+		return 85
+	}
+	return 0
+}
+
+func stixOrgIdentity(org string) StixObject {
+	return StixObject{
+		"type":           "identity",
+		"spec_version":   "2.1",
+		"id":             "identity--" + uuidV5(stixASFENamespace, "org:"+org),
+		"created":        stixTime(stixEpoch),
+		"modified":       stixTime(stixEpoch),
+		"name":           "Organization " + org,
+		"identity_class": "organization",
+	}
+}
+
+// stixTestIndicator is the stable SDO a sighting of a given test refers to
+func stixTestIndicator(test, sub uint32) StixObject {
+	ts := strconv.FormatUint(uint64(test), 10)
+	ss := strconv.FormatUint(uint64(sub), 10)
+	return StixObject{
+		"type":            "indicator",
+		"spec_version":    "2.1",
+		"id":              "indicator--" + uuidV5(stixASFENamespace, "test:"+ts+"."+ss),
+		"created":         stixTime(stixEpoch),
+		"modified":        stixTime(stixEpoch),
+		"name":            "MobileAwareness test " + ts + "." + ss,
+		"indicator_types": []string{"anomalous-activity"},
+		"pattern": fmt.Sprintf("[x-addsec-sighting:test_id = %s AND x-addsec-sighting:test_sub_id = %s]",
+			ts, ss),
+		"pattern_type": "stix",
+		"valid_from":   stixTime(stixEpoch),
+	}
+}
+
+// ReportToStix converts a Report to STIX 2.1 objects: an identity for the
+// organization, and per Sighting an indicator for the test, the observed
+// SCOs, an observed-data wrapping them, and the sighting itself.
+func ReportToStix(rep *Report) []StixObject {
+	events := NormalizeReport(rep)
+	if len(events) == 0 {
+		return nil
+	}
+
+	var objs []StixObject
+	seenIds := make(map[interface{}]bool)
+	add := func(obj StixObject) {
+		// Stable objects can recur within a report; emit them once
+		if !seenIds[obj["id"]] {
+			seenIds[obj["id"]] = true
+			objs = append(objs, obj)
+		}
+	}
+
+	now := time.Now()
+	ident := stixOrgIdentity(events[0].OrganizationId)
+	add(ident)
+
+	for i, s := range rep.GetSightings() {
+		ev := events[i]
+		seen := now
+		if ev.Time != nil {
+			seen = *ev.Time
+		}
+
+		ind := stixTestIndicator(ev.TestId, ev.TestSubId)
+		add(ind)
+
+		sighting := StixObject{
+			"type":                    "sighting",
+			"spec_version":            "2.1",
+			"id":                      "sighting--" + uuidV4(),
+			"created":                 stixTime(now),
+			"modified":                stixTime(now),
+			"first_seen":              stixTime(seen),
+			"last_seen":               stixTime(seen),
+			"count":                   1,
+			"sighting_of_ref":         ind["id"],
+			"where_sighted_refs":      []interface{}{ident["id"]},
+			"x_addsec_system_id":      ev.SystemId,
+			"x_addsec_system_type":    ev.SystemType,
+			"x_addsec_application_id": ev.ApplicationId,
+			"x_addsec_sighting_type":  ev.SightingType,
+			"x_addsec_impact":         ev.Impact,
+			"x_addsec_test_id":        ev.TestId,
+			"x_addsec_test_sub_id":    ev.TestSubId,
+		}
+		if c := stixConfidence(ev.ConfidenceId); c > 0 {
+			sighting["confidence"] = c
+		}
+
+		var refs []interface{}
+		for _, od := range s.GetDatas() {
+			if sco := ObservationToSCO(od); sco != nil {
+				add(sco)
+				refs = append(refs, sco["id"])
+			}
+		}
+		if len(refs) > 0 {
+			obs := StixObject{
+				"type":            "observed-data",
+				"spec_version":    "2.1",
+				"id":              "observed-data--" + uuidV4(),
+				"created":         stixTime(now),
+				"modified":        stixTime(now),
+				"first_observed":  stixTime(seen),
+				"last_observed":   stixTime(seen),
+				"number_observed": 1,
+				"object_refs":     refs,
+			}
+			add(obs)
+			sighting["observed_data_refs"] = []interface{}{obs["id"]}
+		}
+
+		add(sighting)
+	}
+
+	return objs
+}
+
+// ReportToStixBundle wraps ReportToStix in a bundle.
+func ReportToStixBundle(rep *Report) *StixBundle {
+	return &StixBundle{Type: "bundle", Id: "bundle--" + uuidV4(), Objects: ReportToStix(rep)}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func testStixReport() *Report {
+	return &Report{
+		OrganizationId: []byte{0xab, 0xcd},
+		SystemId:       []byte{0x01, 0x02},
+		SystemType:     proto.Uint32(1),
+		ApplicationId:  []byte("com.app"),
+		Sightings: []*Sighting{
+			{
+				TestId:     proto.Uint32(300),
+				Confidence: proto.Uint32(3),
+				Timestamp:  proto.Uint32(1500000000),
+				Datas: []*ObservationData{
+					{DataType: proto.Uint32(20), Data: []byte{10, 0, 0, 1}},
+					{DataType: proto.Uint32(3), Data: []byte{0xde, 0xad}},
+					{DataType: proto.Uint32(7), Data: []byte("1.0")},
+				},
+			},
+			{TestId: proto.Uint32(300)},
+		},
+	}
+}
+
+func TestReportToStix(t *testing.T) {
+	objs := ReportToStix(testStixReport())
+
+	byType := make(map[string][]StixObject)
+	for _, o := range objs {
+		byType[o["type"].(string)] = append(byType[o["type"].(string)], o)
+	}
+
+	// Identity and indicator are shared by both sightings
+	if len(byType["identity"]) != 1 || len(byType["indicator"]) != 1 || len(byType["sighting"]) != 2 {
+		t.Fatalf("objects: %v", objs)
+	}
+	if len(byType["ipv4-addr"]) != 1 || byType["ipv4-addr"][0]["value"] != "10.0.0.1" {
+		t.Errorf("ipv4: %v", byType["ipv4-addr"])
+	}
+	if len(byType["file"]) != 1 || len(byType["observed-data"]) != 1 {
+		t.Errorf("file/observed-data: %v", objs)
+	}
+
+	s := byType["sighting"][0]
+	if s["sighting_of_ref"] != byType["indicator"][0]["id"] || s["first_seen"] != "2017-07-14T02:40:00.000Z" ||
+		s["confidence"] != 85 {
+		t.Errorf("sighting: %v", s)
+	}
+	if refs, ok := s["observed_data_refs"].([]interface{}); !ok || refs[0] != byType["observed-data"][0]["id"] {
+		t.Errorf("observed_data_refs: %v", s)
+	}
+
+	// SCO ids are deterministic
+	again := ReportToStix(testStixReport())
+	for _, o := range again {
+		if o["type"] == "ipv4-addr" && o["id"] != byType["ipv4-addr"][0]["id"] {
+			t.Error("ipv4-addr id not deterministic")
+		}
+	}
+}
+
+func TestTaxiiServer(t *testing.T) {
+	s := newTestServer(t, WithConfig(&Config{Taxii: &TaxiiConfig{Principals: map[string]*TaxiiPrincipal{
+		"u":     {Password: "p", Orgs: []string{"ABCD"}},
+		"other": {Password: "o", Orgs: []string{"ef01"}},
+	}}}))
+	s.taxii.add("abcd", ReportToStix(testStixReport()), 100, 10)
+	s.taxii.add("abcd", ReportToStix(testStixReport()), 100, 10)
+	s.taxii.add("ef01", ReportToStix(testStixReport()), 100, 10)
+	colId := taxiiCollectionId("abcd")
+
+	// Only orgs a principal reads are published, in a bounded number of collections
+	if tc := s.loadConfig().Taxii; !tc.published("abcd") || tc.published("1234") {
+		t.Error("published orgs")
+	}
+	if s.taxii.add("1234", ReportToStix(testStixReport()), 100, 2) {
+		t.Error("collection over the limit")
+	}
+
+	user := "u"
+	get := func(path string, auth bool) (int, map[string]interface{}) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", taxiiMediaType)
+		if auth {
+			req.SetBasicAuth(user, map[string]string{"u": "p", "other": "o"}[user])
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		out := make(map[string]interface{})
+		json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec.Code, out
+	}
+
+	if code, _ := get(TaxiiRoot, false); code != 401 {
+		t.Errorf("unauthenticated: %d", code)
+	}
+	if code, out := get(TaxiiRoot, true); code != 200 || out["default"] != TaxiiApiRoot {
+		t.Errorf("discovery: %d %v", code, out)
+	}
+
+	code, out := get(TaxiiApiRoot+"collections/"+colId+"/objects/?match[type]=sighting&limit=3", true)
+	if code != 200 || out["more"] != true || len(out["objects"].([]interface{})) != 3 {
+		t.Fatalf("objects page 1: %d %v", code, out)
+	}
+	code, out = get(TaxiiApiRoot+"collections/"+colId+"/objects/?match[type]=sighting&limit=3&next="+
+		out["next"].(string), true)
+	if code != 200 || out["more"] != false || len(out["objects"].([]interface{})) != 1 {
+		t.Errorf("objects page 2: %d %v", code, out)
+	}
+
+	// Stable objects from the second report were not duplicated
+	code, out = get(TaxiiApiRoot+"collections/"+colId+"/objects/?match[type]=identity,indicator", true)
+	if code != 200 || len(out["objects"].([]interface{})) != 2 {
+		t.Errorf("stable objects: %d %v", code, out)
+	}
+
+	if code, _ := get(TaxiiApiRoot+"collections/nope/", true); code != 404 {
+		t.Errorf("unknown collection: %d", code)
+	}
+
+	// Principals only see the collections of their orgs
+	if code, out := get(TaxiiApiRoot+"collections/", true); code != 200 || len(out["collections"].([]interface{})) != 1 {
+		t.Errorf("collections: %d %v", code, out)
+	}
+	user = "other"
+	if code, _ := get(TaxiiApiRoot+"collections/"+colId+"/objects/", true); code != 404 {
+		t.Errorf("other org's objects: %d", code)
+	}
+	if code, _ := get(TaxiiApiRoot+"collections/"+taxiiCollectionId("ef01")+"/", true); code != 200 {
+		t.Errorf("own collection: %d", code)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	UnknownDriverError = errors.New("Unknown storage driver")
+
+	storageDriversMu sync.RWMutex
+	storageDrivers   = make(map[string]StorageDriver)
+)
+
+// Storage is a destination for raw report objects.  Put must be safe for
+// concurrent use; the reader is positioned at the start of the data.
+type Storage interface {
+	Put(key string, r io.ReadSeeker) error
+}
+
+// StorageDriver constructs a Storage from its config section.
+type StorageDriver func(sc *StorageConfig) (Storage, error)
+
+// StorageConfig selects a storage driver and carries its settings.  Not every
+// field applies to every driver.
+type StorageConfig struct {
+	Driver    string `json:"driver"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+// UnmarshalJSON accepts both the driver object and the legacy positional
+// ["region", "bucket"] form, which maps onto the s3 driver.  Like
+// ParseConfig, it rejects unknown fields.
+func (sc *StorageConfig) UnmarshalJSON(data []byte) error {
+	var legacy []string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		if len(legacy) < 2 {
+			return errors.New("Legacy storage config requires [region, bucket]")
+		}
+		*sc = StorageConfig{Driver: "s3", Region: legacy[0], Bucket: legacy[1]}
+		return nil
+	}
+
+	// A nested decode does not inherit the outer decoder's settings
+	type plain StorageConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(sc))
+}
+
+// RegisterStorageDriver makes a driver available under name.  Registering the
+// same name twice replaces the earlier driver.
+func RegisterStorageDriver(name string, d StorageDriver) {
+	storageDriversMu.Lock()
+	storageDrivers[name] = d
+	storageDriversMu.Unlock()
+}
+
+// NewStorage builds a Storage using the driver named in sc.
+func NewStorage(sc *StorageConfig) (Storage, error) {
+	storageDriversMu.RLock()
+	d, ok := storageDrivers[sc.Driver]
+	storageDriversMu.RUnlock()
+	if !ok {
+		return nil, UnknownDriverError
+	}
+	return d(sc)
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type fileStorage struct {
+	root string
+}
+
+func init() {
+	RegisterStorageDriver("file", newFileStorage)
+}
+
+func newFileStorage(sc *StorageConfig) (Storage, error) {
+	if sc.Path == "" {
+		return nil, errors.New("file storage requires path")
+	}
+	if err := os.MkdirAll(sc.Path, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStorage{root: sc.Path}, nil
+}
+
+func (s *fileStorage) Put(key string, r io.ReadSeeker) error {
+	// Cleaning against "/" keeps a hostile key from escaping the root
+	name := filepath.Join(s.root, filepath.FromSlash(filepath.Clean("/"+key)))
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename, so readers never see a partial object
+	f, err := ioutil.TempFile(dir, ".put-")
+	if err != nil {
+		return err
+	}
+
+	r.Seek(0, 0)
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultStorageKey is the historical key layout
+const DefaultStorageKey = "/{org}/{app}_{systypecode}/{sysid}/{timestamp}_{seq}"
+
+var (
+	KeyTemplateUniqueError    = errors.New("Storage key template needs {seq} or {hash}")
+	PartitionTemplateKeyError = errors.New("Partition template cannot use {seq} or {hash}")
+
+	defaultKeyTemplate = mustCompileKeyTemplate(DefaultStorageKey)
+	contentKeyTemplate = mustCompileKeyTemplate(DefaultContentStorageKey)
+)
+
+// keyVars carries the values a template can reference for one report
+type keyVars struct {
+	pi   *ParsedInfo
+	data []byte
+	kt   *keyTime
+	seq  []byte // uvarint of the counter
+}
+
+type keyField func(out []byte, v *keyVars) []byte
+
+// keyFields are the placeholders of a key template.  Dates are in the
+// location of the server clock.
+var keyFields = map[string]keyField{
+	"org":         func(out []byte, v *keyVars) []byte { return appendHex(out, v.pi.OrgId) },
+	"sysid":       func(out []byte, v *keyVars) []byte { return appendHex(out, v.pi.SysId) },
+	"app":         func(out []byte, v *keyVars) []byte { return appendKeyEscaped(out, v.pi.AppId) },
+	"systype":     func(out []byte, v *keyVars) []byte { return strconv.AppendUint(out, uint64(v.pi.SysType), 10) },
+	"systypecode": func(out []byte, v *keyVars) []byte { return appendKeyEscaped(out, []byte{byte(0x40 + v.pi.SysType)}) },
+	"timestamp":   func(out []byte, v *keyVars) []byte { return append(out, v.kt.ts...) },
+	"yyyy":        func(out []byte, v *keyVars) []byte { return append(out, v.kt.ts[0:4]...) },
+	"mm":          func(out []byte, v *keyVars) []byte { return append(out, v.kt.ts[5:7]...) },
+	"dd":          func(out []byte, v *keyVars) []byte { return append(out, v.kt.ts[8:10]...) },
+	"hh":          func(out []byte, v *keyVars) []byte { return append(out, v.kt.ts[11:13]...) },
+	"hash":        func(out []byte, v *keyVars) []byte { return appendHex(out, reportDigest(v.data)) },
+	"seq":         func(out []byte, v *keyVars) []byte { return appendHex(out, v.seq) },
+}
+
+// keyTemplate is a compiled storage key template: literals and placeholders
+// in order
+type keyTemplate struct {
+	literals []string
+	fields   []keyField // fields[i] follows literals[i]; nil for the trailing literal
+	hasSeq   bool
+	hasHash  bool
+	size     int
+}
+
+// compileKeyTemplate parses a template such as
+// "/dt={yyyy}-{mm}-{dd}/org={org}/{sysid}_{hash}".  Literal text is used as
+// is; report values are escaped so they cannot add path segments.
+func compileKeyTemplate(tmpl string) (*keyTemplate, error) {
+	kt, err := parseKeyTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if !kt.hasSeq && !kt.hasHash {
+		return nil, KeyTemplateUniqueError
+	}
+	return kt, nil
+}
+
+// compilePartitionTemplate parses a template naming a group of reports,
+// so it may only use per-report values that group well
+func compilePartitionTemplate(tmpl string) (*keyTemplate, error) {
+	kt, err := parseKeyTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	if kt.hasSeq || kt.hasHash {
+		return nil, PartitionTemplateKeyError
+	}
+	return kt, nil
+}
+
+func parseKeyTemplate(tmpl string) (*keyTemplate, error) {
+	kt := &keyTemplate{}
+
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			if strings.IndexByte(tmpl, '}') >= 0 {
+				return nil, fmt.Errorf("storage key template: unbalanced '}'")
+			}
+			kt.literals = append(kt.literals, tmpl)
+			kt.fields = append(kt.fields, nil)
+			break
+		}
+		if strings.IndexByte(tmpl[:i], '}') >= 0 {
+			return nil, fmt.Errorf("storage key template: unbalanced '}'")
+		}
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("storage key template: unterminated placeholder")
+		}
+		name := tmpl[i+1 : i+j]
+		f, ok := keyFields[name]
+		if !ok {
+			return nil, fmt.Errorf("storage key template: unknown placeholder {%s}", name)
+		}
+		switch name {
+		case "seq":
+			kt.hasSeq = true
+		case "hash":
+			kt.hasHash = true
+		}
+
+		kt.literals = append(kt.literals, tmpl[:i])
+		kt.fields = append(kt.fields, f)
+		kt.size += i + 64
+		tmpl = tmpl[i+j+1:]
+	}
+	kt.size += len(tmpl)
+	return kt, nil
+}
+
+func mustCompileKeyTemplate(tmpl string) *keyTemplate {
+	kt, err := compileKeyTemplate(tmpl)
+	if err != nil {
+		panic(err)
+	}
+	return kt
+}
+
+func (t *keyTemplate) render(v *keyVars) string {
+	out := make([]byte, 0, t.size+len(v.pi.AppId)*3)
+	for i, lit := range t.literals {
+		out = append(out, lit...)
+		if t.fields[i] != nil {
+			out = t.fields[i](out, v)
+		}
+	}
+	return string(out)
+}
+
+func appendHex(out []byte, b []byte) []byte {
+	n := len(out)
+	out = append(out, make([]byte, hex.EncodedLen(len(b)))...)
+	hex.Encode(out[n:], b)
+	return out
+}
+
+// appendKeyEscaped percent-encodes everything but [A-Za-z0-9._-], so a
+// value is always a single, printable path segment.  A value of only dots
+// is escaped too.
+func appendKeyEscaped(out []byte, b []byte) []byte {
+	dots := len(b) > 0
+	for _, c := range b {
+		if c != '.' {
+			dots = false
+			break
+		}
+	}
+
+	const hexDigits = "0123456789ABCDEF"
+	for _, c := range b {
+		if !dots && ((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '.' || c == '_' || c == '-') {
+			out = append(out, c)
+			continue
+		}
+		out = append(out, '%', hexDigits[c>>4], hexDigits[c&0xf])
+	}
+	return out
+}
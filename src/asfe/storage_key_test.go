@@ -0,0 +1,73 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorageKeyTemplate(t *testing.T) {
+	pi := &ParsedInfo{OrgId: []byte{0xab, 0xcd}, SysId: []byte{0x01, 0x02}, SysType: 1, AppId: []byte("com.app")}
+	clock := func() time.Time { return time.Date(2019, 5, 1, 7, 8, 9, 0, time.UTC) }
+	kg := newKeyGen(clock)
+
+	// The default is the historical layout
+	key, _ := kg.createStorageKey(defaultKeyTemplate, []byte("body"), pi)
+	if key != "/abcd/com.app_A/0102/2019-05-01T07:08:09_02" {
+		t.Errorf("default: %s", key)
+	}
+
+	hive := mustCompileKeyTemplate("dt={yyyy}-{mm}-{dd}/hh={hh}/org={org}/app={app}/type={systype}/{sysid}_{hash}")
+	key, _ = kg.createStorageKey(hive, []byte("body"), pi)
+	want := "dt=2019-05-01/hh=07/org=abcd/app=com.app/type=1/0102_" + hex.EncodeToString(reportDigest([]byte("body")))
+	if key != want {
+		t.Errorf("hive: %s", key)
+	}
+	if again, _ := kg.createStorageKey(hive, []byte("body"), pi); again != key {
+		t.Error("hash key not stable")
+	}
+
+	for app, want := range map[string]string{
+		"a/b":      "a%2Fb",
+		"..":       "%2E%2E",
+		"x y\xff":  "x%20y%FF",
+		"ok_1.2-3": "ok_1.2-3",
+	} {
+		pi.AppId = []byte(app)
+		key, _ = kg.createStorageKey(mustCompileKeyTemplate("{app}/{seq}"), nil, pi)
+		if !strings.HasPrefix(key, want+"/") {
+			t.Errorf("%q: %s", app, key)
+		}
+	}
+
+	// System types that are not letters cannot add path segments
+	for st, want := range map[uint32]string{0xef: "%2F", 0xee: "%2E", 0xc0: "%00", 2: "B"} {
+		pi.SysType = st
+		key, _ = kg.createStorageKey(mustCompileKeyTemplate("{systypecode}/{seq}"), nil, pi)
+		if !strings.HasPrefix(key, want+"/") {
+			t.Errorf("%#x: %s", st, key)
+		}
+	}
+
+	for _, bad := range []string{"{org}/{nope}/{seq}", "{org/{seq}", "{org}}{seq}", "/{org}/{sysid}"} {
+		if _, err := compileKeyTemplate(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type s3Storage struct {
+	client *s3.S3
+	bucket string
+}
+
+func init() {
+	RegisterStorageDriver("s3", newS3Storage)
+	RegisterStorageDriver("s3compat", newS3CompatStorage)
+}
+
+func newS3Storage(sc *StorageConfig) (Storage, error) {
+	if sc.Region == "" || sc.Bucket == "" {
+		return nil, errors.New("s3 storage requires region and bucket")
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	c := aws.NewConfig().WithMaxRetries(2).WithRegion(sc.Region)
+	if sc.Endpoint != "" {
+		c = c.WithEndpoint(sc.Endpoint).WithS3ForcePathStyle(sc.PathStyle)
+	}
+
+	return &s3Storage{client: s3.New(sess, c), bucket: sc.Bucket}, nil
+}
+
+// S3-compatible services (minio, ceph, etc.) need an explicit endpoint, and
+// usually path-style addressing; region is still required for signing.
+func newS3CompatStorage(sc *StorageConfig) (Storage, error) {
+	if sc.Endpoint == "" {
+		return nil, errors.New("s3compat storage requires endpoint")
+	}
+	return newS3Storage(sc)
+}
+
+func (s *s3Storage) Put(key string, r io.ReadSeeker) error {
+	r.Seek(0, 0)
+	inp := &s3.PutObjectInput{
+		Body:   r,
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+
+	_, err := s.client.PutObject(inp)
+	return err
+}
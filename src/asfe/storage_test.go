@@ -0,0 +1,82 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageConfigLegacy(t *testing.T) {
+	c := &Config{}
+	err := json.Unmarshal([]byte(`{"storagePrimary":["us-east-1","bucket1"],
+		"storageSecondary":{"driver":"file","path":"/tmp/x"}}`), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.StoragePrimary.Driver != "s3" || c.StoragePrimary.Region != "us-east-1" ||
+		c.StoragePrimary.Bucket != "bucket1" {
+		t.Errorf("legacy primary: %+v", c.StoragePrimary)
+	}
+	if c.StorageSecondary.Driver != "file" || c.StorageSecondary.Path != "/tmp/x" {
+		t.Errorf("secondary: %+v", c.StorageSecondary)
+	}
+
+	if err := json.Unmarshal([]byte(`{"storagePrimary":["us-east-1"]}`), &Config{}); err == nil {
+		t.Error("short legacy array accepted")
+	}
+}
+
+func TestStorageUnknownDriver(t *testing.T) {
+	if _, err := NewStorage(&StorageConfig{Driver: "nope"}); err != UnknownDriverError {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asfe-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewStorage(&StorageConfig{Driver: "file", Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("report")
+	if err := s.Put("/org/app_B/sys/ts01", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "org", "app_B", "sys", "ts01"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read back %q, %v", got, err)
+	}
+
+	// Traversal attempts stay inside the root
+	if err := s.Put("/../../escape", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err != nil {
+		t.Errorf("traversal key not contained: %v", err)
+	}
+}
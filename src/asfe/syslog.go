@@ -0,0 +1,405 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	QUEUE_SIZE_SYSLOG = 1000
+
+	SyslogDefaultFacility = 16 // local0
+	SyslogDefaultAppName  = "asfe"
+	SyslogDialTimeout     = 10 * time.Second
+
+	siemVendor  = "Addition Security"
+	siemProduct = "MobileAwareness"
+	siemVersion = "1.0"
+)
+
+var (
+	cefHeaderEscaper = strings.NewReplacer("\\", "\\\\", "|", "\\|", "\r", " ", "\n", " ")
+	cefValueEscaper  = strings.NewReplacer("\\", "\\\\", "=", "\\=", "\r", "\\r", "\n", "\\n")
+	leefValueEscaper = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+// SyslogConfig configures the CEF/LEEF syslog emitter.  Network is "udp",
+// "tcp" or "tls"; Format is "cef" or "leef".  Stream transports use RFC 6587
+// octet-counting framing.
+type SyslogConfig struct {
+	Network            string `json:"network"`
+	Address            string `json:"address"`
+	Format             string `json:"format"`
+	Facility           *int   `json:"facility,omitempty"`
+	AppName            string `json:"appName,omitempty"`
+	Hostname           string `json:"hostname,omitempty"`
+	CAFile             string `json:"caFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// syslogSeverity maps sighting impact onto RFC 5424 severity
+func syslogSeverity(impact uint32) int {
+	switch Sighting_SightingImpact(impact) {
+	case Sighting_SightingImpactMajor:
+		return 2 // critical
+	case Sighting_SightingImpactModerate:
+		return 4 // warning
+	case Sighting_SightingImpactMinor:
+		return 5 // notice
+	default:
+		return 6 // informational
+	}
+}
+
+// siemSeverity maps sighting impact onto the 0-10 CEF/LEEF scale
+func siemSeverity(impact uint32) int {
+	switch Sighting_SightingImpact(impact) {
+	case Sighting_SightingImpactMajor:
+		return 10
+	case Sighting_SightingImpactModerate:
+		return 7
+	case Sighting_SightingImpactMinor:
+		return 4
+	case Sighting_SightingImpactNone:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func siemSignature(ev *Event) string {
+	return strconv.FormatUint(uint64(ev.TestId), 10) + "." + strconv.FormatUint(uint64(ev.TestSubId), 10)
+}
+
+func eventMillis(ev *Event) int64 {
+	if ev.Time != nil {
+		return ev.Time.UnixNano() / int64(time.Millisecond)
+	}
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// FormatCEF renders an event as an ArcSight CEF:0 record.
+func FormatCEF(ev *Event) string {
+	var b bytes.Buffer
+
+	b.WriteString("CEF:0|")
+	b.WriteString(cefHeaderEscaper.Replace(siemVendor))
+	b.WriteByte('|')
+	b.WriteString(cefHeaderEscaper.Replace(siemProduct))
+	b.WriteByte('|')
+	b.WriteString(siemVersion)
+	b.WriteByte('|')
+	b.WriteString(siemSignature(ev))
+	b.WriteByte('|')
+	b.WriteString(cefHeaderEscaper.Replace(ev.SightingType))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(siemSeverity(ev.ImpactId)))
+	b.WriteByte('|')
+
+	ext := [][2]string{
+		{"rt", strconv.FormatInt(eventMillis(ev), 10)},
+		{"deviceExternalId", ev.SystemId},
+		{"cs1Label", "OrganizationId"},
+		{"cs1", ev.OrganizationId},
+		{"cs2Label", "ApplicationId"},
+		{"cs2", ev.ApplicationId},
+		{"cs3Label", "SystemType"},
+		{"cs3", ev.SystemType},
+		{"cs4Label", "Confidence"},
+		{"cs4", ev.Confidence},
+		{"cs5Label", "Impact"},
+		{"cs5", ev.Impact},
+		{"cn1Label", "TestId"},
+		{"cn1", strconv.FormatUint(uint64(ev.TestId), 10)},
+		{"cn2Label", "TestSubId"},
+		{"cn2", strconv.FormatUint(uint64(ev.TestSubId), 10)},
+	}
+	for i, kv := range ext {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(kv[0])
+		b.WriteByte('=')
+		b.WriteString(cefValueEscaper.Replace(kv[1]))
+	}
+
+	return b.String()
+}
+
+// FormatLEEF renders an event as a QRadar LEEF:2.0 record (tab delimited).
+func FormatLEEF(ev *Event) string {
+	var b bytes.Buffer
+
+	b.WriteString("LEEF:2.0|")
+	b.WriteString(siemVendor)
+	b.WriteByte('|')
+	b.WriteString(siemProduct)
+	b.WriteByte('|')
+	b.WriteString(siemVersion)
+	b.WriteByte('|')
+	b.WriteString(siemSignature(ev))
+	b.WriteByte('|')
+
+	attrs := [][2]string{
+		{"devTime", strconv.FormatInt(eventMillis(ev), 10)},
+		{"sev", strconv.Itoa(siemSeverity(ev.ImpactId))},
+		{"cat", ev.SightingType},
+		{"orgId", ev.OrganizationId},
+		{"appId", ev.ApplicationId},
+		{"systemId", ev.SystemId},
+		{"systemType", ev.SystemType},
+		{"testId", strconv.FormatUint(uint64(ev.TestId), 10)},
+		{"testSubId", strconv.FormatUint(uint64(ev.TestSubId), 10)},
+		{"confidence", ev.Confidence},
+		{"impact", ev.Impact},
+	}
+	for i, kv := range attrs {
+		if i > 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(kv[0])
+		b.WriteByte('=')
+		b.WriteString(leefValueEscaper.Replace(kv[1]))
+	}
+
+	return b.String()
+}
+
+func syslogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
+
+// FormatRFC5424 wraps msg in an RFC 5424 syslog header.
+func FormatRFC5424(facility, severity int, t time.Time, hostname, appName, msg string) []byte {
+	var b bytes.Buffer
+	b.WriteByte('<')
+	b.WriteString(strconv.Itoa(facility*8 + severity))
+	b.WriteString(">1 ")
+	b.WriteString(t.UTC().Format("2006-01-02T15:04:05.000Z"))
+	b.WriteByte(' ')
+	b.WriteString(syslogField(hostname))
+	b.WriteByte(' ')
+	b.WriteString(syslogField(appName))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(os.Getpid()))
+	b.WriteString(" - - ")
+	b.WriteString(msg)
+	return b.Bytes()
+}
+
+type syslogEmitter struct {
+	sc       *SyslogConfig
+	tlsc     *tls.Config
+	conn     net.Conn
+	facility int
+	hostname string
+	appName  string
+}
+
+func newSyslogEmitter(sc *SyslogConfig) (*syslogEmitter, error) {
+	e := &syslogEmitter{sc: sc, facility: SyslogDefaultFacility, hostname: sc.Hostname, appName: sc.AppName}
+	if sc.Facility != nil {
+		e.facility = *sc.Facility
+	}
+	if e.hostname == "" {
+		e.hostname, _ = os.Hostname()
+	}
+	if e.appName == "" {
+		e.appName = SyslogDefaultAppName
+	}
+
+	if sc.Network == "tls" {
+		e.tlsc = &tls.Config{ServerName: sc.ServerName, InsecureSkipVerify: sc.InsecureSkipVerify}
+		if sc.CAFile != "" {
+			pem, err := ioutil.ReadFile(sc.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			e.tlsc.RootCAs = x509.NewCertPool()
+			if !e.tlsc.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("syslog caFile has no certificates")
+			}
+		}
+	}
+	return e, nil
+}
+
+func (e *syslogEmitter) dial() (net.Conn, error) {
+	switch e.sc.Network {
+	case "tls":
+		d := &net.Dialer{Timeout: SyslogDialTimeout}
+		return tls.DialWithDialer(d, "tcp", e.sc.Address, e.tlsc)
+	default:
+		return net.DialTimeout(e.sc.Network, e.sc.Address, SyslogDialTimeout)
+	}
+}
+
+func (e *syslogEmitter) write(msg []byte) error {
+	if e.conn == nil {
+		c, err := e.dial()
+		if err != nil {
+			return err
+		}
+		e.conn = c
+	}
+
+	// Datagrams carry one message each; streams need octet counting
+	frame := msg
+	if e.sc.Network != "udp" {
+		frame = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	e.conn.SetWriteDeadline(time.Now().Add(SyslogDialTimeout))
+	_, err := e.conn.Write(frame)
+	return err
+}
+
+// send writes one message, reconnecting once if the connection went away
+func (e *syslogEmitter) send(msg []byte) error {
+	err := e.write(msg)
+	if err != nil && e.conn != nil {
+		e.close()
+		err = e.write(msg)
+	}
+	if err != nil {
+		e.close()
+	}
+	return err
+}
+
+func (e *syslogEmitter) emit(ev *Event) error {
+	var body string
+	if e.sc.Format == "leef" {
+		body = FormatLEEF(ev)
+	} else {
+		body = FormatCEF(ev)
+	}
+
+	t := time.Now()
+	if ev.Time != nil {
+		t = *ev.Time
+	}
+	return e.send(FormatRFC5424(e.facility, syslogSeverity(ev.ImpactId), t, e.hostname, e.appName, body))
+}
+
+func (e *syslogEmitter) close() {
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+}
+
+func (s *Server) syslogWorker() {
+	var e *syslogEmitter
+	var current unsafe.Pointer
+
+	defer func() {
+		if e != nil {
+			e.close()
+		}
+	}()
+
+	for {
+		var data []byte
+		select {
+		case data = <-s.chanSyslog:
+		case <-s.done:
+			return
+		}
+
+		mc := s.loadConfig()
+		if mc.Syslog == nil {
+			continue
+		}
+
+		if unsafe.Pointer(mc.Syslog) != current {
+			ne, err := newSyslogEmitter(mc.Syslog)
+			if err != nil {
+				atomic.AddUint64(&s.stats.ErrSyslog, 1)
+				continue
+			}
+			if e != nil {
+				e.close()
+			}
+			e, current = ne, unsafe.Pointer(mc.Syslog)
+		}
+
+		events, err := DecodeEvents(data)
+		if err != nil {
+			atomic.AddUint64(&s.stats.ErrSyslog, 1)
+			continue
+		}
+		for _, ev := range events {
+			if err := e.emit(ev); err != nil {
+				atomic.AddUint64(&s.stats.ErrSyslog, 1)
+			} else {
+				atomic.AddUint64(&s.stats.SyslogSent, 1)
+			}
+		}
+	}
+}
+
+// opForwardSyslog hands a report to the syslog emitter, if configured.  A
+// full queue drops the report rather than holding up the request.
+func (s *Server) opForwardSyslog(data []byte) {
+	mc := s.loadConfig()
+	if mc.Syslog == nil {
+		return
+	}
+
+	select {
+	case s.chanSyslog <- append([]byte(nil), data...):
+		// No op, it was submitted to the channel
+	default:
+		atomic.AddUint64(&s.stats.QueueFullSyslog, 1)
+	}
+}
+
+func syslogValidate(sc *SyslogConfig) error {
+	switch sc.Network {
+	case "udp", "tcp", "tls":
+	default:
+		return errors.New("syslog network must be udp, tcp or tls")
+	}
+	switch sc.Format {
+	case "cef", "leef":
+	default:
+		return errors.New("syslog format must be cef or leef")
+	}
+	if sc.Address == "" {
+		return errors.New("syslog requires address")
+	}
+	if sc.Facility != nil && (*sc.Facility < 0 || *sc.Facility > 23) {
+		return errors.New("syslog facility must be 0 to 23")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent() *Event {
+	t := time.Unix(1500000000, 0)
+	return &Event{
+		OrganizationId: "abcd",
+		SystemId:       "0102",
+		SystemType:     "SystemTypeAndroid",
+		ApplicationId:  "com.app|x=y",
+		SightingType:   "SightingTypeMalwareArtifacts",
+		Confidence:     "SightingConfidenceHigh",
+		Impact:         "SightingImpactMajor",
+		ImpactId:       4,
+		TestId:         300,
+		TestSubId:      2,
+		Time:           &t,
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	s := FormatCEF(testEvent())
+	if !strings.HasPrefix(s, "CEF:0|Addition Security|MobileAwareness|1.0|300.2|SightingTypeMalwareArtifacts|10|rt=1500000000000 ") {
+		t.Errorf("header: %s", s)
+	}
+	if !strings.Contains(s, `cs2=com.app|x\=y `) {
+		t.Errorf("extension escaping: %s", s)
+	}
+}
+
+func TestFormatLEEF(t *testing.T) {
+	s := FormatLEEF(testEvent())
+	if !strings.HasPrefix(s, "LEEF:2.0|Addition Security|MobileAwareness|1.0|300.2|devTime=1500000000000\tsev=10\t") {
+		t.Errorf("header: %s", s)
+	}
+	if !strings.Contains(s, "\tappId=com.app|x=y\t") {
+		t.Errorf("attributes: %s", s)
+	}
+}
+
+func TestSyslogTCPFraming(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	got := make(chan string, 2)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for i := 0; i < 2; i++ {
+			n, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			l, _ := strconv.Atoi(strings.TrimSpace(n))
+			msg := make([]byte, l)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			got <- string(msg)
+		}
+	}()
+
+	e, err := newSyslogEmitter(&SyslogConfig{Network: "tcp", Address: l.Addr().String(),
+		Format: "leef", Hostname: "gw 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.close()
+
+	for i := 0; i < 2; i++ {
+		if err := e.emit(testEvent()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-got:
+			if !strings.HasPrefix(msg, "<130>1 2017-07-14T02:40:00.000Z gw_1 asfe ") ||
+				!strings.Contains(msg, " - - LEEF:2.0|") {
+				t.Errorf("message %q", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestSyslogValidate(t *testing.T) {
+	for _, f := range []int{-1, 0, 23, 24} {
+		f := f
+		err := syslogValidate(&SyslogConfig{Network: "udp", Format: "cef", Address: "localhost:514", Facility: &f})
+		if (err == nil) != (f >= 0 && f <= 23) {
+			t.Errorf("facility %d: %v", f, err)
+		}
+	}
+}
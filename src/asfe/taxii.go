@@ -0,0 +1,432 @@
+// Copyright 2019 J Forristal LLC
+// Copyright 2016 Addition Security Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asfe
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QUEUE_SIZE_TAXII = 1000
+
+	TaxiiDefaultMaxObjects     = 10000
+	TaxiiDefaultMaxCollections = 1000
+	TaxiiDefaultLimit          = 100
+	TaxiiMaxLimit              = 1000
+	TaxiiRoot                  = "/taxii2/"
+	TaxiiApiRoot               = "/taxii2/api/"
+
+	taxiiMediaType = "application/taxii+json;version=2.1"
+	stixMediaType  = "application/stix+json;version=2.1"
+)
+
+// TaxiiConfig enables the read-only TAXII 2.1 server.  Each organization
+// some principal can read gets a collection holding its most recent
+// MaxObjects STIX objects, up to MaxCollections collections.  Clients use
+// HTTP basic auth as one of the Principals, keyed by username, and only
+// see the collections of that principal's orgs.
+type TaxiiConfig struct {
+	Title          string                     `json:"title,omitempty"`
+	Principals     map[string]*TaxiiPrincipal `json:"principals"`
+	MaxObjects     int                        `json:"maxObjects,omitempty"`
+	MaxCollections int                        `json:"maxCollections,omitempty"`
+}
+
+// TaxiiPrincipal is a TAXII consumer.  Orgs are hex org ids, or "*" for
+// every org.
+type TaxiiPrincipal struct {
+	Password string   `json:"password"`
+	Orgs     []string `json:"orgs"`
+}
+
+func (p *TaxiiPrincipal) canRead(org string) bool {
+	for _, o := range p.Orgs {
+		if o == "*" || strings.EqualFold(o, org) {
+			return true
+		}
+	}
+	return false
+}
+
+// published reports whether any principal can read org's collection
+func (tc *TaxiiConfig) published(org string) bool {
+	for _, p := range tc.Principals {
+		if p.canRead(org) {
+			return true
+		}
+	}
+	return false
+}
+
+// principal returns who a request authenticates as, or nil
+func (tc *TaxiiConfig) principal(r *http.Request) *TaxiiPrincipal {
+	u, pw, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+	p := tc.Principals[u]
+	if p == nil || subtle.ConstantTimeCompare([]byte(pw), []byte(p.Password)) != 1 {
+		return nil
+	}
+	return p
+}
+
+func taxiiValidate(tc *TaxiiConfig) error {
+	if tc.MaxObjects < 0 || tc.MaxCollections < 0 {
+		return errors.New("taxii: maxObjects and maxCollections cannot be negative")
+	}
+	if len(tc.Principals) == 0 {
+		return errors.New("taxii: requires principals")
+	}
+	for u, p := range tc.Principals {
+		if u == "" || p == nil || p.Password == "" {
+			return fmt.Errorf("taxii: principal %q requires a username and password", u)
+		}
+		if len(p.Orgs) == 0 {
+			return fmt.Errorf("taxii: principal %q requires orgs", u)
+		}
+		for _, org := range p.Orgs {
+			if b, err := hex.DecodeString(org); org != "*" && (err != nil || len(b) == 0) {
+				return fmt.Errorf("taxii: principal %q org %q is not hex", u, org)
+			}
+		}
+	}
+	return nil
+}
+
+type taxiiEntry struct {
+	seq   uint64
+	added time.Time
+	obj   StixObject
+}
+
+type taxiiCollection struct {
+	id      string
+	org     string
+	entries []taxiiEntry
+	ids     map[string]int // stable object id -> count held
+}
+
+type taxiiStore struct {
+	mu          sync.RWMutex
+	seq         uint64
+	collections map[string]*taxiiCollection // keyed by collection id
+}
+
+func newTaxiiStore() *taxiiStore {
+	return &taxiiStore{collections: make(map[string]*taxiiCollection)}
+}
+
+func taxiiCollectionId(org string) string {
+	return uuidV5(stixASFENamespace, "collection:"+org)
+}
+
+// add appends a report's objects to the org's collection.  Stable objects
+// (identity, indicator, SCOs) already held are not added again.  It
+// returns false when the org has no collection and there are already
+// maxCollections.
+func (ts *taxiiStore) add(org string, objs []StixObject, max, maxCollections int) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	id := taxiiCollectionId(org)
+	c, ok := ts.collections[id]
+	if !ok {
+		if len(ts.collections) >= maxCollections {
+			return false
+		}
+		c = &taxiiCollection{id: id, org: org, ids: make(map[string]int)}
+		ts.collections[id] = c
+	}
+
+	now := time.Now()
+	for _, obj := range objs {
+		oid, _ := obj["id"].(string)
+		if c.ids[oid] > 0 && !strings.HasPrefix(oid, "sighting--") && !strings.HasPrefix(oid, "observed-data--") {
+			continue
+		}
+		ts.seq++
+		c.entries = append(c.entries, taxiiEntry{seq: ts.seq, added: now, obj: obj})
+		c.ids[oid]++
+	}
+
+	if over := len(c.entries) - max; over > 0 {
+		for _, e := range c.entries[:over] {
+			oid, _ := e.obj["id"].(string)
+			if c.ids[oid]--; c.ids[oid] <= 0 {
+				delete(c.ids, oid)
+			}
+		}
+		c.entries = append([]taxiiEntry(nil), c.entries[over:]...)
+	}
+	return true
+}
+
+func (s *Server) taxiiWorker() {
+	for {
+		var data []byte
+		select {
+		case data = <-s.chanTaxii:
+		case <-s.done:
+			return
+		}
+
+		mc := s.loadConfig()
+		if mc.Taxii == nil {
+			continue
+		}
+
+		rep, err := DecodeReport(data)
+		if err != nil {
+			atomic.AddUint64(&s.stats.ErrTaxii, 1)
+			continue
+		}
+		// The org comes from the report, so only orgs someone reads get a
+		// collection
+		org := hex.EncodeToString(rep.GetOrganizationId())
+		if !mc.Taxii.published(org) {
+			atomic.AddUint64(&s.stats.TaxiiSkipped, 1)
+			continue
+		}
+		objs := ReportToStix(rep)
+		if len(objs) == 0 {
+			continue
+		}
+
+		max := mc.Taxii.MaxObjects
+		if max <= 0 {
+			max = TaxiiDefaultMaxObjects
+		}
+		maxCollections := mc.Taxii.MaxCollections
+		if maxCollections <= 0 {
+			maxCollections = TaxiiDefaultMaxCollections
+		}
+		if !s.taxii.add(org, objs, max, maxCollections) {
+			atomic.AddUint64(&s.stats.TaxiiSkipped, 1)
+			continue
+		}
+		atomic.AddUint64(&s.stats.TaxiiObjects, uint64(len(objs)))
+	}
+}
+
+// opPublishTaxii hands a report to the TAXII collection store, if
+// configured.  A full queue drops the report rather than holding up the request.
+func (s *Server) opPublishTaxii(data []byte) {
+	mc := s.loadConfig()
+	if mc.Taxii == nil {
+		return
+	}
+
+	select {
+	case s.chanTaxii <- append([]byte(nil), data...):
+		// No op, it was submitted to the channel
+	default:
+		atomic.AddUint64(&s.stats.QueueFullTaxii, 1)
+	}
+}
+
+func taxiiWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", taxiiMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func taxiiError(w http.ResponseWriter, status int, title string) {
+	taxiiWrite(w, status, map[string]interface{}{"title": title, "http_status": strconv.Itoa(status)})
+}
+
+func (c *taxiiCollection) resource() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          c.id,
+		"title":       "Organization " + c.org,
+		"can_read":    true,
+		"can_write":   false,
+		"media_types": []string{stixMediaType},
+	}
+}
+
+// handleTaxii serves the TAXII 2.1 discovery, API root, collections and
+// objects endpoints, read-only.
+func (s *Server) handleTaxii(w http.ResponseWriter, r *http.Request) {
+	mc := s.loadConfig()
+	if mc.Taxii == nil {
+		http.NotFound(w, r)
+		return
+	}
+	tc := mc.Taxii
+
+	p := tc.principal(r)
+	if p == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="taxii"`)
+		taxiiError(w, 401, "Unauthorized")
+		return
+	}
+
+	if r.Method != "GET" {
+		taxiiError(w, 405, "Method not allowed")
+		return
+	}
+	if a := r.Header.Get("Accept"); a != "" && !strings.Contains(a, "application/taxii+json") &&
+		!strings.Contains(a, "*/*") {
+		taxiiError(w, 406, "Not acceptable")
+		return
+	}
+
+	title := tc.Title
+	if title == "" {
+		title = "Addition Security sightings"
+	}
+
+	path := r.URL.Path
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	switch {
+	case path == TaxiiRoot:
+		taxiiWrite(w, 200, map[string]interface{}{
+			"title":     title,
+			"default":   TaxiiApiRoot,
+			"api_roots": []string{TaxiiApiRoot},
+		})
+
+	case path == TaxiiApiRoot:
+		taxiiWrite(w, 200, map[string]interface{}{
+			"title":              title,
+			"versions":           []string{taxiiMediaType},
+			"max_content_length": 0,
+		})
+
+	case path == TaxiiApiRoot+"collections/":
+		s.taxii.mu.RLock()
+		cols := make([]map[string]interface{}, 0, len(s.taxii.collections))
+		for _, c := range s.taxii.collections {
+			if p.canRead(c.org) {
+				cols = append(cols, c.resource())
+			}
+		}
+		s.taxii.mu.RUnlock()
+		sort.Slice(cols, func(i, j int) bool { return cols[i]["id"].(string) < cols[j]["id"].(string) })
+		taxiiWrite(w, 200, map[string]interface{}{"collections": cols})
+
+	case strings.HasPrefix(path, TaxiiApiRoot+"collections/"):
+		parts := strings.Split(strings.TrimPrefix(path, TaxiiApiRoot+"collections/"), "/")
+		// parts: [id, ""] or [id, "objects", ""]
+		s.taxii.mu.RLock()
+		defer s.taxii.mu.RUnlock()
+		// Collections of other orgs are not found, rather than forbidden
+		c, ok := s.taxii.collections[parts[0]]
+		if !ok || !p.canRead(c.org) {
+			taxiiError(w, 404, "Collection not found")
+			return
+		}
+		if len(parts) == 2 {
+			taxiiWrite(w, 200, c.resource())
+		} else if len(parts) == 3 && parts[1] == "objects" {
+			taxiiObjects(w, r, c)
+		} else {
+			taxiiError(w, 404, "Not found")
+		}
+
+	default:
+		taxiiError(w, 404, "Not found")
+	}
+}
+
+// taxiiObjects serves an envelope of collection objects, honouring
+// added_after, match[type], limit and next.  Caller holds the read lock.
+func taxiiObjects(w http.ResponseWriter, r *http.Request, c *taxiiCollection) {
+	q := r.URL.Query()
+
+	limit := TaxiiDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	if limit > TaxiiMaxLimit {
+		limit = TaxiiMaxLimit
+	}
+
+	var after time.Time
+	if v := q.Get("added_after"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			taxiiError(w, 400, "Bad added_after")
+			return
+		}
+		after = t
+	}
+
+	var next uint64
+	if v := q.Get("next"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			taxiiError(w, 400, "Bad next")
+			return
+		}
+		next = n
+	}
+
+	types := make(map[string]bool)
+	if v := q.Get("match[type]"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			types[t] = true
+		}
+	}
+
+	var out []taxiiEntry
+	more := false
+	for _, e := range c.entries {
+		if e.seq <= next || !e.added.After(after) {
+			continue
+		}
+		if len(types) > 0 && !types[e.obj["type"].(string)] {
+			continue
+		}
+		if len(out) == limit {
+			more = true
+			break
+		}
+		out = append(out, e)
+	}
+
+	env := map[string]interface{}{"more": more}
+	if len(out) > 0 {
+		objs := make([]StixObject, len(out))
+		for i, e := range out {
+			objs[i] = e.obj
+		}
+		env["objects"] = objs
+		w.Header().Set("X-TAXII-Date-Added-First", stixTime(out[0].added))
+		w.Header().Set("X-TAXII-Date-Added-Last", stixTime(out[len(out)-1].added))
+		if more {
+			env["next"] = strconv.FormatUint(out[len(out)-1].seq, 10)
+		}
+	}
+	taxiiWrite(w, 200, env)
+}
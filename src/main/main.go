@@ -2,9 +2,13 @@ package main
 
 import (
 	"asfe"
+	"os"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(asfe.ValidateConfigCommand(os.Args[2:], os.Stdout))
+	}
 	asfe.Main()
 }
 